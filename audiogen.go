@@ -10,40 +10,53 @@ import (
 )
 
 type Audiogen struct {
+	backendBase
 }
 
-var AudiogenOutFilePath = os.TempDir() + "/0.wav"
+const AudiogenOutFileName = "0.wav"
 
-func (a *Audiogen) CleanupOutputFiles() {
-	os.Remove(AudiogenOutFilePath)
+func (a *Audiogen) Name() string                        { return "audiogen" }
+func (a *Audiogen) Description() string                 { return "generate audio" }
+func (a *Audiogen) PromptUsage() string                 { return "[prompt]" }
+func (a *Audiogen) NeedsAudio(reqParams ReqParams) bool { return false }
+
+func (a *Audiogen) NewParams() ReqParams {
+	r := &ReqParamsAudiogen{}
+	ReqParamsSetDefaults(r)
+	return r
+}
+
+func (a *Audiogen) Prepare(req *ReqQueueReq) error {
+	if req.Prompt == "" {
+		return fmt.Errorf("empty prompt")
+	}
+	return nil
+}
+
+func (a *Audiogen) SelfCheck() error { return checkBackendBin(getParams().AudiogenBin) }
+
+func (a *Audiogen) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	res.Voice, err = a.Audiogen(ctx, qEntry, *qEntry.Req.Params.(*ReqParamsAudiogen), qEntry.Req.Prompt)
+	return
 }
 
-func (a *Audiogen) Audiogen(ctx context.Context, reqParams ReqParamsAudiogen, prompt string) (io.ReadCloser, error) {
-	a.CleanupOutputFiles()
+func (a *Audiogen) Audiogen(ctx context.Context, qEntry *ReqQueueEntry, reqParams ReqParamsAudiogen, prompt string) (io.ReadCloser, error) {
+	outFilePath := path.Join(qEntry.WorkDir, AudiogenOutFileName)
 
-	args := []string{"--description", prompt, "--output_path", os.TempDir()}
+	args := []string{"--description", prompt, "--output_path", qEntry.WorkDir}
 	if reqParams.LengthSecSet {
 		args = append(args, "--duration", strconv.Itoa(reqParams.LengthSec))
 	}
-	cmd := NewCommand(ctx, params.AudiogenBin, args...)
-	cmd.Dir = path.Dir(params.AudiogenBin)
+	cmd := newBackendCommand(ctx, qEntry, getParams().AudiogenBin, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		a.CleanupOutputFiles()
 		return nil, fmt.Errorf("audiogen error: %w: %s", err, string(output))
 	}
 
 	// Check output .wav file
-	if stat, err := os.Stat(AudiogenOutFilePath); os.IsNotExist(err) || stat.Size() == 0 {
-		a.CleanupOutputFiles()
-		return nil, fmt.Errorf("output file not found: %s", AudiogenOutFilePath)
-	}
-
-	r, err := converter.ConvertToOpus(ctx, AudiogenOutFilePath)
-	if err != nil {
-		a.CleanupOutputFiles()
-		return nil, err
+	if stat, err := os.Stat(outFilePath); os.IsNotExist(err) || stat.Size() == 0 {
+		return nil, fmt.Errorf("output file not found: %s", outFilePath)
 	}
 
-	return r, nil
+	return converter.ConvertToOpus(ctx, outFilePath)
 }
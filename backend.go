@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+)
+
+type BackendOutputKind int
+
+const (
+	BackendOutputNone  BackendOutputKind = iota // Only the done message is sent.
+	BackendOutputVoice                          // A single voice message.
+	BackendOutputAudio                          // One or more audio files.
+	BackendOutputText                           // A text reply.
+)
+
+type BackendResult struct {
+	Voice io.ReadCloser
+	Audio []UploadFileData
+	Text  string
+}
+
+// Backend is a tool which processes requests of a request type. Commands, param parsing, help and
+// queue processing are all derived from the registered backends.
+type Backend interface {
+	// The name of the request type. The command of the backend is "aai" + name.
+	Name() string
+	// Short description of the command, shown in the help.
+	Description() string
+	// Usage of the text after the params, for example "[prompt]". Shown in the help.
+	PromptUsage() string
+	// Returns a pointer to new request params filled with the default values.
+	NewParams() ReqParams
+	// Returns true if the request with the given params needs an input audio file.
+	NeedsAudio(reqParams ReqParams) bool
+	OutputKind() BackendOutputKind
+
+	// Sets up a new request after its params have been parsed, for example uses the prompt as the model
+	// name. Returns an error if the request is invalid.
+	Prepare(req *ReqQueueReq) error
+	// Checks if the request can be processed. Called before adding the request to the queue, and also
+	// before processing it as things may have changed while the request was waiting.
+	Check(req ReqQueueReq) error
+	// Processes the request. Canceled requests should return an empty result without an error.
+	Run(ctx context.Context, qEntry *ReqQueueEntry) (BackendResult, error)
+
+	// Returns true if requests can be safely run again if their processing got interrupted by a bot
+	// restart.
+	RerunAfterRestart() bool
+	// Called when a request got dropped because its processing was interrupted by a bot restart.
+	Interrupted(req ReqQueueReq)
+
+	// Checks if the backend is usable, for example if its binary exists. Called at startup, backends
+	// which fail the check are disabled.
+	SelfCheck() error
+}
+
+// Backends which have a model list command ("aai" + name + "-models").
+type BackendModelLister interface {
+	ListModels(ctx context.Context, msg *models.Message)
+}
+
+// Default implementations of the optional Backend methods.
+type backendBase struct{}
+
+func (b backendBase) PromptUsage() string                 { return "" }
+func (b backendBase) NeedsAudio(reqParams ReqParams) bool { return true }
+func (b backendBase) OutputKind() BackendOutputKind       { return BackendOutputVoice }
+func (b backendBase) Prepare(req *ReqQueueReq) error      { return nil }
+func (b backendBase) Check(req ReqQueueReq) error         { return nil }
+func (b backendBase) RerunAfterRestart() bool             { return true }
+func (b backendBase) Interrupted(req ReqQueueReq)         {}
+func (b backendBase) SelfCheck() error                    { return nil }
+
+const backendCmdPrefix = "aai"
+
+// Registered backends, indexed by ReqType.
+var backends = []Backend{&tts, &stt, &mdx, &rvc, &rvcTrain, &musicgen, &audiogen}
+
+func getBackend(t ReqType) Backend {
+	return backends[t]
+}
+
+func (t ReqType) String() string {
+	return getBackend(t).Name()
+}
+
+// Returns true if requests of this type can be safely run again if their processing got interrupted
+// by a bot restart.
+func (t ReqType) RerunAfterRestart() bool {
+	return getBackend(t).RerunAfterRestart()
+}
+
+// Request types are stored by name, as the indices of tool and profile backends depend on the tools config.
+func (t ReqType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *ReqType) UnmarshalJSON(d []byte) error {
+	var name string
+	if err := json.Unmarshal(d, &name); err != nil {
+		return fmt.Errorf("invalid request type: %s", string(d))
+	}
+
+	var err error
+	*t, err = ReqTypeFromName(name)
+	return err
+}
+
+func ReqTypeFromName(name string) (ReqType, error) {
+	for i, b := range backends {
+		if b.Name() == name {
+			return ReqType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown request type " + name)
+}
+
+// Returns the request type of the given command, or false if it's not a backend command.
+func ReqTypeFromCmd(cmd string) (ReqType, bool) {
+	for i, b := range backends {
+		if cmd == backendCmdPrefix+b.Name() {
+			return ReqType(i), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the backend which lists models with the given command, or nil if there's no such backend.
+func getModelListerFromCmd(cmd string) BackendModelLister {
+	for i, b := range backends {
+		if checkReqTypeEnabled(ReqType(i)) != nil {
+			continue
+		}
+		if lister, ok := b.(BackendModelLister); ok && cmd == backendCmdPrefix+b.Name()+"-models" {
+			return lister
+		}
+	}
+	return nil
+}
+
+// Returns the usage of the command of the backend, for example "/aaitts (-m [model]) [prompt]".
+func getBackendUsage(b Backend, cmdChar string) string {
+	s := cmdChar + backendCmdPrefix + b.Name()
+	if usage := ReqParamsUsage(b.NewParams()); usage != "" {
+		s += " " + usage
+	}
+	if usage := b.PromptUsage(); usage != "" {
+		s += " " + usage
+	}
+	return s
+}
+
+// Returns the help lines of the backend commands. Disabled commands are not shown.
+func getBackendsHelp(cmdChar string) (s string) {
+	for i, b := range backends {
+		if checkReqTypeEnabled(ReqType(i)) != nil {
+			continue
+		}
+		s += getBackendUsage(b, cmdChar) + " - " + b.Description() + "\n"
+		if _, ok := b.(BackendModelLister); ok {
+			s += cmdChar + backendCmdPrefix + b.Name() + "-models - list " + b.Name() + " models\n"
+		}
+	}
+	return
+}
+
+// Returns the detailed help of the command of the given backend.
+func getBackendHelp(b Backend, cmdChar string) string {
+	reqParams := b.NewParams()
+	s := "🤖 " + getBackendUsage(b, cmdChar) + " - " + b.Description()
+	if paramsHelp := ReqParamsHelp(reqParams); paramsHelp != "" {
+		s += "\n\nParams:\n" + paramsHelp
+	}
+	if p, ok := b.(*ProfileBackend); ok && p.cfg.Params != "" {
+		s += "\n\nDefault params of this profile: " + p.cfg.Params
+	}
+	if profiles := getProfileNames(b); len(profiles) > 0 {
+		s += "\n\nProfiles (can be selected with the -profile param): " + strings.Join(profiles, ", ")
+	}
+	if b.NeedsAudio(reqParams) {
+		s += "\n\nThe input audio file can be sent after the command, attached to the command, or the command " +
+			"can be a reply to an audio file."
+	}
+	s += "\n\nParams for all commands:\n" + ReqParamsCommonHelp(reqParams)
+	return s
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+const defaultClipboardTTL = time.Hour
+const clipboardJanitorInterval = time.Minute
+
+// Larger downloaded files are not kept, only their file IDs.
+const clipboardMaxDataSize = 20 * 1024 * 1024
+
+type ClipboardEntry struct {
+	FileID   string
+	Filename string
+	Path     string // Empty if the file has not been downloaded yet.
+	Size     int64
+	StoredAt time.Time
+}
+
+// Clipboard stores the last audio file received in each chat, so it can be reused as input audio for
+// the following commands without uploading it again. Downloaded files are kept in the clipboard dir
+// inside the instance work dir.
+type Clipboard struct {
+	mutex   sync.Mutex
+	entries map[int64]*ClipboardEntry
+}
+
+func (c *Clipboard) getDir() string {
+	return path.Join(getInstanceWorkDir(), "clipboard")
+}
+
+func (c *Clipboard) getTTL() time.Duration {
+	if getParams().ClipboardTTL > 0 {
+		return getParams().ClipboardTTL
+	}
+	return defaultClipboardTTL
+}
+
+func (c *Clipboard) removeEntry(chatID int64) {
+	if e := c.entries[chatID]; e != nil && e.Path != "" {
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("  can't remove clipboard file:", err)
+		}
+	}
+	delete(c.entries, chatID)
+}
+
+func (c *Clipboard) removeExpired() {
+	for chatID, e := range c.entries {
+		if time.Since(e.StoredAt) > c.getTTL() {
+			c.removeEntry(chatID)
+		}
+	}
+}
+
+// Periodically removes the expired entries, so their files don't stay on disk until the clipboard
+// is accessed again.
+func (c *Clipboard) janitor(ctx context.Context) {
+	ticker := time.NewTicker(clipboardJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.mutex.Lock()
+		c.removeExpired()
+		c.mutex.Unlock()
+	}
+}
+
+func (c *Clipboard) Start(ctx context.Context) {
+	go c.janitor(ctx)
+}
+
+// Stores the given audio file for the given chat. The data can be empty if the file has not been
+// downloaded yet. An already downloaded file is kept if the same file gets stored again.
+func (c *Clipboard) Set(chatID int64, fileID, filename string, d AudioFileData) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[int64]*ClipboardEntry)
+	}
+	c.removeExpired()
+
+	newEntry := &ClipboardEntry{
+		FileID:   fileID,
+		Filename: filename,
+		StoredAt: time.Now(),
+	}
+	if e, ok := c.entries[chatID]; ok && e.FileID == fileID && (d.isEmpty() || e.Path != "") {
+		newEntry.Path = e.Path
+		newEntry.Size = e.Size
+		c.entries[chatID] = newEntry
+		return
+	}
+	c.removeEntry(chatID)
+
+	if size := d.size(); size > 0 && size <= clipboardMaxDataSize {
+		filePath := path.Join(c.getDir(), fmt.Sprint(chatID)+path.Ext(filename))
+		err := os.MkdirAll(c.getDir(), 0700)
+		if err == nil {
+			err = d.writeFile(filePath)
+		}
+		if err != nil {
+			fmt.Println("  can't store clipboard file:", err)
+			os.Remove(filePath)
+		} else {
+			newEntry.Path = filePath
+			newEntry.Size = size
+		}
+	}
+	c.entries[chatID] = newEntry
+}
+
+// Returns the audio file stored for the given chat, or false if there is no (non-expired) stored file.
+func (c *Clipboard) Get(chatID int64) (ClipboardEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeExpired()
+	e, ok := c.entries[chatID]
+	if !ok {
+		return ClipboardEntry{}, false
+	}
+	return *e, true
+}
+
+// Links or copies the already downloaded file to the given path if it is stored for the given chat.
+// Returns false if the file is not available.
+func (c *Clipboard) CopyFile(chatID int64, fileID, dst string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeExpired()
+	e, ok := c.entries[chatID]
+	if !ok || e.FileID != fileID || e.Path == "" {
+		return false
+	}
+	if err := linkOrCopyFile(dst, e.Path); err != nil {
+		fmt.Println("  can't copy clipboard file:", err)
+		return false
+	}
+	return true
+}
+
+func (c *Clipboard) Show(ctx context.Context, msg *models.Message) {
+	e, ok := c.Get(msg.Chat.ID)
+	if !ok {
+		sendReplyToMessage(ctx, msg, "📋 Clipboard is empty")
+		return
+	}
+
+	s := "📋 Clipboard: " + e.Filename
+	if e.Path != "" {
+		s += fmt.Sprintf(" (%.1f MB)", float64(e.Size)/1024/1024)
+	}
+	s += "\nStored " + time.Since(e.StoredAt).Round(time.Second).String() + " ago, expires in " +
+		time.Until(e.StoredAt.Add(c.getTTL())).Round(time.Second).String()
+	sendReplyToMessage(ctx, msg, s)
+}
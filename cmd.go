@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -15,12 +16,17 @@ import (
 type Cmd struct {
 	ctx context.Context
 	*exec.Cmd
+
+	// If set, the command is run by this warm daemon if it supports the daemon mode.
+	daemon *Daemon
+	// True if the command has been run by the daemon.
+	daemonDone bool
 }
 
 // NewCommand is like exec.CommandContext but ensures that subprocesses
 // are killed when the context times out, not just the top level process.
 func NewCommand(ctx context.Context, command string, args ...string) *Cmd {
-	return &Cmd{ctx, exec.Command(command, args...)}
+	return &Cmd{ctx: ctx, Cmd: exec.Command(command, args...)}
 }
 
 func (c *Cmd) Start() error {
@@ -48,6 +54,40 @@ func (c *Cmd) Start() error {
 	return nil
 }
 
+// Runs the command with the daemon. Returns errDaemonNotSupported if the command should be run
+// without the daemon.
+func (c *Cmd) runWithDaemon(processLineCallback func(string)) (canceled bool, err error) {
+	if c.daemon == nil {
+		return false, errDaemonNotSupported
+	}
+	canceled, err = c.daemon.Run(c.ctx, c.Args[1:], c.Dir, c.Stdin, processLineCallback)
+	if err != errDaemonNotSupported {
+		c.daemonDone = true
+	}
+	return
+}
+
+func (c *Cmd) Wait() error {
+	if c.daemonDone {
+		return nil
+	}
+	return c.Cmd.Wait()
+}
+
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	var output bytes.Buffer
+	canceled, err := c.runWithDaemon(func(line string) {
+		output.WriteString(line + "\n")
+	})
+	if err == errDaemonNotSupported {
+		return c.Cmd.CombinedOutput()
+	}
+	if canceled {
+		err = c.ctx.Err()
+	}
+	return output.Bytes(), err
+}
+
 func (c *Cmd) Run() error {
 	if err := c.Start(); err != nil {
 		return err
@@ -114,6 +154,10 @@ func (c *Cmd) ParseOutput(doneChan chan bool, lineChan chan string, errChan chan
 }
 
 func (c *Cmd) RunAndProcessOutput(processLineCallback func(string)) (canceled bool, err error) {
+	if canceled, err = c.runWithDaemon(processLineCallback); err != errDaemonNotSupported {
+		return
+	}
+
 	doneChan := make(chan bool)
 	defer close(doneChan)
 	lineChan := make(chan string)
@@ -142,7 +186,6 @@ selectForLoop:
 			break selectForLoop
 		}
 	}
-	reqQueue.currentEntry.entry.cancelProcessUpdate()
 	<-doneChan
 	return false, err
 }
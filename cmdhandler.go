@@ -2,200 +2,317 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 )
 
 type cmdHandlerType struct{}
 
-func (c *cmdHandlerType) TTS(ctx context.Context, prompt string, msg *models.Message) {
-	reqParams := ReqParamsTTS{
-		Model: params.TTSDefaultModel,
+// Checks the params which can be used with all request types and adds the request to the queue.
+func (c *cmdHandlerType) addReq(ctx context.Context, req ReqQueueReq) {
+	if req.Params.Common().Timeout > 0 && !isAdmin(req.Message.From.ID) {
+		sendReplyToMessage(ctx, req.Message, errorStr+": only admins can set the timeout")
+		return
 	}
-	var err error
-	prompt, err = ReqParamsParse(ctx, prompt, &reqParams)
+
+	quotaRes, err := quota.Reserve(req.Message, req.Type)
 	if err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
+		sendReplyToMessage(ctx, req.Message, errorStr+": "+err.Error())
 		return
 	}
 
-	if prompt == "" {
-		sendReplyToMessage(ctx, msg, errorStr+": empty prompt")
+	reqQueue.Add(req, quotaRes)
+}
+
+// Parses the params of a backend command and adds the request to the queue.
+func (c *cmdHandlerType) Req(ctx context.Context, reqType ReqType, text string, msg *models.Message) {
+	b := getBackend(reqType)
+	reqParams := b.NewParams()
+	prompt, err := ReqParamsParse(ctx, text, reqParams)
+	if err != nil {
+		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
 		return
 	}
-	if reqParams.Model == "" {
-		sendReplyToMessage(ctx, msg, errorStr+": no model given")
+	if profile := reqParams.Common().Profile; profile != "" {
+		// Requests of profiles are of the profile's request type, and the params are parsed again to
+		// get the default params of the profile.
+		if reqType, err = getProfile(b, profile); err != nil {
+			sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+			return
+		}
+		b = getBackend(reqType)
+		reqParams = b.NewParams()
+		if prompt, err = ReqParamsParse(ctx, text, reqParams); err != nil {
+			sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
+			return
+		}
+	}
+
+	if err := checkReqTypeEnabled(reqType); err != nil {
+		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
 		return
 	}
 
 	req := ReqQueueReq{
-		Type:    ReqTypeTTS,
+		Type:    reqType,
 		Message: msg,
 		Prompt:  prompt,
 		Params:  reqParams,
 	}
-	reqQueue.Add(req)
-}
-
-func (c *cmdHandlerType) STT(ctx context.Context, msg *models.Message) {
-	reqParams := ReqParamsSTT{}
-	_, err := ReqParamsParse(ctx, msg.Text, &reqParams)
-	if err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
+	if err := b.Prepare(&req); err != nil {
+		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
 		return
 	}
-
-	req := ReqQueueReq{
-		Type:    ReqTypeSTT,
-		Message: msg,
-		Params:  reqParams,
+	if err := b.Check(req); err != nil {
+		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+		return
 	}
-	reqQueue.Add(req)
+	c.addReq(ctx, req)
 }
 
-func (c *cmdHandlerType) MDX(ctx context.Context, msg *models.Message) {
-	reqParams := ReqParamsMDX{}
-	_, err := ReqParamsParse(ctx, msg.Text, &reqParams)
-	if err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
-		return
+// Cancels the requests of the user. If a task ID is given or the message is a reply to a request, then
+// only that request gets canceled. Admins can cancel requests of other users this way.
+func (c *cmdHandlerType) Cancel(ctx context.Context, taskIDStr string, msg *models.Message) {
+	var taskID uint64
+	taskIDStr = strings.TrimSpace(taskIDStr)
+	if taskIDStr != "" {
+		var err error
+		taskID, err = strconv.ParseUint(taskIDStr, 10, 64)
+		if err != nil {
+			sendReplyToMessage(ctx, msg, errorStr+": invalid task ID")
+			return
+		}
 	}
 
-	req := ReqQueueReq{
-		Type:    ReqTypeMDX,
-		Message: msg,
-		Params:  reqParams,
+	admin := isAdmin(msg.From.ID)
+	count := reqQueue.Cancel(func(e *ReqQueueEntry) bool {
+		if taskID != 0 {
+			if e.TaskID != taskID {
+				return false
+			}
+		} else if msg.ReplyToMessage != nil {
+			if !e.isRelatedMessage(msg.ReplyToMessage) {
+				return false
+			}
+		} else {
+			return e.Req.Message.From.ID == msg.From.ID
+		}
+		return admin || e.Req.Message.From.ID == msg.From.ID
+	})
+	if count == 0 {
+		fmt.Println("  no matching request to cancel")
+		sendReplyToMessage(ctx, msg, errorStr+": no matching request to cancel")
 	}
-	reqQueue.Add(req)
 }
 
-func (c *cmdHandlerType) RVC(ctx context.Context, prompt string, msg *models.Message) {
-	reqParams := ReqParamsRVC{
-		Method:       "harvest",
-		Model:        prompt,
-		FilterRadius: 3,
+// Sets the scheduling weight of a user. Only admins can use this command.
+func (c *cmdHandlerType) Weight(ctx context.Context, args string, msg *models.Message) {
+	if !isAdmin(msg.From.ID) {
+		sendReplyToMessage(ctx, msg, errorStr+": only admins can set weights")
+		return
 	}
 
-	if reqParams.Model == "" {
-		reqParams.Model = params.RVCDefaultModel
+	sa := strings.Fields(args)
+	if len(sa) != 2 {
+		sendReplyToMessage(ctx, msg, errorStr+": usage: [user id] [weight]")
+		return
 	}
-
-	_, err := ReqParamsParse(ctx, msg.Text, &reqParams)
+	userID, err := strconv.ParseInt(sa[0], 10, 64)
 	if err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
+		sendReplyToMessage(ctx, msg, errorStr+": invalid user ID")
 		return
 	}
-
-	reqParams.Model = strings.Trim(reqParams.Model, " ")
-
-	if reqParams.Model == "" {
-		sendReplyToMessage(ctx, msg, errorStr+": no model given")
+	weight, err := strconv.ParseFloat(sa[1], 64)
+	if err != nil {
+		sendReplyToMessage(ctx, msg, errorStr+": invalid weight")
 		return
 	}
-
-	req := ReqQueueReq{
-		Type:    ReqTypeRVC,
-		Message: msg,
-		Params:  reqParams,
+	if err := reqQueue.SetUserWeight(userID, weight); err != nil {
+		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+		return
 	}
-	reqQueue.Add(req)
+	sendReplyToMessage(ctx, msg, doneStr+": weight of user #"+fmt.Sprint(userID)+" is now "+fmt.Sprint(reqQueue.GetUserWeight(userID)))
 }
 
-func (c *cmdHandlerType) RVCTrain(ctx context.Context, prompt string, msg *models.Message) {
-	reqParams := ReqParamsRVCTrain{
-		Method:    "harvest",
-		Model:     prompt,
-		BatchSize: params.RVCTrainDefaultBatchSize,
-		Epochs:    params.RVCTrainDefaultEpochs,
-	}
+const queueCallbackCancel = "queue-cancel:"
+const queueCallbackMoveToFront = "queue-top:"
 
-	_, err := ReqParamsParse(ctx, msg.Text, &reqParams)
-	if err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
-		return
+// Returns the queue status text and, for admins, the inline keyboard for managing the queued entries.
+// Non-admins only see the details of their own entries. The admin view is only used in private chats,
+// so other members of a group don't see the details of everyone's requests.
+func (c *cmdHandlerType) getQueueStatus(userID int64, admin bool) (string, *models.InlineKeyboardMarkup) {
+	running, waiting := reqQueue.GetStatus()
+	if len(running) == 0 && len(waiting) == 0 {
+		return "📋 The queue is empty", nil
 	}
 
-	reqParams.Model = strings.Trim(reqParams.Model, " ")
+	entryStr := func(e ReqQueueStatusEntry) string {
+		if !admin && e.User.ID != userID {
+			return "👤 " + e.Type.String()
+		}
+		s := "👤 " + getUserName(e.User) + " " + e.Type.String()
+		if e.Params != "" {
+			s += " " + e.Params
+		}
+		if admin {
+			s += " 🆔 " + fmt.Sprint(e.TaskID)
+		}
+		return s
+	}
 
-	if reqParams.Model == "" {
-		sendReplyToMessage(ctx, msg, errorStr+": no model given")
-		return
+	var keyboard [][]models.InlineKeyboardButton
+	var ownPositions []string
+	s := "📋 Request queue\n"
+	if len(running) > 0 {
+		s += "\n🔨 Running:\n"
+		for _, e := range running {
+			s += entryStr(e) + " (" + e.Lane + " lane, running for " + time.Since(e.Since).Round(time.Second).String() + ")"
+			if e.Progress != "" && (admin || e.User.ID == userID) {
+				s += "\n  " + e.Progress
+			}
+			s += "\n"
+			if admin {
+				keyboard = append(keyboard, []models.InlineKeyboardButton{
+					{Text: "❌ Cancel " + fmt.Sprint(e.TaskID), CallbackData: queueCallbackCancel + fmt.Sprint(e.TaskID)},
+				})
+			}
+		}
+	}
+	if len(waiting) > 0 {
+		s += "\n👨‍👦‍👦 Waiting:\n"
+		for _, e := range waiting {
+			s += "#" + fmt.Sprint(e.Pos) + " " + entryStr(e) + " (" + e.Lane + " lane, waiting for " +
+				time.Since(e.Since).Round(time.Second).String() + ")\n"
+			if e.User.ID == userID {
+				ownPositions = append(ownPositions, "#"+fmt.Sprint(e.Pos)+" in the "+e.Lane+" lane")
+			}
+			if admin {
+				keyboard = append(keyboard, []models.InlineKeyboardButton{
+					{Text: "❌ Cancel " + fmt.Sprint(e.TaskID), CallbackData: queueCallbackCancel + fmt.Sprint(e.TaskID)},
+					{Text: "⏫ Move to front", CallbackData: queueCallbackMoveToFront + fmt.Sprint(e.TaskID)},
+				})
+			}
+		}
+	}
+	if len(ownPositions) > 0 {
+		s += "\nYour position: " + strings.Join(ownPositions, ", ")
+	}
+	// Telegram's message length limit is 4096 characters.
+	if r := []rune(s); len(r) > 4000 {
+		s = string(r[:4000]) + "..."
 	}
 
-	req := ReqQueueReq{
-		Type:    ReqTypeRVCTrain,
-		Message: msg,
-		Params:  reqParams,
+	if len(keyboard) == 0 {
+		return s, nil
 	}
-	reqQueue.Add(req)
+	return s, &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 }
 
-func (c *cmdHandlerType) Musicgen(ctx context.Context, prompt string, msg *models.Message) {
-	reqParams := ReqParamsMusicgen{}
-	var err error
-	prompt, err = ReqParamsParse(ctx, prompt, &reqParams)
-	if err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
-		return
+func (c *cmdHandlerType) Queue(ctx context.Context, msg *models.Message) {
+	admin := isAdmin(msg.From.ID) && msg.Chat.ID >= 0 // Only in private chats.
+	s, keyboard := c.getQueueStatus(msg.From.ID, admin)
+	sendParams := &bot.SendMessageParams{
+		ReplyToMessageID: msg.ID,
+		ChatID:           msg.Chat.ID,
+		Text:             s,
+	}
+	if keyboard != nil {
+		sendParams.ReplyMarkup = keyboard
 	}
+	if _, err := telegramAPI.SendMessage(ctx, sendParams); err != nil {
+		fmt.Println("  reply send error:", err)
+	}
+}
 
-	if prompt == "" {
-		sendReplyToMessage(ctx, msg, errorStr+": empty prompt")
-		return
+// Handles the inline keyboard buttons of the queue status message.
+func (c *cmdHandlerType) QueueCallback(ctx context.Context, callbackQuery *models.CallbackQuery) {
+	answer := func(s string) {
+		_ = telegramAPI.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: callbackQuery.ID,
+			Text:            s,
+		})
 	}
 
-	req := ReqQueueReq{
-		Type:    ReqTypeMusicgen,
-		Message: msg,
-		Prompt:  prompt,
-		Params:  reqParams,
+	if !isAdmin(callbackQuery.Sender.ID) {
+		answer("Only admins can manage the queue")
+		return
 	}
-	reqQueue.Add(req)
-}
 
-func (c *cmdHandlerType) Audiogen(ctx context.Context, prompt string, msg *models.Message) {
-	reqParams := ReqParamsAudiogen{}
+	var taskID uint64
 	var err error
-	prompt, err = ReqParamsParse(ctx, prompt, &reqParams)
+	var result string
+	if taskIDStr, found := strings.CutPrefix(callbackQuery.Data, queueCallbackCancel); found {
+		if taskID, err = strconv.ParseUint(taskIDStr, 10, 64); err == nil {
+			if reqQueue.Cancel(func(e *ReqQueueEntry) bool { return e.TaskID == taskID }) > 0 {
+				result = "Canceled"
+			} else {
+				result = "Request not found"
+			}
+		}
+	} else if taskIDStr, found := strings.CutPrefix(callbackQuery.Data, queueCallbackMoveToFront); found {
+		if taskID, err = strconv.ParseUint(taskIDStr, 10, 64); err == nil {
+			if reqQueue.MoveToFront(taskID) {
+				result = "Moved to front"
+			} else {
+				result = "Request not found"
+			}
+		}
+	} else {
+		err = fmt.Errorf("invalid callback data")
+	}
 	if err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": can't parse params: "+err.Error())
+		answer(errorStr + ": " + err.Error())
 		return
 	}
+	answer(result)
 
-	if prompt == "" {
-		sendReplyToMessage(ctx, msg, errorStr+": empty prompt")
+	if callbackQuery.Message == nil {
 		return
 	}
-
-	req := ReqQueueReq{
-		Type:    ReqTypeAudiogen,
-		Message: msg,
-		Prompt:  prompt,
-		Params:  reqParams,
+	s, keyboard := c.getQueueStatus(callbackQuery.Sender.ID, callbackQuery.Message.Chat.ID >= 0)
+	editParams := &bot.EditMessageTextParams{
+		MessageID: callbackQuery.Message.ID,
+		ChatID:    callbackQuery.Message.Chat.ID,
+		Text:      s,
+	}
+	if keyboard != nil {
+		editParams.ReplyMarkup = keyboard
+	}
+	if err := telegramAPI.EditMessageText(ctx, editParams); err != nil {
+		fmt.Println("  queue status edit error:", err)
 	}
-	reqQueue.Add(req)
 }
 
-func (c *cmdHandlerType) Cancel(ctx context.Context, msg *models.Message) {
-	if err := reqQueue.CancelCurrentEntry(ctx); err != nil {
-		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+// Shows the help, or the detailed help of the given command.
+func (c *cmdHandlerType) Help(ctx context.Context, args string, msg *models.Message, cmdChar string) {
+	if cmd := strings.TrimSpace(args); cmd != "" {
+		cmd = strings.TrimPrefix(strings.TrimLeft(cmd, "/!"), backendCmdPrefix)
+		reqType, err := ReqTypeFromName(cmd)
+		if err != nil {
+			sendReplyToMessage(ctx, msg, errorStr+": unknown command "+args)
+			return
+		}
+		if err := checkReqTypeEnabled(reqType); err != nil {
+			sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+			return
+		}
+		sendReplyToMessage(ctx, msg, getBackendHelp(getBackend(reqType), cmdChar))
+		return
 	}
-}
 
-func (c *cmdHandlerType) Help(ctx context.Context, msg *models.Message, cmdChar string) {
 	sendReplyToMessage(ctx, msg, "🤖 Audio AI Telegram Bot\n\n"+
 		"Available commands:\n\n"+
-		cmdChar+"aaitts (-m [model]) [prompt] - text to speech\n"+
-		cmdChar+"aaitts-models - list text to speech models\n"+
-		cmdChar+"aaistt (-lang [language]) - speech to text\n"+
-		cmdChar+"aaimdx (-f) - music and voice separation (-f enables full output including instrument and bassline tracks)\n"+
-		cmdChar+"aairvc (model) (-m [model]) (-p [pitch]) (-method [method]) (-filter-radius [v]) (-index-rate [v]) (-rms-mix-rate [v]) - retrieval based voice conversion\n"+
-		cmdChar+"aairvc-train (model) (-m [model]) (-method [method]) (-batch-size [v]) (-epochs [v]) (-delete) - retrieval based voice conversion training\n"+
-		cmdChar+"aairvc-models - list rvc models\n"+
-		cmdChar+"aaimusicgen (-l [sec]) [prompt] - generate music based on given audio file and prompt\n"+
-		cmdChar+"aaiaudiogen (-l [sec]) [prompt] - generate audio\n"+
-		cmdChar+"aaicancel - cancel current req\n"+
-		cmdChar+"aaihelp - show this help\n\n"+
+		getBackendsHelp(cmdChar)+
+		cmdChar+"aaiclipboard - show the last audio file of this chat, use it as input with the -last param\n"+
+		cmdChar+"aaiqueue - show the request queue\n"+
+		cmdChar+"aaiweight [user id] [weight] - set the scheduling weight of a user (admins only, 0 restores the default)\n"+
+		cmdChar+"aaicancel (task id) - cancel your requests, or only the given one (you can also reply to the request to cancel)\n"+
+		cmdChar+"aaihelp (command) - show this help, or the detailed help of a command (for example "+cmdChar+"aaihelp rvc)\n\n"+
+		"Admins can set the processing timeout with the -timeout [duration] param for all commands (for example -timeout 30m)\n\n"+
 		"For more information see https://github.com/nonoo/audio-ai-telegram-bot")
 }
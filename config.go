@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// The config file is a JSON file which has the same settings as the command line arguments and the
+// environment variables, see config.json-example. Command line arguments and environment variables
+// override the settings of the config file. The config is reloaded on SIGHUP or when the file changes,
+// but only the settings in reloadableParams are applied without restarting the bot.
+
+type ConfigBackend struct {
+	Bin              string `json:"bin"`
+	Timeout          string `json:"timeout"`
+	DefaultModel     string `json:"default_model"`
+	ModelPath        string `json:"model_path"`
+	DefaultBatchSize int    `json:"default_batch_size"`
+	DefaultEpochs    int    `json:"default_epochs"`
+	APIURL           string `json:"api_url"`
+	APIKey           string `json:"api_key"`
+	APIModel         string `json:"api_model"`
+	APIVoice         string `json:"api_voice"`
+	APITimeout       string `json:"api_timeout"`
+}
+
+type ConfigFile struct {
+	BotToken          string             `json:"bot_token"`
+	BotAPIURL         string             `json:"bot_api_url"`
+	BotAPILocal       bool               `json:"bot_api_local"`
+	AllowedUserIDs    []int64            `json:"allowed_user_ids"`
+	AdminUserIDs      []int64            `json:"admin_user_ids"`
+	AllowedGroupIDs   []int64            `json:"allowed_group_ids"`
+	QueueDB           string             `json:"queue_db"`
+	ToolsConfig       string             `json:"tools_config"`
+	CheckProbe        bool               `json:"check_probe"`
+	ClipboardTTL      string             `json:"clipboard_ttl"`
+	ClipboardDefault  bool               `json:"clipboard_default"`
+	UserWeights       map[string]float64 `json:"user_weights"` // Keys are user IDs.
+	UserQuota         map[string]float64 `json:"user_quota"`   // Keys are the names of the limits, like "rvc-train:day".
+	GroupQuota        map[string]float64 `json:"group_quota"`
+	AdminQuota        map[string]float64 `json:"admin_quota"`
+	Workers           map[string]int     `json:"workers"`
+	Daemons           []string           `json:"daemons"`
+	DaemonIdleTimeout string             `json:"daemon_idle_timeout"`
+	MaxUploadSize     int                `json:"max_upload_size"` // In MB.
+	FileServer        string             `json:"file_server"`
+	FileServerURL     string             `json:"file_server_url"`
+	FileServerDir     string             `json:"file_server_dir"`
+	FileServerTTL     string             `json:"file_server_ttl"`
+	FileServerSecret  string             `json:"file_server_secret"`
+	Webhook           string             `json:"webhook"`
+	WebhookURL        string             `json:"webhook_url"`
+	WebhookSecret     string             `json:"webhook_secret"`
+	WebhookCert       string             `json:"webhook_cert"`
+	WebhookKey        string             `json:"webhook_key"`
+	WorkerServer      string             `json:"worker_server"`
+	WorkerToken       string             `json:"worker_token"`
+	WorkerConnect     string             `json:"worker_connect"`
+	WorkerName        string             `json:"worker_name"`
+	WorkerTypes       []string           `json:"worker_types"`
+	// Keys are request types, tools and profiles can only have a timeout.
+	Backends map[string]ConfigBackend `json:"backends"`
+}
+
+// Settings of the backend sections in the config file which can be used with the built-in backends.
+var configBackendSettings = map[string][]string{
+	"tts":       {"BIN", "DEFAULT_MODEL", "API_URL", "API_KEY", "API_MODEL", "API_VOICE", "API_TIMEOUT"},
+	"stt":       {"BIN", "API_URL", "API_KEY", "API_MODEL", "API_TIMEOUT"},
+	"mdx":       {"BIN"},
+	"rvc":       {"BIN", "MODEL_PATH", "DEFAULT_MODEL"},
+	"rvc-train": {"BIN", "DEFAULT_BATCH_SIZE", "DEFAULT_EPOCHS"},
+	"musicgen":  {"BIN"},
+	"audiogen":  {"BIN"},
+}
+
+// Fields of paramsType which are applied when the config is reloaded, changes of other fields need a
+// restart.
+var reloadableParams = []string{
+	"AllowedUserIDs", "AdminUserIDs", "AllowedGroupIDs",
+	"ClipboardTTL", "ClipboardDefault",
+	"UserWeights", "UserQuota", "GroupQuota", "AdminQuota",
+	"Timeouts", "Daemons", "DaemonIdleTimeout",
+	"MaxUploadSizeMB", "FileServerTTL",
+	"TTSDefaultModel", "TTSAPI", "STTAPI",
+	"RVCDefaultModel", "RVCTrainDefaultBatchSize", "RVCTrainDefaultEpochs",
+}
+
+const configCheckInterval = 5 * time.Second
+
+func joinInts(a []int64) string {
+	var sa []string
+	for _, v := range a {
+		sa = append(sa, strconv.FormatInt(v, 10))
+	}
+	return strings.Join(sa, ",")
+}
+
+// Returns the map in key=value,key=value format with sorted keys.
+func joinMap[T int | float64](m map[string]T) string {
+	var sa []string
+	for k, v := range m {
+		sa = append(sa, k+"="+strconv.FormatFloat(float64(v), 'f', -1, 64))
+	}
+	sort.Strings(sa)
+	return strings.Join(sa, ",")
+}
+
+// Returns the settings of the config file with their environment variable names as keys, so they can be
+// parsed the same way as the environment variables.
+func (c *ConfigFile) toEnv() (map[string]string, error) {
+	env := map[string]string{
+		"BOT_TOKEN":           c.BotToken,
+		"BOT_API_URL":         c.BotAPIURL,
+		"ALLOWED_USERIDS":     joinInts(c.AllowedUserIDs),
+		"ADMIN_USERIDS":       joinInts(c.AdminUserIDs),
+		"ALLOWED_GROUPIDS":    joinInts(c.AllowedGroupIDs),
+		"QUEUE_DB":            c.QueueDB,
+		"TOOLS_CONFIG":        c.ToolsConfig,
+		"CLIPBOARD_TTL":       c.ClipboardTTL,
+		"USER_WEIGHTS":        joinMap(c.UserWeights),
+		"USER_QUOTA":          joinMap(c.UserQuota),
+		"GROUP_QUOTA":         joinMap(c.GroupQuota),
+		"ADMIN_QUOTA":         joinMap(c.AdminQuota),
+		"WORKERS":             joinMap(c.Workers),
+		"DAEMONS":             strings.Join(c.Daemons, ","),
+		"DAEMON_IDLE_TIMEOUT": c.DaemonIdleTimeout,
+		"FILE_SERVER":         c.FileServer,
+		"FILE_SERVER_URL":     c.FileServerURL,
+		"FILE_SERVER_DIR":     c.FileServerDir,
+		"FILE_SERVER_TTL":     c.FileServerTTL,
+		"FILE_SERVER_SECRET":  c.FileServerSecret,
+		"WEBHOOK":             c.Webhook,
+		"WEBHOOK_URL":         c.WebhookURL,
+		"WEBHOOK_SECRET":      c.WebhookSecret,
+		"WEBHOOK_CERT":        c.WebhookCert,
+		"WEBHOOK_KEY":         c.WebhookKey,
+		"WORKER_SERVER":       c.WorkerServer,
+		"WORKER_TOKEN":        c.WorkerToken,
+		"WORKER_CONNECT":      c.WorkerConnect,
+		"WORKER_NAME":         c.WorkerName,
+		"WORKER_TYPES":        strings.Join(c.WorkerTypes, ","),
+	}
+	if c.MaxUploadSize != 0 {
+		env["MAX_UPLOAD_SIZE"] = strconv.Itoa(c.MaxUploadSize)
+	}
+	if c.BotAPILocal {
+		env["BOT_API_LOCAL"] = "true"
+	}
+	if c.CheckProbe {
+		env["CHECK_PROBE"] = "true"
+	}
+	if c.ClipboardDefault {
+		env["CLIPBOARD_DEFAULT"] = "true"
+	}
+
+	for name, b := range c.Backends {
+		settings := map[string]string{
+			"BIN":           b.Bin,
+			"TIMEOUT":       b.Timeout,
+			"DEFAULT_MODEL": b.DefaultModel,
+			"MODEL_PATH":    b.ModelPath,
+			"API_URL":       b.APIURL,
+			"API_KEY":       b.APIKey,
+			"API_MODEL":     b.APIModel,
+			"API_VOICE":     b.APIVoice,
+			"API_TIMEOUT":   b.APITimeout,
+		}
+		if b.DefaultBatchSize != 0 {
+			settings["DEFAULT_BATCH_SIZE"] = strconv.Itoa(b.DefaultBatchSize)
+		}
+		if b.DefaultEpochs != 0 {
+			settings["DEFAULT_EPOCHS"] = strconv.Itoa(b.DefaultEpochs)
+		}
+
+		prefix := strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		for setting, v := range settings {
+			if v == "" {
+				continue
+			}
+			if setting != "TIMEOUT" && !slices.Contains(configBackendSettings[name], setting) {
+				return nil, fmt.Errorf("backend " + name + " can't have the " + strings.ToLower(setting) + " setting")
+			}
+			env[prefix+setting] = v
+		}
+	}
+	return env, nil
+}
+
+// Loads the config file and returns its settings in the format of toEnv().
+func loadConfigFile(configPath string) (cfg ConfigFile, env map[string]string, err error) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("can't open config: %w", err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, nil, fmt.Errorf("can't parse config %s: %w", configPath, err)
+	}
+	if env, err = cfg.toEnv(); err != nil {
+		return cfg, nil, fmt.Errorf("config: %w", err)
+	}
+	return cfg, env, nil
+}
+
+// Checks that the backend sections of the config file belong to existing request types. This can only
+// be done after the tools are loaded.
+func (c *ConfigFile) checkBackends() error {
+	for name := range c.Backends {
+		if _, err := ReqTypeFromName(name); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the params with the reloadable fields of the given params applied, the names of the
+// applied fields, and the names of the changed fields which need a restart.
+func (p *paramsType) applyReload(n *paramsType) (res *paramsType, applied, restartNeeded []string) {
+	res = new(paramsType)
+	*res = *p
+	rv := reflect.ValueOf(res).Elem()
+	nv := reflect.ValueOf(n).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if !field.IsExported() || reflect.DeepEqual(rv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if slices.Contains(reloadableParams, field.Name) {
+			rv.Field(i).Set(nv.Field(i))
+			applied = append(applied, field.Name)
+		} else {
+			restartNeeded = append(restartNeeded, field.Name)
+		}
+	}
+	return
+}
+
+// Parses the command line arguments, environment variables and the config file again, and applies the
+// reloadable settings. Invalid configs are rejected, the current settings are kept then.
+func reloadConfig(ctx context.Context) {
+	var newParams paramsType
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := newParams.parse(fs, os.Args[1:], true); err != nil {
+		fmt.Println("can't reload config:", err)
+		sendTextToAdmins(ctx, errorStr+": can't reload config: "+err.Error())
+		return
+	}
+
+	oldParams := getParams()
+	p, applied, restartNeeded := oldParams.applyReload(&newParams)
+	// Goroutines which already got the old params keep using them, the new params are used from now on.
+	currentParams.Store(p)
+	if slices.Contains(applied, "UserWeights") {
+		reqQueue.UpdateUserWeights(oldParams.UserWeights, p.UserWeights)
+	}
+
+	fmt.Println("config reloaded, applied:", applied, "restart needed:", restartNeeded)
+	s := "✅ Config reloaded"
+	if len(applied) > 0 {
+		s += ", applied: " + strings.Join(applied, ", ")
+	} else {
+		s += ", no changes applied"
+	}
+	if len(restartNeeded) > 0 {
+		s += "\n⚠️ restart needed to apply: " + strings.Join(restartNeeded, ", ")
+	}
+	sendTextToAdmins(ctx, s)
+}
+
+func getConfigModTime() time.Time {
+	fi, err := os.Stat(getParams().ConfigPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// Reloads the config when a signal is received on the given channel or when the config file changes,
+// until the context is done.
+func watchConfig(ctx context.Context, sighupChan chan os.Signal) {
+	defer signal.Stop(sighupChan)
+
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	modTime := getConfigModTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighupChan:
+			if getParams().ConfigPath == "" {
+				fmt.Println("got SIGHUP, no config file to reload")
+				continue
+			}
+			fmt.Println("got SIGHUP, reloading config")
+			modTime = getConfigModTime()
+		case <-ticker.C:
+			if getParams().ConfigPath == "" {
+				continue
+			}
+			t := getConfigModTime()
+			if t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+			fmt.Println("config file changed, reloading")
+		}
+		reloadConfig(ctx)
+	}
+}
@@ -1,16 +1,95 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	ffmpeg_go "github.com/u2takey/ffmpeg-go"
 )
 
+// Extensions of video files by mime type, used for naming video files which have no file name.
+var videoMimeTypeExts = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/quicktime":  ".mov",
+	"video/webm":       ".webm",
+	"video/x-matroska": ".mkv",
+	"video/x-msvideo":  ".avi",
+	"video/mpeg":       ".mpg",
+	"video/3gpp":       ".3gp",
+}
+
+var videoExts = []string{".mp4", ".m4v", ".mov", ".webm", ".mkv", ".avi", ".mpg", ".mpeg", ".3gp", ".flv", ".wmv"}
+
 type Converter struct {
 }
 
+// Returns true if the file with the given mime type can be used as an input audio file. Files with an
+// unknown mime type are accepted, ffmpeg will tell if they are not usable.
+func isAudioOrVideoMimeType(mimeType string) bool {
+	return mimeType == "" || mimeType == "application/octet-stream" || mimeType == "application/ogg" ||
+		strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/")
+}
+
+func isVideoFile(filename string) bool {
+	ext := strings.ToLower(path.Ext(filename))
+	for _, e := range videoExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a file name for the given video which has a video extension, so its audio track gets extracted.
+func getVideoFilename(filename, mimeType, defaultName string) string {
+	if filename == "" {
+		filename = defaultName
+	}
+	if isVideoFile(filename) {
+		return filename
+	}
+	ext, ok := videoMimeTypeExts[mimeType]
+	if !ok {
+		ext = ".mp4"
+	}
+	return filename + ext
+}
+
+// Extracts the audio track of the given video to a FLAC file in the given dir.
+func (c *Converter) ExtractAudio(ctx context.Context, dir string, videoData AudioFileData) (d AudioFileData, err error) {
+	fmt.Print("  extracting audio from video...\n")
+
+	input := videoData.path
+	if input == "" {
+		// Videos can't be read from a pipe, as the index of mp4 files may be at the end of the file.
+		input = path.Join(dir, "video"+path.Ext(videoData.filename))
+		if err := videoData.writeFile(input); err != nil {
+			return d, fmt.Errorf("can't write video file: %w", err)
+		}
+		defer os.Remove(input)
+	}
+
+	d.filename = strings.TrimSuffix(videoData.filename, path.Ext(videoData.filename)) + ".flac"
+	d.path = path.Join(dir, "audio.flac")
+	cmd := NewCommand(ctx, "ffmpeg", "-y", "-v", "error", "-i", input, "-vn", "-map", "0:a:0", "-c:a", "flac", d.path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "matches no streams") {
+			return d, fmt.Errorf("the video has no audio track")
+		}
+		return d, fmt.Errorf("error extracting audio: %w", err)
+	}
+	return d, nil
+}
+
 func (c *Converter) ConvertToMP3(ctx context.Context, filePath string) (reader io.ReadCloser, err error) {
 	reader, writer := io.Pipe()
 
@@ -66,3 +145,26 @@ func (c *Converter) ConvertToOpus(ctx context.Context, filePath string) (reader
 
 	return reader, nil
 }
+
+func (c *Converter) GetDuration(ctx context.Context, audioData AudioFileData) (time.Duration, error) {
+	input := "pipe:0"
+	if audioData.path != "" {
+		input = audioData.path
+	}
+	cmd := NewCommand(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", input)
+	if audioData.path == "" {
+		cmd.Stdin = bytes.NewReader(audioData.data)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("error getting duration: %w", err)
+	}
+
+	secs, err := strconv.ParseFloat(strings.TrimSpace(out.String()), 64)
+	if err != nil {
+		return 0, fmt.Errorf("error getting duration: invalid ffprobe output: %s", strings.TrimSpace(out.String()))
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Warm daemons keep backend processes running between requests, so models don't have to be loaded for
+// every request. Daemons are started by running the backend's binary with the --daemon argument, and
+// talk a JSON-lines protocol on stdin/stdout:
+//
+//   - The daemon sends {"type":"ready"} when it's ready to process requests.
+//   - Run requests contain the arguments which the backend would be started with in one-shot mode:
+//     {"id":1,"type":"run","args":[...],"cwd":"...","stdin":"..."}. The daemon replies with zero or more
+//     {"id":1,"type":"output","line":"..."} messages, then {"id":1,"type":"done","exit_code":0,"error":""}.
+//   - Pings ({"id":2,"type":"ping"}) are answered with {"id":2,"type":"pong"}.
+//   - The daemon should exit when its stdin is closed.
+//
+// Backends which exit or don't send the ready message are run in one-shot mode.
+
+const daemonStartTimeout = time.Minute
+const daemonPingInterval = 30 * time.Second
+const daemonPingTimeout = 10 * time.Second
+const daemonDefaultIdleTimeout = 10 * time.Minute
+const daemonStopTimeout = 10 * time.Second
+
+var errDaemonNotSupported = fmt.Errorf("daemon mode not supported")
+
+type daemonMsg struct {
+	ID       uint64   `json:"id,omitempty"`
+	Type     string   `json:"type"`
+	Args     []string `json:"args,omitempty"`
+	Cwd      string   `json:"cwd,omitempty"`
+	Stdin    string   `json:"stdin,omitempty"`
+	Line     string   `json:"line,omitempty"`
+	ExitCode int      `json:"exit_code,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type Daemon struct {
+	bin string
+
+	// Holds a value while the daemon is used by a request or a ping, as the daemon processes requests
+	// one at a time.
+	busy chan struct{}
+
+	// These are only accessed while the daemon is busy.
+	cmd         *Cmd
+	cancel      context.CancelFunc
+	stdin       io.WriteCloser
+	msgChan     chan daemonMsg
+	exitChan    chan struct{} // Closed when the process exits.
+	stopChan    chan struct{} // Closed when the daemon is stopped.
+	lastID      uint64
+	lastUsedAt  time.Time
+	unsupported bool
+}
+
+type Daemons struct {
+	mutex   sync.Mutex
+	daemons map[string]*Daemon
+}
+
+// Returns true if the daemon mode is enabled for the given request type. Profiles use the daemon mode if
+// it's enabled for them or for their backend.
+func isDaemonEnabled(reqType ReqType) bool {
+	if slices.Contains(getParams().Daemons, reqType) {
+		return true
+	}
+	if p, ok := getBackend(reqType).(*ProfileBackend); ok {
+		for _, t := range getParams().Daemons {
+			if getBackend(t) == p.Backend {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the daemon of the given binary, or nil if the daemon mode is not enabled for the request type.
+// Profiles of a backend share its daemon, as their extra args are sent in the requests.
+func (d *Daemons) Get(reqType ReqType, bin string) *Daemon {
+	if !isDaemonEnabled(reqType) {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.daemons == nil {
+		d.daemons = make(map[string]*Daemon)
+	}
+	daemon := d.daemons[bin]
+	if daemon == nil {
+		daemon = &Daemon{bin: bin, busy: make(chan struct{}, 1)}
+		d.daemons[bin] = daemon
+		go daemon.monitor()
+	}
+	return daemon
+}
+
+func (d *Daemon) String() string {
+	return path.Base(d.bin) + " daemon"
+}
+
+func (d *Daemon) isRunning() bool {
+	if d.cmd == nil {
+		return false
+	}
+	select {
+	case <-d.exitChan:
+		return false
+	default:
+		return true
+	}
+}
+
+// Reads the messages of the daemon from its stdout. Messages are dropped after the daemon has been
+// stopped, as nobody receives them anymore.
+func (d *Daemon) readOutput(stdout io.Reader, msgChan chan daemonMsg, exitChan, stopChan chan struct{}, cmd *Cmd) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg daemonMsg
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || msg.Type == "" {
+			fmt.Println(d, "output:", scanner.Text())
+			continue
+		}
+		select {
+		case msgChan <- msg:
+		case <-stopChan:
+		}
+	}
+	err := cmd.Wait()
+	fmt.Println(d, "exited:", err)
+	close(exitChan)
+}
+
+// Waits for a message of the request with the given ID (or the ready message if the ID is 0).
+func (d *Daemon) waitForMsg(ctx context.Context, id uint64) (msg daemonMsg, err error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return msg, ctx.Err()
+		case <-d.exitChan:
+			return msg, fmt.Errorf("%s exited", d)
+		case msg = <-d.msgChan:
+			if msg.ID == id {
+				return msg, nil
+			}
+		}
+	}
+}
+
+// Starts the daemon if it's not running. Returns errDaemonNotSupported if the binary doesn't support the
+// daemon mode.
+func (d *Daemon) start() error {
+	if d.unsupported {
+		return errDaemonNotSupported
+	}
+	if d.isRunning() {
+		return nil
+	}
+
+	fmt.Println("starting", d)
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	d.cmd = NewCommand(ctx, d.bin, "--daemon")
+	d.cmd.Dir = path.Dir(d.bin)
+	d.cmd.Stderr = os.Stderr
+	var err error
+	if d.stdin, err = d.cmd.StdinPipe(); err != nil {
+		return fmt.Errorf("can't start %s: %w", d, err)
+	}
+	stdout, err := d.cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("can't start %s: %w", d, err)
+	}
+	if err := d.cmd.Start(); err != nil {
+		fmt.Println("can't start", d, "using one-shot mode:", err)
+		d.cancel()
+		d.cmd = nil
+		d.unsupported = true
+		return errDaemonNotSupported
+	}
+	d.msgChan = make(chan daemonMsg, 16)
+	d.exitChan = make(chan struct{})
+	d.stopChan = make(chan struct{})
+	go d.readOutput(stdout, d.msgChan, d.exitChan, d.stopChan, d.cmd)
+
+	startCtx, cancel := context.WithTimeout(context.Background(), daemonStartTimeout)
+	defer cancel()
+	if _, err := d.waitForMsg(startCtx, 0); err != nil {
+		fmt.Println(d, "didn't get ready, using one-shot mode:", err)
+		d.stop()
+		d.unsupported = true
+		return errDaemonNotSupported
+	}
+	fmt.Println(d, "ready")
+	d.lastUsedAt = time.Now()
+	return nil
+}
+
+func (d *Daemon) stop() {
+	if d.cmd == nil {
+		return
+	}
+	d.stdin.Close()
+	d.cancel() // This kills the process group of the daemon.
+	close(d.stopChan)
+	select {
+	case <-d.exitChan:
+	case <-time.After(daemonStopTimeout):
+		// The output may be kept open by a process which left the process group of the daemon.
+		fmt.Println(d, "didn't exit in time, abandoning it")
+	}
+	d.cmd = nil
+}
+
+func (d *Daemon) send(msg daemonMsg) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = d.stdin.Write(append(b, '\n'))
+	return err
+}
+
+// Runs a request with the given args on the daemon. Returns errDaemonNotSupported if the binary doesn't
+// support the daemon mode, the request should be run in one-shot mode then.
+func (d *Daemon) Run(ctx context.Context, args []string, dir string, stdin io.Reader, processLineCallback func(string)) (canceled bool, err error) {
+	select {
+	case d.busy <- struct{}{}:
+	case <-ctx.Done():
+		return true, nil
+	}
+	defer func() { <-d.busy }()
+
+	if err := d.start(); err != nil {
+		return false, err
+	}
+	d.lastUsedAt = time.Now()
+	defer func() { d.lastUsedAt = time.Now() }()
+
+	msg := daemonMsg{Type: "run", Args: args, Cwd: dir}
+	if stdin != nil {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return false, fmt.Errorf("can't read stdin: %w", err)
+		}
+		msg.Stdin = string(b)
+	}
+	d.lastID++
+	reqID := d.lastID
+	msg.ID = reqID
+	if err := d.send(msg); err != nil {
+		d.stop()
+		return false, fmt.Errorf("can't send request to %s: %w", d, err)
+	}
+
+	for {
+		msg, err := d.waitForMsg(ctx, reqID)
+		if ctx.Err() != nil {
+			// Requests can't be interrupted, so the daemon has to be restarted.
+			fmt.Println("  stopping", d, "to cancel the request")
+			d.stop()
+			return true, nil
+		}
+		if err != nil {
+			d.stop()
+			return false, err
+		}
+		switch msg.Type {
+		case "output":
+			processLineCallback(msg.Line)
+		case "done":
+			if msg.ExitCode != 0 {
+				return false, fmt.Errorf("exit code %d: %s", msg.ExitCode, msg.Error)
+			}
+			return false, nil
+		}
+	}
+}
+
+// Pings the daemon periodically, and stops it if it doesn't reply or it has been idle for too long.
+func (d *Daemon) monitor() {
+	for {
+		time.Sleep(daemonPingInterval)
+
+		select {
+		case d.busy <- struct{}{}:
+		default: // Processing a request.
+			continue
+		}
+
+		if d.isRunning() {
+			idleTimeout := getParams().DaemonIdleTimeout
+			if idleTimeout == 0 {
+				idleTimeout = daemonDefaultIdleTimeout
+			}
+			if time.Since(d.lastUsedAt) > idleTimeout {
+				fmt.Println("stopping idle", d)
+				d.stop()
+			} else {
+				d.lastID++
+				ctx, cancel := context.WithTimeout(context.Background(), daemonPingTimeout)
+				err := d.send(daemonMsg{ID: d.lastID, Type: "ping"})
+				if err == nil {
+					_, err = d.waitForMsg(ctx, d.lastID)
+				}
+				cancel()
+				if err != nil {
+					fmt.Println(d, "didn't reply to ping, stopping:", err)
+					d.stop()
+				}
+			}
+		}
+		<-d.busy
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The file server serves the results which are too large to be uploaded to Telegram. Files are kept for
+// the configured TTL, and they can only be downloaded using signed links which expire with the files.
+
+const fileServerPath = "/files/"
+const defaultFileServerDir = "audio-ai-telegram-bot-files"
+const defaultFileServerTTL = 24 * time.Hour
+const fileServerJanitorInterval = 10 * time.Minute
+
+var fileServerIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// The expiry time of each file is stored next to its dir, so changing the TTL doesn't affect the links already sent.
+const fileServerExpiresExt = ".expires"
+
+type FileServer struct {
+	secret []byte
+}
+
+func (s *FileServer) Enabled() bool {
+	return getParams().FileServerAddr != ""
+}
+
+func (s *FileServer) getDir() string {
+	if getParams().FileServerDir != "" {
+		return getParams().FileServerDir
+	}
+	return defaultFileServerDir
+}
+
+func (s *FileServer) getTTL() time.Duration {
+	if getParams().FileServerTTL > 0 {
+		return getParams().FileServerTTL
+	}
+	return defaultFileServerTTL
+}
+
+func (s *FileServer) getURL() string {
+	if getParams().FileServerURL != "" {
+		return strings.TrimSuffix(getParams().FileServerURL, "/")
+	}
+	return "http://" + getParams().FileServerAddr
+}
+
+func (s *FileServer) sign(name string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(name + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Moves the given file to the file server, and returns its download link and the time when it expires.
+func (s *FileServer) Add(filePath, filename string) (link string, expiresAt time.Time, err error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", expiresAt, fmt.Errorf("can't generate file id: %w", err)
+	}
+	id := hex.EncodeToString(b)
+
+	filename = strings.ReplaceAll(path.Base(filename), "\\", "_")
+	if filename == "." || filename == "/" || filename == ".." {
+		filename = "result"
+	}
+
+	expiresAt = time.Now().Add(s.getTTL())
+	expires := expiresAt.Unix()
+
+	dir := path.Join(s.getDir(), id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", expiresAt, fmt.Errorf("can't create file server dir: %w", err)
+	}
+	if err := os.WriteFile(dir+fileServerExpiresExt, []byte(strconv.FormatInt(expires, 10)), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", expiresAt, fmt.Errorf("can't write file server expiry: %w", err)
+	}
+	dst := path.Join(dir, filename)
+	if err := os.Rename(filePath, dst); err != nil {
+		if err := linkOrCopyFile(dst, filePath); err != nil {
+			os.RemoveAll(dir)
+			os.Remove(dir + fileServerExpiresExt)
+			return "", expiresAt, fmt.Errorf("can't copy file to the file server: %w", err)
+		}
+	}
+
+	link = s.getURL() + fileServerPath + id + "/" + url.PathEscape(filename) + "?expires=" +
+		strconv.FormatInt(expires, 10) + "&sig=" + s.sign(id+"/"+filename, expires)
+	return link, expiresAt, nil
+}
+
+func (s *FileServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	id, filename, found := strings.Cut(strings.TrimPrefix(r.URL.Path, fileServerPath), "/")
+	if !found || !fileServerIDRegex.MatchString(id) || filename == "" || strings.Contains(filename, "/") {
+		http.NotFound(rw, r)
+		return
+	}
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(s.sign(id+"/"+filename, expires)), []byte(r.URL.Query().Get("sig"))) {
+		http.Error(rw, "invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(rw, "link expired", http.StatusGone)
+		return
+	}
+
+	f, err := os.Open(path.Join(s.getDir(), id, filename))
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	http.ServeContent(rw, r, filename, fi.ModTime(), f)
+}
+
+// Returns the stored expiry time of the given file dir. If it's missing (the dir is being created, or
+// the expiry file couldn't be written), the dir expires after the TTL counted from its modification time.
+func (s *FileServer) getExpiresAt(dir string, fi os.FileInfo) time.Time {
+	d, err := os.ReadFile(dir + fileServerExpiresExt)
+	if err == nil {
+		if expires, err := strconv.ParseInt(strings.TrimSpace(string(d)), 10, 64); err == nil {
+			return time.Unix(expires, 0)
+		}
+	}
+	return fi.ModTime().Add(s.getTTL())
+}
+
+// Removes the files which have expired.
+func (s *FileServer) removeExpired() {
+	dirEntries, err := os.ReadDir(s.getDir())
+	if err != nil {
+		return
+	}
+	for _, d := range dirEntries {
+		dir := path.Join(s.getDir(), d.Name())
+		if !d.IsDir() {
+			// Removing expiry files left without a dir.
+			if id, found := strings.CutSuffix(d.Name(), fileServerExpiresExt); found && fileServerIDRegex.MatchString(id) {
+				if _, err := os.Stat(path.Join(s.getDir(), id)); os.IsNotExist(err) {
+					os.Remove(dir)
+				}
+			}
+			continue
+		}
+		if !fileServerIDRegex.MatchString(d.Name()) {
+			continue
+		}
+		fi, err := d.Info()
+		if err != nil || time.Now().Before(s.getExpiresAt(dir, fi)) {
+			continue
+		}
+		fmt.Println("file server: removing expired file", d.Name())
+		if err := os.RemoveAll(dir); err != nil {
+			fmt.Println("file server: can't remove expired file:", err)
+			continue
+		}
+		os.Remove(dir + fileServerExpiresExt)
+	}
+}
+
+func (s *FileServer) janitor(ctx context.Context) {
+	ticker := time.NewTicker(fileServerJanitorInterval)
+	defer ticker.Stop()
+	for {
+		s.removeExpired()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *FileServer) Start(ctx context.Context) error {
+	s.secret = []byte(getParams().FileServerSecret)
+
+	mux := http.NewServeMux()
+	mux.Handle(fileServerPath, s)
+	listener, err := net.Listen("tcp", getParams().FileServerAddr)
+	if err != nil {
+		return fmt.Errorf("can't start file server: %w", err)
+	}
+	go s.janitor(ctx)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		fmt.Println("file server listening on", getParams().FileServerAddr)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Println("file server error:", err)
+		}
+	}()
+	return nil
+}
@@ -2,21 +2,42 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/go-telegram/bot"
 )
 
+const defaultBotAPIURL = "https://api.telegram.org"
+const downloadFileName = "download"
+const downloadRetryCount = 3
+const downloadRetryInterval = 2 * time.Second
+
 type GetFile struct {
 }
 
+// The client has no timeout, as large files can take long to download. Downloads are stopped by their
+// context.
+var downloadHTTPClient = http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
 // WriteCounter counts the number of bytes written to it. It implements to the io.Writer interface
 // and we can pass this into io.TeeReader() which will report progress on each write cycle.
 type WriteCounter struct {
 	Ctx                   context.Context
+	QEntry                *ReqQueueEntry
 	GotBytes              int64
 	TotalBytes            int64
 	ProgressPrintInterval time.Duration
@@ -27,45 +48,132 @@ func (wc *WriteCounter) Write(p []byte) (int, error) {
 	n := len(p)
 	wc.GotBytes += int64(n)
 
-	if time.Since(wc.LastProgressPrintAt) > wc.ProgressPrintInterval {
+	if wc.TotalBytes > 0 && time.Since(wc.LastProgressPrintAt) > wc.ProgressPrintInterval {
 		progressPercent := int(float64(wc.GotBytes) / float64(wc.TotalBytes) * 100)
 		fmt.Print("    progress: ", progressPercent, "%\n")
-		reqQueue.currentEntry.entry.sendReply(wc.Ctx, downloadingStr+" "+getProgressbar(progressPercent, progressBarLength))
+		wc.QEntry.sendReply(wc.Ctx, downloadingStr+" "+getProgressbar(progressPercent, progressBarLength))
 		wc.LastProgressPrintAt = time.Now()
 	}
 	return n, nil
 }
 
-func (g *GetFile) GetFile(ctx context.Context, fileID string) (d []byte, err error) {
-	fmt.Println("  downloading...")
+func getBotAPIURL() string {
+	if getParams().BotAPIURL != "" {
+		return strings.TrimSuffix(getParams().BotAPIURL, "/")
+	}
+	return defaultBotAPIURL
+}
 
-	f, err := telegramBot.GetFile(ctx, &bot.GetFileParams{
-		FileID: fileID,
-	})
+// Makes one attempt to download the given URL to the file, continuing the download if the file already
+// has data from the previous attempt. Returns true if the download should be retried.
+func (g *GetFile) downloadAttempt(ctx context.Context, fileURL string, file *os.File, counter *WriteCounter) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
 	if err != nil {
-		return nil, err
+		return false, fmt.Errorf("can't create request")
+	}
+	if counter.GotBytes > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", counter.GotBytes))
 	}
-	resp, err := http.Get("https://api.telegram.org/file/bot" + params.BotToken + "/" + f.FilePath)
+
+	resp, err := downloadHTTPClient.Do(req)
 	if err != nil {
-		return nil, err
+		// The URL contains the bot token, so it's removed from the error.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, err
 	}
 	defer resp.Body.Close()
 
-	counter := &WriteCounter{
-		Ctx:                   ctx,
-		TotalBytes:            int64(f.FileSize),
-		ProgressPrintInterval: groupChatProgressUpdateInterval,
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && counter.GotBytes > 0:
+	case resp.StatusCode == http.StatusOK:
+		// Starting over as the server doesn't support continuing the download.
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		if err := file.Truncate(0); err != nil {
+			return false, err
+		}
+		counter.GotBytes = 0
+	default:
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("download error: " + resp.Status)
 	}
 
-	if reqQueue.currentEntry.entry.Message.Chat.ID >= 0 {
-		counter.ProgressPrintInterval = privateChatProgressUpdateInterval
+	if _, err := io.Copy(file, io.TeeReader(resp.Body, counter)); err != nil {
+		return true, err
 	}
+	return false, nil
+}
 
-	d, err = io.ReadAll(io.TeeReader(resp.Body, counter))
+// Downloads the given URL to the given file. Failed downloads are retried.
+func (g *GetFile) download(ctx context.Context, fileURL, filePath string, counter *WriteCounter) error {
+	file, err := os.Create(filePath)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("can't create file: %w", err)
+	}
+	defer file.Close()
+
+	for attempt := 1; ; attempt++ {
+		retry, err := g.downloadAttempt(ctx, fileURL, file, counter)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == downloadRetryCount || ctx.Err() != nil {
+			return err
+		}
+		fmt.Println("    download error, retrying:", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * downloadRetryInterval):
+		}
+	}
+}
+
+// Downloads the given file to the work dir of the request. If the Bot API server runs in local mode, then
+// the file is linked or copied from the file path which the server returns.
+func (g *GetFile) GetFile(ctx context.Context, qEntry *ReqQueueEntry, fileID, filename string) (d AudioFileData, err error) {
+	fmt.Println("  downloading...")
+
+	f, err := telegramAPI.GetFile(ctx, &bot.GetFileParams{
+		FileID: fileID,
+	})
+	if err != nil {
+		return d, err
+	}
+
+	if qEntry.WorkDir == "" {
+		if qEntry.WorkDir, err = createWorkDir(qEntry.TaskID); err != nil {
+			return d, err
+		}
+	}
+	filePath := path.Join(qEntry.WorkDir, downloadFileName+path.Ext(filename))
+
+	if getParams().BotAPILocal && path.IsAbs(f.FilePath) {
+		if err := linkOrCopyFile(filePath, f.FilePath); err != nil {
+			return d, fmt.Errorf("can't copy file: %w", err)
+		}
+	} else {
+		counter := &WriteCounter{
+			Ctx:                   ctx,
+			QEntry:                qEntry,
+			TotalBytes:            f.FileSize,
+			ProgressPrintInterval: groupChatProgressUpdateInterval,
+		}
+
+		if qEntry.Message.Chat.ID >= 0 {
+			counter.ProgressPrintInterval = privateChatProgressUpdateInterval
+		}
+
+		fileURL := getBotAPIURL() + "/file/bot" + getParams().BotToken + "/" + f.FilePath
+		if err := g.download(ctx, fileURL, filePath, counter); err != nil {
+			return d, err
+		}
 	}
 
 	fmt.Println("  downloading done")
-	return d, nil
+	return AudioFileData{path: filePath, filename: filename}, nil
 }
@@ -7,6 +7,7 @@ require (
 	github.com/go-telegram/bot v0.7.15
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
 	github.com/u2takey/ffmpeg-go v0.5.0
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9
 )
 
@@ -14,4 +15,5 @@ require (
 	github.com/aws/aws-sdk-go v1.38.20 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/u2takey/go-utils v0.3.1 // indirect
+	golang.org/x/sys v0.12.0 // indirect
 )
@@ -61,3 +61,11 @@ func copyFile(dst, src string) error {
 	}
 	return nil
 }
+
+// Hard links the source file to the destination, or copies it if linking is not possible.
+func linkOrCopyFile(dst, src string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(dst, src)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path"
 	"strings"
+	"syscall"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -13,6 +17,8 @@ import (
 )
 
 var telegramBot *bot.Bot
+var telegramAPI TelegramAPI
+var store Store
 var cmdHandler cmdHandlerType
 var reqQueue ReqQueue
 var converter Converter
@@ -21,12 +27,19 @@ var tts TTS
 var stt STT
 var mdx MDX
 var rvc RVC
+var rvcTrain RVCTrain
 var musicgen Musicgen
 var audiogen Audiogen
+var clipboard Clipboard
+var quota Quota
+var remoteWorkers RemoteWorkers
+var daemons Daemons
+var fileServer FileServer
+var webhook Webhook
 
 func sendReplyToMessage(ctx context.Context, replyToMsg *models.Message, s string) (msg *models.Message) {
 	var err error
-	msg, err = telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+	msg, err = telegramAPI.SendMessage(ctx, &bot.SendMessageParams{
 		ReplyToMessageID: replyToMsg.ID,
 		ChatID:           replyToMsg.Chat.ID,
 		Text:             s,
@@ -39,7 +52,7 @@ func sendReplyToMessage(ctx context.Context, replyToMsg *models.Message, s strin
 
 func editReplyToMessage(ctx context.Context, msg *models.Message, s string) error {
 	var err error
-	_, err = telegramBot.EditMessageText(ctx, &bot.EditMessageTextParams{
+	err = telegramAPI.EditMessageText(ctx, &bot.EditMessageTextParams{
 		MessageID: msg.ID,
 		ChatID:    msg.Chat.ID,
 		Text:      s,
@@ -51,53 +64,203 @@ func editReplyToMessage(ctx context.Context, msg *models.Message, s string) erro
 }
 
 func sendTextToAdmins(ctx context.Context, s string) {
-	for _, chatID := range params.AdminUserIDs {
-		_, _ = telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+	for _, chatID := range getParams().AdminUserIDs {
+		_, err := telegramAPI.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID: chatID,
 			Text:   s,
 		})
+		if err != nil {
+			fmt.Println("  admin message send error:", err)
+		}
+	}
+}
+
+func getUserName(u *models.User) string {
+	if u.Username != "" {
+		return "@" + u.Username
 	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+func isAdmin(userID int64) bool {
+	return slices.Contains(getParams().AdminUserIDs, userID)
 }
 
 type AudioFileData struct {
 	data     []byte
+	path     string // Set instead of data if the audio file is on disk.
 	filename string
 }
 
-func handleAudio(ctx context.Context, update *models.Update, fileID, filename string) {
-	// Are we expecting audio data from this user?
-	if reqQueue.currentEntry.gotAudioChan == nil || update.Message.From.ID != reqQueue.currentEntry.entry.Message.From.ID {
+func (a AudioFileData) isEmpty() bool {
+	return len(a.data) == 0 && a.path == ""
+}
+
+func (a AudioFileData) size() int64 {
+	if a.path == "" {
+		return int64(len(a.data))
+	}
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Returns the audio data, reading it from the file if it's on disk.
+func (a AudioFileData) readAll() ([]byte, error) {
+	if a.path == "" {
+		return a.data, nil
+	}
+	return os.ReadFile(a.path)
+}
+
+func (a AudioFileData) open() (io.ReadCloser, error) {
+	if a.path == "" {
+		return io.NopCloser(bytes.NewReader(a.data)), nil
+	}
+	return os.Open(a.path)
+}
+
+// Writes the audio data to the given file. Files on disk are linked if possible, so they are not copied.
+func (a AudioFileData) writeFile(filePath string) error {
+	if a.path == "" {
+		return os.WriteFile(filePath, a.data, 0644)
+	}
+	return linkOrCopyFile(filePath, a.path)
+}
+
+// Returns the file ID and file name of the audio file attached to the given message. Videos are also
+// returned, their audio track gets extracted after the download. Returns an empty file ID if the message
+// has no audio file attached.
+func getMessageAudioFile(msg *models.Message) (fileID, filename string) {
+	if msg.Animation != nil { // Animations also have the document set.
+		return msg.Animation.FileID, getVideoFilename(msg.Animation.FileName, msg.Animation.MimeType, "animation")
+	} else if msg.Document != nil {
+		if !isAudioOrVideoMimeType(msg.Document.MimeType) {
+			return "", ""
+		}
+		if strings.HasPrefix(msg.Document.MimeType, "video/") {
+			return msg.Document.FileID, getVideoFilename(msg.Document.FileName, msg.Document.MimeType, "video")
+		}
+		return msg.Document.FileID, msg.Document.FileName
+	} else if msg.Video != nil {
+		return msg.Video.FileID, getVideoFilename(msg.Video.FileName, msg.Video.MimeType, "video")
+	} else if msg.VideoNote != nil {
+		return msg.VideoNote.FileID, "video_note.mp4"
+	} else if msg.Voice != nil {
+		return msg.Voice.FileID, "voice.ogg"
+	} else if msg.Audio != nil {
+		filename = msg.Audio.FileName
+		if filename == "" {
+			filename = "audio"
+		}
+		return msg.Audio.FileID, filename
+	}
+	return "", ""
+}
+
+// Returns the message which holds the input audio file for the given command message. This is either
+// the command message itself (the command is the caption of the audio file), or the message the command
+// replies to. Returns nil if there's no such message.
+func getInputAudioMessage(msg *models.Message) *models.Message {
+	if fileID, _ := getMessageAudioFile(msg); fileID != "" {
+		return msg
+	}
+	if msg.ReplyToMessage != nil {
+		if fileID, _ := getMessageAudioFile(msg.ReplyToMessage); fileID != "" {
+			return msg.ReplyToMessage
+		}
+	}
+	return nil
+}
+
+// Downloads the given audio file and adds the entry to the request queue. The download is skipped if the
+// file is already in the chat's clipboard.
+func downloadAudioAndAddToQueue(ctx context.Context, qEntry *ReqQueueEntry, fileID, filename string) {
+	var err error
+	if qEntry.WorkDir == "" {
+		qEntry.WorkDir, err = createWorkDir(qEntry.TaskID)
+	}
+	if err != nil {
+		quota.Release(qEntry.quotaRes, false)
+		qEntry.sendReply(ctx, errorStr+": "+err.Error())
 		return
 	}
 
-	var g GetFile
-	d, err := g.GetFile(ctx, fileID)
+	audioData := AudioFileData{path: path.Join(qEntry.WorkDir, downloadFileName+path.Ext(filename)), filename: filename}
+	if !clipboard.CopyFile(qEntry.Message.Chat.ID, fileID, audioData.path) {
+		var g GetFile
+		audioData, err = g.GetFile(ctx, qEntry, fileID, filename)
+		if err != nil {
+			removeWorkDir(qEntry.WorkDir)
+			quota.Release(qEntry.quotaRes, false)
+			qEntry.sendReply(ctx, errorStr+": can't get file: "+err.Error())
+			return
+		}
+		qEntry.sendReply(ctx, doneStr+" downloading\n"+qEntry.Req.Params.String())
+		qEntry.setReplyTo(qEntry.Message, true)
+	}
+
+	clipboard.Set(qEntry.Message.Chat.ID, fileID, filename, audioData)
+
+	// The clipboard keeps the video, so the audio gets extracted for each request using it.
+	if isVideoFile(filename) {
+		audioData, err = converter.ExtractAudio(ctx, qEntry.WorkDir, audioData)
+		if err != nil {
+			removeWorkDir(qEntry.WorkDir)
+			quota.Release(qEntry.quotaRes, false)
+			qEntry.sendReply(ctx, errorStr+": "+err.Error())
+			return
+		}
+	}
+
+	audioDuration, err := converter.GetDuration(ctx, audioData)
 	if err != nil {
-		reqQueue.currentEntry.entry.sendReply(ctx, errorStr+": can't get file: "+err.Error())
+		fmt.Println("  can't get audio duration:", err)
+	}
+	if err := quota.ReserveAudio(qEntry.quotaRes, qEntry.Req.Message, audioDuration); err != nil {
+		removeWorkDir(qEntry.WorkDir)
+		quota.Release(qEntry.quotaRes, false)
+		qEntry.sendReply(ctx, errorStr+": "+err.Error())
 		return
 	}
-	reqQueue.currentEntry.entry.sendReply(ctx, doneStr+" downloading\n"+reqQueue.currentEntry.entry.Req.Params.String())
+
+	// Now that we have the audio data, the request can get into the queue.
+	reqQueue.AddWithAudio(qEntry, audioData)
+}
+
+func handleAudio(ctx context.Context, update *models.Update) {
+	// Are we expecting audio data from this user?
+	qEntry := reqQueue.GetEntryWaitingForAudio(update.Message.Chat.ID, update.Message.From.ID)
+	if qEntry == nil {
+		return
+	}
+
 	// Updating the message to reply to this document.
-	reqQueue.currentEntry.entry.Message = update.Message
-	reqQueue.currentEntry.entry.ReplyMessage = nil
-	// Notifying the request queue that we now got the audio data.
-	reqQueue.currentEntry.gotAudioChan <- AudioFileData{
-		data:     d,
-		filename: filename,
+	qEntry.setReplyTo(update.Message, false)
+	fileID, filename := getMessageAudioFile(update.Message)
+	downloadAudioAndAddToQueue(ctx, qEntry, fileID, filename)
+}
+
+func isMessageAllowed(msg *models.Message) bool {
+	if msg.Chat.ID >= 0 { // From user?
+		return slices.Contains(getParams().AllowedUserIDs, msg.From.ID)
 	}
+	return slices.Contains(getParams().AllowedGroupIDs, msg.Chat.ID)
 }
 
 func handleMessage(ctx context.Context, update *models.Update) {
 	fmt.Print("msg from ", update.Message.From.Username, "#", update.Message.From.ID, ": ", update.Message.Text, "\n")
 
 	if update.Message.Chat.ID >= 0 { // From user?
-		if !slices.Contains(params.AllowedUserIDs, update.Message.From.ID) {
+		if !isMessageAllowed(update.Message) {
 			fmt.Println("  user not allowed, ignoring")
 			return
 		}
 	} else { // From group ?
 		fmt.Print("  msg from group #", update.Message.Chat.ID)
-		if !slices.Contains(params.AllowedGroupIDs, update.Message.Chat.ID) {
+		if !isMessageAllowed(update.Message) {
 			fmt.Println(", group not allowed, ignoring")
 			return
 		}
@@ -113,50 +276,37 @@ func handleMessage(ctx context.Context, update *models.Update) {
 		update.Message.Text = strings.TrimPrefix(update.Message.Text, cmd+" ")
 		cmdChar := string(cmd[0])
 		cmd = cmd[1:] // Cutting the command character.
-		switch cmd {
-		case "aaitts":
-			fmt.Println("  interpreting as cmd tts")
-			cmdHandler.TTS(ctx, strings.Replace(update.Message.Text, cmdChar+"aaitts", "", 1), update.Message)
+		if reqType, ok := ReqTypeFromCmd(cmd); ok {
+			fmt.Println("  interpreting as cmd", reqType)
+			cmdHandler.Req(ctx, reqType, strings.Replace(update.Message.Text, cmdChar+cmd, "", 1), update.Message)
 			return
-		case "aaitts-models":
-			fmt.Println("  interpreting as cmd tts-models")
-			tts.ListModels(ctx, update.Message)
-			return
-		case "aaistt":
-			fmt.Println("  interpreting as cmd stt")
-			cmdHandler.STT(ctx, update.Message)
-			return
-		case "aaimdx":
-			fmt.Println("  interpreting as cmd mdx")
-			cmdHandler.MDX(ctx, update.Message)
-			return
-		case "aairvc":
-			fmt.Println("  interpreting as cmd rvc")
-			cmdHandler.RVC(ctx, strings.Replace(update.Message.Text, cmdChar+"aairvc", "", 1), update.Message)
-			return
-		case "aairvc-train":
-			fmt.Println("  interpreting as cmd rvc-train")
-			cmdHandler.RVCTrain(ctx, strings.Replace(update.Message.Text, cmdChar+"aairvc-train", "", 1), update.Message)
+		}
+		if lister := getModelListerFromCmd(cmd); lister != nil {
+			fmt.Println("  interpreting as cmd", cmd)
+			lister.ListModels(ctx, update.Message)
 			return
-		case "aairvc-models":
-			fmt.Println("  interpreting as cmd rvc")
-			rvc.ListModels(ctx, update.Message)
+		}
+
+		switch cmd {
+		case "aaiclipboard":
+			fmt.Println("  interpreting as cmd aaiclipboard")
+			clipboard.Show(ctx, update.Message)
 			return
-		case "aaimusicgen":
-			fmt.Println("  interpreting as cmd musicgen")
-			cmdHandler.Musicgen(ctx, strings.Replace(update.Message.Text, cmdChar+"aaimusicgen", "", 1), update.Message)
+		case "aaiqueue":
+			fmt.Println("  interpreting as cmd aaiqueue")
+			cmdHandler.Queue(ctx, update.Message)
 			return
-		case "aaiaudiogen":
-			fmt.Println("  interpreting as cmd audiogen")
-			cmdHandler.Audiogen(ctx, strings.Replace(update.Message.Text, cmdChar+"aaiaudiogen", "", 1), update.Message)
+		case "aaiweight":
+			fmt.Println("  interpreting as cmd aaiweight")
+			cmdHandler.Weight(ctx, strings.Replace(update.Message.Text, cmdChar+"aaiweight", "", 1), update.Message)
 			return
 		case "aaicancel":
 			fmt.Println("  interpreting as cmd aaicancel")
-			cmdHandler.Cancel(ctx, update.Message)
+			cmdHandler.Cancel(ctx, strings.Replace(update.Message.Text, cmdChar+"aaicancel", "", 1), update.Message)
 			return
 		case "aaihelp":
 			fmt.Println("  interpreting as cmd aaihelp")
-			cmdHandler.Help(ctx, update.Message, cmdChar)
+			cmdHandler.Help(ctx, strings.Replace(update.Message.Text, cmdChar+"aaihelp", "", 1), update.Message, cmdChar)
 			return
 		case "start":
 			fmt.Println("  interpreting as cmd start")
@@ -175,51 +325,132 @@ func handleMessage(ctx context.Context, update *models.Update) {
 	}
 
 	if update.Message.Chat.ID >= 0 { // From user?
-		cmdHandler.TTS(ctx, update.Message.Text, update.Message)
+		cmdHandler.Req(ctx, ReqTypeTTS, update.Message.Text, update.Message)
 	}
 }
 
 func telegramBotUpdateHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.CallbackQuery != nil {
+		fmt.Print("callback query from ", update.CallbackQuery.Sender.Username, "#", update.CallbackQuery.Sender.ID, ": ",
+			update.CallbackQuery.Data, "\n")
+		cmdHandler.QueueCallback(ctx, update.CallbackQuery)
+		return
+	}
+
 	if update.Message == nil {
 		return
 	}
 
-	if update.Message.Document != nil {
-		handleAudio(ctx, update, update.Message.Document.FileID, update.Message.Document.FileName)
-	} else if update.Message.Voice != nil {
-		handleAudio(ctx, update, update.Message.Voice.FileID, "voice.ogg")
-	} else if update.Message.Audio != nil {
-		handleAudio(ctx, update, update.Message.Audio.FileID, update.Message.Audio.FileName)
+	fileID, filename := getMessageAudioFile(update.Message)
+	if fileID != "" && isMessageAllowed(update.Message) {
+		clipboard.Set(update.Message.Chat.ID, fileID, filename, AudioFileData{})
+	}
+
+	caption := update.Message.Caption
+	if fileID != "" && caption != "" && (caption[0] == '/' || caption[0] == '!') {
+		// The caption is a command which uses the attached audio file as input.
+		update.Message.Text = caption
+		handleMessage(ctx, update)
+	} else if fileID != "" {
+		handleAudio(ctx, update)
 	} else if update.Message.Text != "" {
 		handleMessage(ctx, update)
 	}
 }
 
 func main() {
+	// SIGHUP terminates the process by default, so it's handled from the start, even if there's no config file.
+	sighupChan := make(chan os.Signal, 1)
+	signal.Notify(sighupChan, syscall.SIGHUP)
+
 	fmt.Println("audio-ai-telegram-bot starting...")
 
-	if err := params.Init(); err != nil {
+	var p paramsType
+	if err := p.Init(); err != nil {
 		fmt.Println("error:", err)
 		os.Exit(1)
 	}
+	currentParams.Store(&p)
 
 	var cancel context.CancelFunc
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	reqQueue.Init(ctx)
+	if getParams().Check {
+		report, failed := checkBackends(false)
+		fmt.Print("backend check:\n" + report)
+		if failed != "" {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if getParams().WorkerConnect != "" {
+		var worker Worker
+		worker.Run(ctx)
+		return
+	}
 
 	opts := []bot.Option{
 		bot.WithDefaultHandler(telegramBotUpdateHandler),
+		bot.WithServerURL(getBotAPIURL()),
 	}
 
 	var err error
-	telegramBot, err = bot.New(params.BotToken, opts...)
+	telegramBot, err = bot.New(getParams().BotToken, opts...)
 	if nil != err {
 		panic(fmt.Sprint("can't init telegram bot: ", err))
 	}
+	telegramAPI.Init(telegramBot)
+
+	if err := store.Open(getParams().QueueDBPath); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	if err := quota.Load(&store); err != nil {
+		fmt.Println("can't load quota usage:", err)
+	}
+
+	// Backends which fail the check are not disabled if they can be run by remote workers.
+	backendReport, failedBackends := checkBackends(getParams().WorkerServerAddr == "")
+	fmt.Print("backend check:\n" + backendReport)
+
+	reqQueue.Init(ctx)
+	clipboard.Start(ctx)
+
+	if getParams().WorkerServerAddr != "" {
+		if err := remoteWorkers.Start(ctx, getParams().WorkerServerAddr); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if fileServer.Enabled() {
+		if err := fileServer.Start(ctx); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
 
-	sendTextToAdmins(ctx, "🤖 Bot started")
+	go watchConfig(ctx, sighupChan)
 
+	startedMsg := "🤖 Bot started"
+	if failedBackends != "" {
+		if getParams().WorkerServerAddr == "" {
+			startedMsg += "\n\n⚠️ Disabled commands:\n" + failedBackends
+		} else {
+			startedMsg += "\n\n⚠️ Commands which can only be run by remote workers:\n" + failedBackends
+		}
+	}
+	sendTextToAdmins(ctx, startedMsg)
+
+	if webhook.Enabled() {
+		if err := webhook.Run(ctx); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	telegramBot.Start(ctx)
 }
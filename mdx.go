@@ -10,31 +10,44 @@ import (
 )
 
 type MDX struct {
+	backendBase
 }
 
-var MDXInFilePath = os.TempDir() + "/mdx.wav"
-var MDXInstrumFilePath = os.TempDir() + "/mdx_instrum.wav"
-var MDXInstrum2FilePath = os.TempDir() + "/mdx_instrum2.wav"
-var MDXVocalsFilePath = os.TempDir() + "/mdx_vocals.wav"
-var MDXBassFilePath = os.TempDir() + "/mdx_bass.wav"
-var MDXDrumsFilePath = os.TempDir() + "/mdx_drums.wav"
-var MDXOtherFilePath = os.TempDir() + "/mdx_other.wav"
+const MDXInFileName = "mdx.wav"
 
-func (m *MDX) CleanupOutputFiles() {
-	os.Remove(MDXInstrumFilePath)
-	os.Remove(MDXInstrum2FilePath)
-	os.Remove(MDXVocalsFilePath)
-	os.Remove(MDXBassFilePath)
-	os.Remove(MDXDrumsFilePath)
-	os.Remove(MDXOtherFilePath)
+func (m *MDX) Name() string                  { return "mdx" }
+func (m *MDX) Description() string           { return "music and voice separation" }
+func (m *MDX) OutputKind() BackendOutputKind { return BackendOutputAudio }
+
+func (m *MDX) NewParams() ReqParams {
+	r := &ReqParamsMDX{}
+	ReqParamsSetDefaults(r)
+	return r
 }
 
-func (m *MDX) MDX(ctx context.Context, reqParams ReqParamsMDX, audioData AudioFileData) ([]UploadFileData, error) {
-	os.Remove(MDXInFilePath)
-	defer os.Remove(MDXInFilePath)
-	m.CleanupOutputFiles()
+func (m *MDX) SelfCheck() error { return checkBackendBin(getParams().MDXBin) }
+
+func (m *MDX) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	res.Audio, err = m.MDX(ctx, qEntry, *qEntry.Req.Params.(*ReqParamsMDX), qEntry.AudioData)
+	return
+}
+
+// MDX output file names (based on the input file name) and the suffixes of the uploaded files.
+var MDXOutFiles = []struct {
+	fileName string
+	suffix   string
+}{
+	{"mdx_instrum.wav", "Instrumental"},
+	{"mdx_instrum2.wav", "Instrumental2"},
+	{"mdx_vocals.wav", "Vocals"},
+	{"mdx_bass.wav", "Bass"},
+	{"mdx_drums.wav", "Drums"},
+	{"mdx_other.wav", "Other"},
+}
 
-	err := os.WriteFile(MDXInFilePath, audioData.data, 0644)
+func (m *MDX) MDX(ctx context.Context, qEntry *ReqQueueEntry, reqParams ReqParamsMDX, audioData AudioFileData) ([]UploadFileData, error) {
+	inFilePath := path.Join(qEntry.WorkDir, MDXInFileName)
+	err := audioData.writeFile(inFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("can't write mdx input file: %w", err)
 	}
@@ -43,9 +56,8 @@ func (m *MDX) MDX(ctx context.Context, reqParams ReqParamsMDX, audioData AudioFi
 	if !reqParams.FullOutput {
 		args = append(args, "--vocals_only", "True")
 	}
-	args = append(args, "--input_audio", MDXInFilePath, "--output_folder", os.TempDir())
-	cmd := NewCommand(ctx, params.MDXBin, args...)
-	cmd.Dir = path.Dir(params.MDXBin)
+	args = append(args, "--input_audio", inFilePath, "--output_folder", qEntry.WorkDir)
+	cmd := newBackendCommand(ctx, qEntry, getParams().MDXBin, args...)
 
 	var lineBeforePercent string
 	var percent int
@@ -56,91 +68,41 @@ func (m *MDX) MDX(ctx context.Context, reqParams ReqParamsMDX, audioData AudioFi
 			percent, err = strconv.Atoi(match[1])
 			if err == nil {
 				fmt.Print("    progress: ", lineBeforePercent, " ", percent, "%\n")
-				reqQueue.currentEntry.entry.sendProcessUpdate(ctx, lineBeforePercent, percent)
+				qEntry.sendProcessUpdate(ctx, lineBeforePercent, percent)
 			}
 		} else {
 			if line != "" {
 				lineBeforePercent = line
-				reqQueue.currentEntry.entry.sendProcessUpdate(ctx, lineBeforePercent, percent)
+				qEntry.sendProcessUpdate(ctx, lineBeforePercent, percent)
 			}
 		}
 	})
+	qEntry.cancelProcessUpdate()
 
 	if canceled {
-		m.CleanupOutputFiles()
 		return nil, nil
 	}
 
 	if err != nil {
-		m.CleanupOutputFiles()
 		return nil, fmt.Errorf("MDX run error: %w", err)
 	}
 
 	var result []UploadFileData
-	if _, err := os.Stat(MDXInstrumFilePath); !os.IsNotExist(err) {
-		r, err := converter.ConvertToMP3(ctx, MDXInstrumFilePath)
-		if err != nil {
-			m.CleanupOutputFiles()
-			return nil, err
-		}
-		result = append(result, UploadFileData{
-			r:        r,
-			filename: fileNameWithoutExt(audioData.filename) + " (Instrumental).mp3",
-		})
-	}
-	if _, err := os.Stat(MDXInstrum2FilePath); !os.IsNotExist(err) {
-		r, err := converter.ConvertToMP3(ctx, MDXInstrum2FilePath)
-		if err != nil {
-			m.CleanupOutputFiles()
-			return nil, err
-		}
-		result = append(result, UploadFileData{
-			r:        r,
-			filename: fileNameWithoutExt(audioData.filename) + " (Instrumental2).mp3",
-		})
-	}
-	if _, err := os.Stat(MDXVocalsFilePath); !os.IsNotExist(err) {
-		r, err := converter.ConvertToMP3(ctx, MDXVocalsFilePath)
-		if err != nil {
-			m.CleanupOutputFiles()
-			return nil, err
-		}
-		result = append(result, UploadFileData{
-			r:        r,
-			filename: fileNameWithoutExt(audioData.filename) + " (Vocals).mp3",
-		})
-	}
-	if _, err := os.Stat(MDXBassFilePath); !os.IsNotExist(err) {
-		r, err := converter.ConvertToMP3(ctx, MDXBassFilePath)
-		if err != nil {
-			m.CleanupOutputFiles()
-			return nil, err
-		}
-		result = append(result, UploadFileData{
-			r:        r,
-			filename: fileNameWithoutExt(audioData.filename) + " (Bass).mp3",
-		})
-	}
-	if _, err := os.Stat(MDXDrumsFilePath); !os.IsNotExist(err) {
-		r, err := converter.ConvertToMP3(ctx, MDXDrumsFilePath)
-		if err != nil {
-			m.CleanupOutputFiles()
-			return nil, err
+	for _, f := range MDXOutFiles {
+		outFilePath := path.Join(qEntry.WorkDir, f.fileName)
+		if _, err := os.Stat(outFilePath); os.IsNotExist(err) {
+			continue
 		}
-		result = append(result, UploadFileData{
-			r:        r,
-			filename: fileNameWithoutExt(audioData.filename) + " (Drums).mp3",
-		})
-	}
-	if _, err := os.Stat(MDXOtherFilePath); !os.IsNotExist(err) {
-		r, err := converter.ConvertToMP3(ctx, MDXOtherFilePath)
+		r, err := converter.ConvertToMP3(ctx, outFilePath)
 		if err != nil {
-			m.CleanupOutputFiles()
+			for i := range result {
+				result[i].r.Close()
+			}
 			return nil, err
 		}
 		result = append(result, UploadFileData{
 			r:        r,
-			filename: fileNameWithoutExt(audioData.filename) + " (Other).mp3",
+			filename: fileNameWithoutExt(audioData.filename) + " (" + f.suffix + ").mp3",
 		})
 	}
 
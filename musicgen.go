@@ -10,47 +10,59 @@ import (
 )
 
 type Musicgen struct {
+	backendBase
 }
 
-var MusicgenInFilePath = os.TempDir() + "/musicgen-in.wav"
-var MusicgenOutFilePath = os.TempDir() + "/0.wav"
+const MusicgenInFileName = "musicgen-in.wav"
+const MusicgenOutFileName = "0.wav"
 
-func (m *Musicgen) CleanupOutputFiles() {
-	os.Remove(MusicgenOutFilePath)
+func (m *Musicgen) Name() string        { return "musicgen" }
+func (m *Musicgen) Description() string { return "generate music based on given audio file and prompt" }
+func (m *Musicgen) PromptUsage() string { return "[prompt]" }
+
+func (m *Musicgen) NewParams() ReqParams {
+	r := &ReqParamsMusicgen{}
+	ReqParamsSetDefaults(r)
+	return r
+}
+
+func (m *Musicgen) Prepare(req *ReqQueueReq) error {
+	if req.Prompt == "" {
+		return fmt.Errorf("empty prompt")
+	}
+	return nil
+}
+
+func (m *Musicgen) SelfCheck() error { return checkBackendBin(getParams().MusicgenBin) }
+
+func (m *Musicgen) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	res.Voice, err = m.Musicgen(ctx, qEntry, *qEntry.Req.Params.(*ReqParamsMusicgen), qEntry.Req.Prompt, qEntry.AudioData)
+	return
 }
 
-func (m *Musicgen) Musicgen(ctx context.Context, reqParams ReqParamsMusicgen, prompt string, audioData AudioFileData) (io.ReadCloser, error) {
-	m.CleanupOutputFiles()
+func (m *Musicgen) Musicgen(ctx context.Context, qEntry *ReqQueueEntry, reqParams ReqParamsMusicgen, prompt string, audioData AudioFileData) (io.ReadCloser, error) {
+	inFilePath := path.Join(qEntry.WorkDir, MusicgenInFileName)
+	outFilePath := path.Join(qEntry.WorkDir, MusicgenOutFileName)
 
-	defer os.Remove(MusicgenInFilePath)
-	err := os.WriteFile(MusicgenInFilePath, audioData.data, 0644)
+	err := audioData.writeFile(inFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("can't write musicgen input file: %w", err)
 	}
 
-	args := []string{"--input_file", MusicgenInFilePath, "--description", prompt, "--output_path", os.TempDir()}
+	args := []string{"--input_file", inFilePath, "--description", prompt, "--output_path", qEntry.WorkDir}
 	if reqParams.LengthSecSet {
 		args = append(args, "--duration", strconv.Itoa(reqParams.LengthSec))
 	}
-	cmd := NewCommand(ctx, params.MusicgenBin, args...)
-	cmd.Dir = path.Dir(params.MusicgenBin)
+	cmd := newBackendCommand(ctx, qEntry, getParams().MusicgenBin, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		m.CleanupOutputFiles()
 		return nil, fmt.Errorf("musicgen error: %w: %s", err, string(output))
 	}
 
 	// Check output .wav file
-	if stat, err := os.Stat(MusicgenOutFilePath); os.IsNotExist(err) || stat.Size() == 0 {
-		m.CleanupOutputFiles()
-		return nil, fmt.Errorf("output file not found: %s", MusicgenOutFilePath)
-	}
-
-	r, err := converter.ConvertToOpus(ctx, MusicgenOutFilePath)
-	if err != nil {
-		m.CleanupOutputFiles()
-		return nil, err
+	if stat, err := os.Stat(outFilePath); os.IsNotExist(err) || stat.Size() == 0 {
+		return nil, fmt.Errorf("output file not found: %s", outFilePath)
 	}
 
-	return r, nil
+	return converter.ConvertToOpus(ctx, outFilePath)
 }
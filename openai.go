@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Settings of an OpenAI compatible speech API server, like the whisper.cpp or Coqui TTS servers. If the
+// URL is set, then the STT and TTS backends use the API instead of running their binaries.
+type OpenAIAPIConfig struct {
+	URL     string // Base URL of the API, for example http://localhost:8080/v1
+	Key     string
+	Model   string
+	Voice   string        // Only used for TTS.
+	Timeout time.Duration // HTTP request timeout, if 0 then only the processing timeout is used.
+}
+
+const openAITTSOutFileName = "tts-api.wav"
+
+// Sets the settings which were not given as command line arguments from the environment variables
+// with the given prefix, for example STT_API_URL, using the given getEnv function.
+func (c *OpenAIAPIConfig) initFromEnv(prefix string, getEnv func(string) string) error {
+	if c.URL == "" {
+		c.URL = getEnv(prefix + "_API_URL")
+	}
+	if c.Key == "" {
+		c.Key = getEnv(prefix + "_API_KEY")
+	}
+	if c.Model == "" {
+		c.Model = getEnv(prefix + "_API_MODEL")
+	}
+	if c.Voice == "" {
+		c.Voice = getEnv(prefix + "_API_VOICE")
+	}
+	if c.Timeout == 0 {
+		if v := getEnv(prefix + "_API_TIMEOUT"); v != "" {
+			var err error
+			if c.Timeout, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("invalid " + prefix + "_API_TIMEOUT value: " + v)
+			}
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid " + strings.ToLower(prefix) + " api timeout")
+	}
+	return nil
+}
+
+// Returns the API settings for the given request type. Profiles can have their own API settings,
+// otherwise the settings of the backend are used.
+func getOpenAIAPIConfig(reqType ReqType, backendConfig OpenAIAPIConfig) OpenAIAPIConfig {
+	if p, ok := getBackend(reqType).(*ProfileBackend); ok {
+		if p.api.URL != "" {
+			return p.api
+		} else if p.cfg.Bin != "" { // Profiles with a binary don't use the API of the backend.
+			return OpenAIAPIConfig{}
+		}
+	}
+	return backendConfig
+}
+
+// Sends a POST request to the given endpoint of the API and returns the response body.
+func (c OpenAIAPIConfig) post(ctx context.Context, endpoint, contentType string, body io.Reader) ([]byte, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.URL, "/")+endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("can't create api request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("api request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	d, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read api response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(d, &errResp) == nil && errResp.Error.Message != "" {
+			return nil, fmt.Errorf("api error: %s: %s", resp.Status, errResp.Error.Message)
+		}
+		if len(d) > 200 {
+			d = d[:200]
+		}
+		return nil, fmt.Errorf("api error: %s: %s", resp.Status, strings.TrimSpace(string(d)))
+	}
+	return d, nil
+}
+
+// Transcribes the audio data using the /audio/transcriptions endpoint.
+func (c OpenAIAPIConfig) Transcribe(ctx context.Context, audioData AudioFileData, language string) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := map[string]string{"model": c.Model, "language": language, "response_format": "json"}
+	for k, v := range fields {
+		if v == "" {
+			continue
+		}
+		if err := w.WriteField(k, v); err != nil {
+			return "", fmt.Errorf("can't create api request: %w", err)
+		}
+	}
+	filename := audioData.filename
+	if filename == "" {
+		filename = "audio.ogg"
+	}
+	fw, err := w.CreateFormFile("file", path.Base(filename))
+	if err != nil {
+		return "", fmt.Errorf("can't create api request: %w", err)
+	}
+	r, err := audioData.open()
+	if err != nil {
+		return "", fmt.Errorf("can't read audio data: %w", err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(fw, r); err != nil {
+		return "", fmt.Errorf("can't create api request: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("can't create api request: %w", err)
+	}
+
+	d, err := c.post(ctx, "/audio/transcriptions", w.FormDataContentType(), &body)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(d, &resp); err != nil {
+		// Some servers ignore the response format and reply with plain text.
+		return string(d), nil
+	}
+	return resp.Text, nil
+}
+
+// Generates speech from the text using the /audio/speech endpoint and writes it to outFilePath.
+func (c OpenAIAPIConfig) Speech(ctx context.Context, text, voice, outFilePath string) error {
+	if voice == "" {
+		voice = c.Voice
+	}
+	reqBody, err := json.Marshal(map[string]string{
+		"model":           c.Model,
+		"input":           text,
+		"voice":           voice,
+		"response_format": "wav",
+	})
+	if err != nil {
+		return fmt.Errorf("can't create api request: %w", err)
+	}
+
+	d, err := c.post(ctx, "/audio/speech", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	if len(d) == 0 {
+		return fmt.Errorf("api returned no audio")
+	}
+	if err := os.WriteFile(outFilePath, d, 0644); err != nil {
+		return fmt.Errorf("can't write api output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Starts a stand-in API server which checks the auth header and calls the given handler.
+func newTestAPIServer(t *testing.T, endpoint string, handler http.HandlerFunc) OpenAIAPIConfig {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1"+endpoint {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer test-key" {
+			t.Errorf("got authorization header %q", auth)
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return OpenAIAPIConfig{URL: server.URL + "/v1/", Key: "test-key", Model: "test-model", Voice: "default-voice"}
+}
+
+func TestOpenAITranscribe(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		reply       string
+		want        string
+	}{
+		{name: "json", contentType: "application/json", reply: `{"text":"hello world"}`, want: "hello world"},
+		{name: "plain text", contentType: "text/plain", reply: "hello world\n", want: "hello world\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPIServer(t, "/audio/transcriptions", func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseMultipartForm(1 << 20); err != nil {
+					t.Error(err)
+					return
+				}
+				if r.FormValue("model") != "test-model" || r.FormValue("language") != "en" ||
+					r.FormValue("response_format") != "json" {
+					t.Errorf("got form %v", r.MultipartForm.Value)
+				}
+				f, fh, err := r.FormFile("file")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer f.Close()
+				d, _ := io.ReadAll(f)
+				if fh.Filename != "in.ogg" || string(d) != "audio" {
+					t.Errorf("got file %s: %q", fh.Filename, d)
+				}
+				w.Header().Set("Content-Type", tt.contentType)
+				_, _ = w.Write([]byte(tt.reply))
+			})
+
+			got, err := api.Transcribe(context.Background(), AudioFileData{data: []byte("audio"), filename: "dir/in.ogg"}, "en")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAISpeech(t *testing.T) {
+	api := newTestAPIServer(t, "/audio/speech", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		if req["model"] != "test-model" || req["input"] != "hello" || req["voice"] != "default-voice" ||
+			req["response_format"] != "wav" {
+			t.Errorf("got request %v", req)
+		}
+		_, _ = w.Write([]byte("RIFF"))
+	})
+
+	outFilePath := path.Join(t.TempDir(), "out.wav")
+	if err := api.Speech(context.Background(), "hello", "", outFilePath); err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.ReadFile(outFilePath)
+	if err != nil || string(d) != "RIFF" {
+		t.Fatalf("got output %q, %v", d, err)
+	}
+}
+
+func TestOpenAIErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		reply   string
+		wantErr string
+	}{
+		{name: "json error", status: http.StatusBadRequest, reply: `{"error":{"message":"invalid voice"}}`,
+			wantErr: "api error: 400 Bad Request: invalid voice"},
+		{name: "plain error", status: http.StatusInternalServerError, reply: "  server exploded\n",
+			wantErr: "api error: 500 Internal Server Error: server exploded"},
+		{name: "long error", status: http.StatusBadGateway, reply: strings.Repeat("x", 300),
+			wantErr: "api error: 502 Bad Gateway: " + strings.Repeat("x", 200)},
+		{name: "no audio", status: http.StatusOK, wantErr: "api returned no audio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPIServer(t, "/audio/speech", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.reply))
+			})
+			err := api.Speech(context.Background(), "hello", "voice", path.Join(t.TempDir(), "out.wav"))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,21 +6,71 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/exp/slices"
 )
 
 type paramsType struct {
-	BotToken string
+	ConfigPath string
+	configEnv  map[string]string // Settings of the config file with their environment variable names.
+
+	BotToken    string
+	BotAPIURL   string
+	BotAPILocal bool
+
+	Check      bool // Only check the backends and exit.
+	CheckProbe bool
 
 	AllowedUserIDs  []int64
 	AdminUserIDs    []int64
 	AllowedGroupIDs []int64
 
+	QueueDBPath string
+
+	ToolsConfigPath string
+
+	ClipboardTTL     time.Duration
+	ClipboardDefault bool
+
+	UserWeights map[int64]float64
+
+	UserQuota  QuotaConfig
+	GroupQuota QuotaConfig
+	AdminQuota QuotaConfig
+
+	Workers  map[ReqType]int
+	Timeouts map[ReqType]time.Duration
+
+	Daemons           []ReqType
+	DaemonIdleTimeout time.Duration
+
+	MaxUploadSizeMB  int
+	FileServerAddr   string
+	FileServerURL    string
+	FileServerDir    string
+	FileServerTTL    time.Duration
+	FileServerSecret string
+
+	WebhookAddr   string
+	WebhookURL    string
+	WebhookSecret string
+	WebhookCert   string
+	WebhookKey    string
+
+	WorkerServerAddr string
+	WorkerToken      string
+	WorkerConnect    string
+	WorkerName       string
+	WorkerTypes      []ReqType
+
 	TTSBin          string
 	TTSDefaultModel string
+	TTSAPI          OpenAIAPIConfig
 
 	STTBin string
+	STTAPI OpenAIAPIConfig
 
 	MDXBin string
 
@@ -37,39 +87,142 @@ type paramsType struct {
 	AudiogenBin string
 }
 
-var params paramsType
+// The current params. Config reloads publish a new params value instead of modifying the current one, as
+// the params are read by many goroutines without locking.
+var currentParams atomic.Pointer[paramsType]
+
+func getParams() *paramsType {
+	return currentParams.Load()
+}
+
+// Returns the value of the given environment variable, or the value of the setting in the config file if
+// the environment variable is not set.
+func (p *paramsType) getEnv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return p.configEnv[name]
+}
 
 func (p *paramsType) Init() error {
-	flag.StringVar(&p.BotToken, "bot-token", "", "telegram bot token")
+	return p.parse(flag.CommandLine, os.Args[1:], false)
+}
+
+// Parses the command line arguments, the environment variables and the config file. The tools config is
+// not loaded again on reload, as the backends can't change while the bot is running.
+func (p *paramsType) parse(fs *flag.FlagSet, args []string, reload bool) error {
+	fs.StringVar(&p.ConfigPath, "config", "", "path to the JSON config file")
+	fs.StringVar(&p.BotToken, "bot-token", "", "telegram bot token")
+	fs.StringVar(&p.BotAPIURL, "bot-api-url", "", "url of the telegram bot api server (default https://api.telegram.org)")
+	fs.BoolVar(&p.BotAPILocal, "bot-api-local", false, "the bot api server runs in local mode, files are read from the paths it returns")
+	fs.BoolVar(&p.Check, "check", false, "check the backends, print the report and exit")
+	fs.BoolVar(&p.CheckProbe, "check-probe", false, "run the backend binaries with --help when checking them at startup")
 	var allowedUserIDs string
-	flag.StringVar(&allowedUserIDs, "allowed-user-ids", "", "allowed telegram user ids")
+	fs.StringVar(&allowedUserIDs, "allowed-user-ids", "", "allowed telegram user ids")
 	var adminUserIDs string
-	flag.StringVar(&adminUserIDs, "admin-user-ids", "", "admin telegram user ids")
+	fs.StringVar(&adminUserIDs, "admin-user-ids", "", "admin telegram user ids")
 	var allowedGroupIDs string
-	flag.StringVar(&allowedGroupIDs, "allowed-group-ids", "", "allowed telegram group ids")
-	flag.StringVar(&p.TTSBin, "tts-bin", "", "path to the tts binary")
-	flag.StringVar(&p.TTSDefaultModel, "tts-default-model", "", "default tts model")
-	flag.StringVar(&p.STTBin, "stt-bin", "", "path to the stt binary")
-	flag.StringVar(&p.MDXBin, "mdx-bin", "", "path to the mdx binary")
-	flag.StringVar(&p.RVCBin, "rvc-bin", "", "path to the rvc binary")
-	flag.StringVar(&p.RVCModelPath, "rvc-model-path", "", "path to the rvc weights directory")
-	flag.StringVar(&p.RVCDefaultModel, "rvc-default-model", "", "default rvc model")
-	flag.StringVar(&p.RVCTrainBin, "rvc-train-bin", "", "path to the rvc train binary")
-	flag.IntVar(&p.RVCTrainDefaultBatchSize, "rvc-train-default-batch-size", 0, "default rvc train batch size")
-	flag.IntVar(&p.RVCTrainDefaultEpochs, "rvc-train-default-epochs", 0, "default rvc train epochs")
-	flag.StringVar(&p.MusicgenBin, "musicgen-bin", "", "path to the musicgen binary")
-	flag.StringVar(&p.AudiogenBin, "audiogen-bin", "", "path to the audiogen binary")
-	flag.Parse()
+	fs.StringVar(&allowedGroupIDs, "allowed-group-ids", "", "allowed telegram group ids")
+	fs.StringVar(&p.QueueDBPath, "queue-db", "", "path to the request queue database file (default audio-ai-telegram-bot.db)")
+	fs.StringVar(&p.ToolsConfigPath, "tools-config", "", "path to the JSON config file of external tools")
+	fs.DurationVar(&p.ClipboardTTL, "clipboard-ttl", 0, "how long the last audio file of a chat is kept (default 1h)")
+	fs.BoolVar(&p.ClipboardDefault, "clipboard-default", false, "use the last audio file of the chat as input if no other audio file is given")
+	var userWeights string
+	fs.StringVar(&userWeights, "user-weights", "", "scheduling weights of users, for example 123=2,456=0.5")
+	var userQuota string
+	fs.StringVar(&userQuota, "user-quota", "", "per user limits, for example pending=3,hour=20,day=100,audio-min=60,rvc-train:day=2")
+	var groupQuota string
+	fs.StringVar(&groupQuota, "group-quota", "", "per group limits, same format as user-quota")
+	var adminQuota string
+	fs.StringVar(&adminQuota, "admin-quota", "", "limits for admins, same format as user-quota (default no limits)")
+	var workers string
+	fs.StringVar(&workers, "workers", "", "worker slots per request type, for example tts=2,stt=1,rvc-train=1")
+	var daemonTypes string
+	fs.StringVar(&daemonTypes, "daemons", "", "request types which use warm daemons, for example tts,musicgen")
+	fs.DurationVar(&p.DaemonIdleTimeout, "daemon-idle-timeout", 0, "daemons are stopped after being idle for this long (default 10m)")
+	fs.IntVar(&p.MaxUploadSizeMB, "max-upload-size", 0, "max. size of uploaded files in MB, larger results are sent through the file server (default 50, or 2000 with a bot api server)")
+	fs.StringVar(&p.FileServerAddr, "file-server", "", "listen address of the file server for results which are too large to upload, for example :8091")
+	fs.StringVar(&p.FileServerURL, "file-server-url", "", "public url of the file server used in the links, for example https://bot.example.com:8091")
+	fs.StringVar(&p.FileServerDir, "file-server-dir", "", "directory of the file server (default audio-ai-telegram-bot-files)")
+	fs.DurationVar(&p.FileServerTTL, "file-server-ttl", 0, "how long the files of the file server are kept (default 24h)")
+	fs.StringVar(&p.FileServerSecret, "file-server-secret", "", "secret used for signing the file server links (required if the file server is enabled)")
+	fs.StringVar(&p.WebhookAddr, "webhook", "", "receive updates with a webhook on the given listen address instead of long polling, for example :8443")
+	fs.StringVar(&p.WebhookURL, "webhook-url", "", "public url of the webhook which is registered at telegram, for example https://bot.example.com/telegram")
+	fs.StringVar(&p.WebhookSecret, "webhook-secret", "", "secret token which telegram sends with the webhook requests")
+	fs.StringVar(&p.WebhookCert, "webhook-cert", "", "tls certificate file of the webhook server")
+	fs.StringVar(&p.WebhookKey, "webhook-key", "", "tls key file of the webhook server")
+	fs.StringVar(&p.WorkerServerAddr, "worker-server", "", "listen address of the server for remote workers, for example :8090")
+	fs.StringVar(&p.WorkerToken, "worker-token", "", "shared secret of the bot and the remote workers")
+	fs.StringVar(&p.WorkerConnect, "worker-connect", "", "run as a remote worker of the bot with the given worker server url, for example http://bot:8090")
+	fs.StringVar(&p.WorkerName, "worker-name", "", "name of the remote worker (default hostname)")
+	var workerTypes string
+	fs.StringVar(&workerTypes, "worker-types", "", "request types the remote worker runs, for example stt,rvc (default all)")
+	timeouts := make([]time.Duration, len(backends))
+	for i, b := range backends {
+		switch b.(type) {
+		case *ToolBackend, *ProfileBackend: // Only present on reload, as tools are loaded after the flags are parsed.
+			continue
+		}
+		name := b.Name()
+		fs.DurationVar(&timeouts[i], name+"-timeout", 0, "processing timeout for "+name+" requests")
+	}
+	fs.StringVar(&p.TTSBin, "tts-bin", "", "path to the tts binary")
+	fs.StringVar(&p.TTSDefaultModel, "tts-default-model", "", "default tts model")
+	fs.StringVar(&p.TTSAPI.URL, "tts-api-url", "", "base url of an openai compatible speech api used instead of the tts binary, for example http://localhost:8080/v1")
+	fs.StringVar(&p.TTSAPI.Key, "tts-api-key", "", "tts api key")
+	fs.StringVar(&p.TTSAPI.Model, "tts-api-model", "", "tts api model")
+	fs.StringVar(&p.TTSAPI.Voice, "tts-api-voice", "", "default tts api voice")
+	fs.DurationVar(&p.TTSAPI.Timeout, "tts-api-timeout", 0, "tts api request timeout")
+	fs.StringVar(&p.STTBin, "stt-bin", "", "path to the stt binary")
+	fs.StringVar(&p.STTAPI.URL, "stt-api-url", "", "base url of an openai compatible transcription api used instead of the stt binary, for example http://localhost:8080/v1")
+	fs.StringVar(&p.STTAPI.Key, "stt-api-key", "", "stt api key")
+	fs.StringVar(&p.STTAPI.Model, "stt-api-model", "", "stt api model")
+	fs.DurationVar(&p.STTAPI.Timeout, "stt-api-timeout", 0, "stt api request timeout")
+	fs.StringVar(&p.MDXBin, "mdx-bin", "", "path to the mdx binary")
+	fs.StringVar(&p.RVCBin, "rvc-bin", "", "path to the rvc binary")
+	fs.StringVar(&p.RVCModelPath, "rvc-model-path", "", "path to the rvc weights directory")
+	fs.StringVar(&p.RVCDefaultModel, "rvc-default-model", "", "default rvc model")
+	fs.StringVar(&p.RVCTrainBin, "rvc-train-bin", "", "path to the rvc train binary")
+	fs.IntVar(&p.RVCTrainDefaultBatchSize, "rvc-train-default-batch-size", 0, "default rvc train batch size")
+	fs.IntVar(&p.RVCTrainDefaultEpochs, "rvc-train-default-epochs", 0, "default rvc train epochs")
+	fs.StringVar(&p.MusicgenBin, "musicgen-bin", "", "path to the musicgen binary")
+	fs.StringVar(&p.AudiogenBin, "audiogen-bin", "", "path to the audiogen binary")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
 
-	if p.BotToken == "" {
-		p.BotToken = os.Getenv("BOT_TOKEN")
+	if p.ConfigPath == "" {
+		p.ConfigPath = os.Getenv("CONFIG")
 	}
+	var config ConfigFile
+	if p.ConfigPath != "" {
+		var err error
+		if config, p.configEnv, err = loadConfigFile(p.ConfigPath); err != nil {
+			return err
+		}
+	}
+
+	if p.WorkerConnect == "" {
+		p.WorkerConnect = p.getEnv("WORKER_CONNECT")
+	}
+
 	if p.BotToken == "" {
+		p.BotToken = p.getEnv("BOT_TOKEN")
+	}
+	// Remote workers and the check mode don't connect to Telegram.
+	if p.BotToken == "" && p.WorkerConnect == "" && !p.Check {
 		return fmt.Errorf("bot token not set")
 	}
 
+	if p.BotAPIURL == "" {
+		p.BotAPIURL = p.getEnv("BOT_API_URL")
+	}
+	if !p.BotAPILocal {
+		p.BotAPILocal, _ = strconv.ParseBool(p.getEnv("BOT_API_LOCAL"))
+	}
+
 	if allowedUserIDs == "" {
-		allowedUserIDs = os.Getenv("ALLOWED_USERIDS")
+		allowedUserIDs = p.getEnv("ALLOWED_USERIDS")
 	}
 	sa := strings.Split(allowedUserIDs, ",")
 	for _, idStr := range sa {
@@ -84,7 +237,7 @@ func (p *paramsType) Init() error {
 	}
 
 	if adminUserIDs == "" {
-		adminUserIDs = os.Getenv("ADMIN_USERIDS")
+		adminUserIDs = p.getEnv("ADMIN_USERIDS")
 	}
 	sa = strings.Split(adminUserIDs, ",")
 	for _, idStr := range sa {
@@ -102,7 +255,7 @@ func (p *paramsType) Init() error {
 	}
 
 	if allowedGroupIDs == "" {
-		allowedGroupIDs = os.Getenv("ALLOWED_GROUPIDS")
+		allowedGroupIDs = p.getEnv("ALLOWED_GROUPIDS")
 	}
 	sa = strings.Split(allowedGroupIDs, ",")
 	for _, idStr := range sa {
@@ -116,48 +269,308 @@ func (p *paramsType) Init() error {
 		p.AllowedGroupIDs = append(p.AllowedGroupIDs, id)
 	}
 
+	if !p.CheckProbe {
+		p.CheckProbe, _ = strconv.ParseBool(p.getEnv("CHECK_PROBE"))
+	}
+
+	if p.ToolsConfigPath == "" {
+		p.ToolsConfigPath = p.getEnv("TOOLS_CONFIG")
+	}
+	if p.ToolsConfigPath != "" && !reload {
+		// Tools have to be loaded before the request type settings are parsed.
+		if err := loadToolsConfig(p.ToolsConfigPath); err != nil {
+			return err
+		}
+	}
+	if err := config.checkBackends(); err != nil {
+		return err
+	}
+
+	if p.QueueDBPath == "" {
+		p.QueueDBPath = p.getEnv("QUEUE_DB")
+	}
+	if p.QueueDBPath == "" {
+		p.QueueDBPath = "audio-ai-telegram-bot.db"
+	}
+
+	if p.ClipboardTTL == 0 {
+		if v := p.getEnv("CLIPBOARD_TTL"); v != "" {
+			var err error
+			p.ClipboardTTL, err = time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid CLIPBOARD_TTL value: " + v)
+			}
+		}
+	}
+	if !p.ClipboardDefault {
+		p.ClipboardDefault, _ = strconv.ParseBool(p.getEnv("CLIPBOARD_DEFAULT"))
+	}
+
+	if userWeights == "" {
+		userWeights = p.getEnv("USER_WEIGHTS")
+	}
+	p.UserWeights = make(map[int64]float64)
+	sa = strings.Split(userWeights, ",")
+	for _, weightStr := range sa {
+		if weightStr == "" {
+			continue
+		}
+		idStr, valStr, found := strings.Cut(weightStr, "=")
+		if !found {
+			return fmt.Errorf("user weights contains invalid setting: " + weightStr)
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("user weights contains invalid user ID: " + idStr)
+		}
+		weight, err := strconv.ParseFloat(valStr, 64)
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("user weights contains invalid weight: " + weightStr)
+		}
+		p.UserWeights[id] = weight
+	}
+
+	var err error
+	if userQuota == "" {
+		userQuota = p.getEnv("USER_QUOTA")
+	}
+	if p.UserQuota, err = ParseQuotaConfig(userQuota); err != nil {
+		return fmt.Errorf("user quota: %w", err)
+	}
+	if groupQuota == "" {
+		groupQuota = p.getEnv("GROUP_QUOTA")
+	}
+	if p.GroupQuota, err = ParseQuotaConfig(groupQuota); err != nil {
+		return fmt.Errorf("group quota: %w", err)
+	}
+	if adminQuota == "" {
+		adminQuota = p.getEnv("ADMIN_QUOTA")
+	}
+	if p.AdminQuota, err = ParseQuotaConfig(adminQuota); err != nil {
+		return fmt.Errorf("admin quota: %w", err)
+	}
+
+	if workers == "" {
+		workers = p.getEnv("WORKERS")
+	}
+	p.Workers = make(map[ReqType]int)
+	sa = strings.Split(workers, ",")
+	for _, workerStr := range sa {
+		if workerStr == "" {
+			continue
+		}
+		typeName, countStr, found := strings.Cut(workerStr, "=")
+		if !found {
+			return fmt.Errorf("workers contains invalid setting: " + workerStr)
+		}
+		reqType, err := ReqTypeFromName(typeName)
+		if err != nil {
+			return fmt.Errorf("workers contains invalid request type: " + typeName)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 1 {
+			return fmt.Errorf("workers contains invalid worker count: " + workerStr)
+		}
+		p.Workers[reqType] = count
+	}
+
+	if daemonTypes == "" {
+		daemonTypes = p.getEnv("DAEMONS")
+	}
+	sa = strings.Split(daemonTypes, ",")
+	for _, typeName := range sa {
+		if typeName == "" {
+			continue
+		}
+		reqType, err := ReqTypeFromName(typeName)
+		if err != nil {
+			return fmt.Errorf("daemons contains invalid request type: " + typeName)
+		}
+		p.Daemons = append(p.Daemons, reqType)
+	}
+	if p.DaemonIdleTimeout == 0 {
+		if v := p.getEnv("DAEMON_IDLE_TIMEOUT"); v != "" {
+			var err error
+			p.DaemonIdleTimeout, err = time.ParseDuration(v)
+			if err != nil || p.DaemonIdleTimeout < 0 {
+				return fmt.Errorf("invalid DAEMON_IDLE_TIMEOUT value: " + v)
+			}
+		}
+	}
+
+	if p.MaxUploadSizeMB == 0 {
+		if v := p.getEnv("MAX_UPLOAD_SIZE"); v != "" {
+			var err error
+			p.MaxUploadSizeMB, err = strconv.Atoi(v)
+			if err != nil || p.MaxUploadSizeMB < 0 {
+				return fmt.Errorf("invalid MAX_UPLOAD_SIZE value: " + v)
+			}
+		}
+	}
+	if p.FileServerAddr == "" {
+		p.FileServerAddr = p.getEnv("FILE_SERVER")
+	}
+	if p.FileServerURL == "" {
+		p.FileServerURL = p.getEnv("FILE_SERVER_URL")
+	}
+	if p.FileServerDir == "" {
+		p.FileServerDir = p.getEnv("FILE_SERVER_DIR")
+	}
+	if p.FileServerTTL == 0 {
+		if v := p.getEnv("FILE_SERVER_TTL"); v != "" {
+			var err error
+			p.FileServerTTL, err = time.ParseDuration(v)
+			if err != nil || p.FileServerTTL < 0 {
+				return fmt.Errorf("invalid FILE_SERVER_TTL value: " + v)
+			}
+		}
+	}
+	if p.FileServerSecret == "" {
+		p.FileServerSecret = p.getEnv("FILE_SERVER_SECRET")
+	}
+	// A random secret would invalidate the links on restart, while the files are still kept.
+	if p.FileServerAddr != "" && p.FileServerSecret == "" {
+		return fmt.Errorf("file server secret not set")
+	}
+
+	if p.WebhookAddr == "" {
+		p.WebhookAddr = p.getEnv("WEBHOOK")
+	}
+	if p.WebhookURL == "" {
+		p.WebhookURL = p.getEnv("WEBHOOK_URL")
+	}
+	if p.WebhookSecret == "" {
+		p.WebhookSecret = p.getEnv("WEBHOOK_SECRET")
+	}
+	if p.WebhookCert == "" {
+		p.WebhookCert = p.getEnv("WEBHOOK_CERT")
+	}
+	if p.WebhookKey == "" {
+		p.WebhookKey = p.getEnv("WEBHOOK_KEY")
+	}
+	if p.WebhookAddr != "" && p.WebhookURL == "" {
+		return fmt.Errorf("webhook url not set")
+	}
+	if (p.WebhookCert == "") != (p.WebhookKey == "") {
+		return fmt.Errorf("both the webhook tls certificate and key have to be set")
+	}
+
+	if p.WorkerServerAddr == "" {
+		p.WorkerServerAddr = p.getEnv("WORKER_SERVER")
+	}
+	if p.WorkerToken == "" {
+		p.WorkerToken = p.getEnv("WORKER_TOKEN")
+	}
+	if (p.WorkerServerAddr != "" || p.WorkerConnect != "") && p.WorkerToken == "" {
+		return fmt.Errorf("worker token not set")
+	}
+	if p.WorkerName == "" {
+		p.WorkerName = p.getEnv("WORKER_NAME")
+	}
+	if p.WorkerName == "" {
+		p.WorkerName, _ = os.Hostname()
+	}
+	if workerTypes == "" {
+		workerTypes = p.getEnv("WORKER_TYPES")
+	}
+	if workerTypes == "" {
+		for i := range backends {
+			p.WorkerTypes = append(p.WorkerTypes, ReqType(i))
+		}
+	}
+	sa = strings.Split(workerTypes, ",")
+	for _, typeName := range sa {
+		if typeName == "" {
+			continue
+		}
+		reqType, err := ReqTypeFromName(typeName)
+		if err != nil {
+			return fmt.Errorf("worker types contains invalid request type: " + typeName)
+		}
+		p.WorkerTypes = append(p.WorkerTypes, reqType)
+	}
+
+	p.Timeouts = make(map[ReqType]time.Duration)
+	// Tools and profiles don't have timeout flags, only env variables, the config file and the timeout
+	// set in the tools config.
+	timeouts = append(timeouts, make([]time.Duration, len(backends)-len(timeouts))...)
+	for i, b := range backends {
+		name := b.Name()
+		if timeouts[i] == 0 {
+			envName := strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_TIMEOUT"
+			if v := p.getEnv(envName); v != "" {
+				var err error
+				timeouts[i], err = time.ParseDuration(v)
+				if err != nil {
+					return fmt.Errorf("invalid " + envName + " value: " + v)
+				}
+			}
+		}
+		if timeouts[i] == 0 {
+			switch t := b.(type) {
+			case *ToolBackend:
+				timeouts[i] = t.timeout
+			case *ProfileBackend:
+				timeouts[i] = t.timeout
+			}
+		}
+		if timeouts[i] < 0 {
+			return fmt.Errorf("invalid " + name + " timeout")
+		}
+		if timeouts[i] > 0 {
+			p.Timeouts[ReqType(i)] = timeouts[i]
+		}
+	}
+
 	if p.TTSBin == "" {
-		p.TTSBin = os.Getenv("TTS_BIN")
+		p.TTSBin = p.getEnv("TTS_BIN")
 	}
 
 	if p.TTSDefaultModel == "" {
-		p.TTSDefaultModel = os.Getenv("TTS_DEFAULT_MODEL")
+		p.TTSDefaultModel = p.getEnv("TTS_DEFAULT_MODEL")
+	}
+
+	if err := p.TTSAPI.initFromEnv("TTS", p.getEnv); err != nil {
+		return err
 	}
 
 	if p.STTBin == "" {
-		p.STTBin = os.Getenv("STT_BIN")
+		p.STTBin = p.getEnv("STT_BIN")
+	}
+	if err := p.STTAPI.initFromEnv("STT", p.getEnv); err != nil {
+		return err
 	}
 
 	if p.MDXBin == "" {
-		p.MDXBin = os.Getenv("MDX_BIN")
+		p.MDXBin = p.getEnv("MDX_BIN")
 	}
 
 	if p.RVCBin == "" {
-		p.RVCBin = os.Getenv("RVC_BIN")
+		p.RVCBin = p.getEnv("RVC_BIN")
 	}
 	if p.RVCModelPath == "" {
-		p.RVCModelPath = os.Getenv("RVC_MODEL_PATH")
+		p.RVCModelPath = p.getEnv("RVC_MODEL_PATH")
 	}
 	if p.RVCDefaultModel == "" {
-		p.RVCDefaultModel = os.Getenv("RVC_DEFAULT_MODEL")
+		p.RVCDefaultModel = p.getEnv("RVC_DEFAULT_MODEL")
 	}
 
 	if p.RVCTrainBin == "" {
-		p.RVCTrainBin = os.Getenv("RVC_TRAIN_BIN")
+		p.RVCTrainBin = p.getEnv("RVC_TRAIN_BIN")
 	}
 	if p.RVCTrainDefaultBatchSize == 0 {
-		p.RVCTrainDefaultBatchSize, _ = strconv.Atoi(os.Getenv("RVC_TRAIN_DEFAULT_BATCH_SIZE"))
+		p.RVCTrainDefaultBatchSize, _ = strconv.Atoi(p.getEnv("RVC_TRAIN_DEFAULT_BATCH_SIZE"))
 	}
 	if p.RVCTrainDefaultEpochs == 0 {
-		p.RVCTrainDefaultEpochs, _ = strconv.Atoi(os.Getenv("RVC_TRAIN_DEFAULT_EPOCHS"))
+		p.RVCTrainDefaultEpochs, _ = strconv.Atoi(p.getEnv("RVC_TRAIN_DEFAULT_EPOCHS"))
 	}
 
 	if p.MusicgenBin == "" {
-		p.MusicgenBin = os.Getenv("MUSICGEN_BIN")
+		p.MusicgenBin = p.getEnv("MUSICGEN_BIN")
 	}
 
 	if p.AudiogenBin == "" {
-		p.AudiogenBin = os.Getenv("AUDIOGEN_BIN")
+		p.AudiogenBin = p.getEnv("AUDIOGEN_BIN")
 	}
 
 	return nil
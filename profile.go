@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Profiles are variants of a backend with their own binary, extra args and default params. They are
+// defined in the tools config file, and get their own command and request type.
+
+type ProfileConfig struct {
+	Name        string `json:"name"`    // The command will be "aai" + name, for example "stt-fast".
+	Backend     string `json:"backend"` // Name of the backend or tool, for example "stt".
+	Description string `json:"description"`
+	Bin         string `json:"bin"` // If empty, then the binary of the backend is used.
+	// Extra command line arguments, added before the arguments of the backend.
+	Args []string `json:"args"`
+	// Default params in the same format as in the commands, for example "-l 30".
+	Params  string `json:"params"`
+	Timeout string `json:"timeout"`
+
+	// Settings of an OpenAI compatible speech API, only for stt and tts profiles. If the URL is set, then
+	// the API is used instead of the binary.
+	APIURL     string `json:"api_url"`
+	APIKey     string `json:"api_key"`
+	APIModel   string `json:"api_model"`
+	APIVoice   string `json:"api_voice"`
+	APITimeout string `json:"api_timeout"`
+}
+
+// ProfileBackend is a backend profile, all methods which are not overridden are the base backend's.
+type ProfileBackend struct {
+	Backend
+
+	cfg     ProfileConfig
+	timeout time.Duration
+	api     OpenAIAPIConfig
+}
+
+func (p *ProfileBackend) Name() string { return p.cfg.Name }
+
+func (p *ProfileBackend) Description() string {
+	if p.cfg.Description != "" {
+		return p.cfg.Description
+	}
+	return p.Backend.Description() + " (" + p.cfg.Name + " profile)"
+}
+
+func (p *ProfileBackend) NewParams() ReqParams {
+	r := p.Backend.NewParams()
+	if p.cfg.Params != "" {
+		// The default params were checked when the profile got loaded.
+		_, _ = ReqParamsParse(context.Background(), p.cfg.Params, r)
+	}
+	return r
+}
+
+// Profiles with their own binary or API only need those, others need their base backend.
+func (p *ProfileBackend) SelfCheck() error {
+	if p.api.URL != "" {
+		return nil
+	}
+	if p.cfg.Bin != "" {
+		return checkBackendBin(p.cfg.Bin)
+	}
+	return p.Backend.SelfCheck()
+}
+
+// Returns the profile of the given backend. The profile name can be given with or without the name of
+// the backend as a prefix, for example both "fast" and "stt-fast" can be used for the "stt-fast"
+// profile of the "stt" backend.
+func getProfile(b Backend, name string) (ReqType, error) {
+	if p, ok := b.(*ProfileBackend); ok {
+		b = p.Backend
+	}
+	name = strings.ToLower(name)
+	for i, pb := range backends {
+		p, ok := pb.(*ProfileBackend)
+		if !ok || p.Backend != b {
+			continue
+		}
+		if name == p.cfg.Name || b.Name()+"-"+name == p.cfg.Name {
+			return ReqType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown " + b.Name() + " profile " + name)
+}
+
+// Returns the names of the enabled profiles of the given backend.
+func getProfileNames(b Backend) (names []string) {
+	for i, pb := range backends {
+		if p, ok := pb.(*ProfileBackend); ok && p.Backend == b && checkReqTypeEnabled(ReqType(i)) == nil {
+			names = append(names, p.cfg.Name)
+		}
+	}
+	return
+}
+
+// Returns a command which runs the given backend binary for the request. If the request is of a
+// profile, then the binary and the extra args of the profile are used. The command is run by a warm
+// daemon if it's enabled for the request type.
+func newBackendCommand(ctx context.Context, qEntry *ReqQueueEntry, bin string, args ...string) *Cmd {
+	if p, ok := getBackend(qEntry.Req.Type).(*ProfileBackend); ok {
+		if p.cfg.Bin != "" {
+			bin = p.cfg.Bin
+		}
+		args = append(slices.Clone(p.cfg.Args), args...)
+	}
+	cmd := NewCommand(ctx, bin, args...)
+	cmd.Dir = path.Dir(bin)
+	cmd.daemon = daemons.Get(qEntry.Req.Type, bin)
+	return cmd
+}
+
+func newProfileBackend(cfg ProfileConfig) (*ProfileBackend, error) {
+	if !toolNameRegex.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("invalid profile name: %s", cfg.Name)
+	}
+	if _, err := ReqTypeFromName(cfg.Name); err == nil {
+		return nil, fmt.Errorf("profile name %s is already used", cfg.Name)
+	}
+	if slices.Contains(reservedCmdNames, cfg.Name) || strings.HasSuffix(cfg.Name, "-models") {
+		return nil, fmt.Errorf("profile name %s is reserved", cfg.Name)
+	}
+
+	baseReqType, err := ReqTypeFromName(cfg.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", cfg.Name, err)
+	}
+	base := getBackend(baseReqType)
+	if _, ok := base.(*ProfileBackend); ok {
+		return nil, fmt.Errorf("profile %s: the backend of a profile can't be another profile", cfg.Name)
+	}
+
+	p := &ProfileBackend{Backend: base, cfg: cfg}
+
+	if cfg.Params != "" {
+		r := base.NewParams()
+		prompt, err := ReqParamsParse(context.Background(), cfg.Params, r)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s has invalid params: %w", cfg.Name, err)
+		}
+		if prompt != "" {
+			return nil, fmt.Errorf("profile %s params can't contain a prompt: %s", cfg.Name, prompt)
+		}
+		if r.Common() != (ReqParamsCommon{}) {
+			return nil, fmt.Errorf("profile %s params can't contain params for all commands", cfg.Name)
+		}
+	}
+	if cfg.APIURL != "" {
+		if base != Backend(&stt) && base != Backend(&tts) {
+			return nil, fmt.Errorf("profile %s: only stt and tts profiles can use an api", cfg.Name)
+		}
+		p.api = OpenAIAPIConfig{URL: cfg.APIURL, Key: cfg.APIKey, Model: cfg.APIModel, Voice: cfg.APIVoice}
+		if cfg.APITimeout != "" {
+			if p.api.Timeout, err = time.ParseDuration(cfg.APITimeout); err != nil || p.api.Timeout <= 0 {
+				return nil, fmt.Errorf("profile %s has invalid api timeout: %s", cfg.Name, cfg.APITimeout)
+			}
+		}
+	}
+	if cfg.Timeout != "" {
+		if p.timeout, err = time.ParseDuration(cfg.Timeout); err != nil || p.timeout <= 0 {
+			return nil, fmt.Errorf("profile %s has invalid timeout: %s", cfg.Name, cfg.Timeout)
+		}
+	}
+	return p, nil
+}
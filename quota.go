@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"golang.org/x/exp/slices"
+)
+
+type QuotaLimits struct {
+	Pending        int     // Max. number of requests in the queue at the same time.
+	PerHour        int     // Max. number of accepted requests in the last hour.
+	PerDay         int     // Max. number of accepted requests in the last 24 hours.
+	AudioMinPerDay float64 // Max. input audio minutes in the last 24 hours.
+}
+
+func (l QuotaLimits) isSet() bool {
+	return l.Pending > 0 || l.PerHour > 0 || l.PerDay > 0 || l.AudioMinPerDay > 0
+}
+
+type QuotaConfig struct {
+	All     QuotaLimits // Limits for all request types together.
+	PerType map[ReqType]QuotaLimits
+}
+
+func (c QuotaConfig) isSet() bool {
+	return c.All.isSet() || len(c.PerType) > 0
+}
+
+// Parses quota settings like "pending=3,hour=20,day=100,audio-min=60,rvc-train:day=2". Settings
+// prefixed with a request type only apply to that request type.
+func ParseQuotaConfig(s string) (c QuotaConfig, err error) {
+	c.PerType = make(map[ReqType]QuotaLimits)
+	for _, setting := range strings.Split(s, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		name, valStr, found := strings.Cut(setting, "=")
+		if !found {
+			return c, fmt.Errorf("invalid quota setting: " + setting)
+		}
+
+		limits := &c.All
+		var typeLimits QuotaLimits
+		var reqType ReqType
+		typeName, limitName, hasType := strings.Cut(name, ":")
+		if hasType {
+			reqType, err = ReqTypeFromName(typeName)
+			if err != nil {
+				return c, fmt.Errorf("invalid quota setting: %w", err)
+			}
+			typeLimits = c.PerType[reqType]
+			limits = &typeLimits
+			name = limitName
+		}
+
+		val, err := strconv.ParseFloat(valStr, 64)
+		if err != nil || val < 0 {
+			return c, fmt.Errorf("invalid quota value: " + setting)
+		}
+
+		switch name {
+		case "pending":
+			limits.Pending = int(val)
+		case "hour":
+			limits.PerHour = int(val)
+		case "day":
+			limits.PerDay = int(val)
+		case "audio-min":
+			limits.AudioMinPerDay = val
+		default:
+			return c, fmt.Errorf("unknown quota setting: " + name)
+		}
+
+		if hasType {
+			c.PerType[reqType] = typeLimits
+		}
+	}
+	return c, nil
+}
+
+type quotaUsageRecord struct {
+	At            time.Time     `json:"at"`
+	ReqType       ReqType       `json:"type"`
+	AudioDuration time.Duration `json:"audio_duration,omitempty"`
+	// The ID of the reservation of the request. The usage is refunded if the reservation is released
+	// unsuccessfully.
+	ResID uint64 `json:"res_id,omitempty"`
+}
+
+// The quota reserved for a request. The request counts as pending until its reservation is released.
+type QuotaReservation struct {
+	id      uint64 // Stored with the queue entry, so the reservation can be restored after a restart.
+	keys    []int64
+	reqType ReqType
+}
+
+// Quota keeps track of the accepted requests of users and groups, and checks them against the
+// configured limits. Usage records are saved to the store, so the quotas are kept after a restart.
+type Quota struct {
+	mutex sync.Mutex
+	store *Store // Nil if the usage is not saved.
+	// Keys are user IDs and group chat IDs. They can't collide as group chat IDs are negative.
+	usage   map[int64][]quotaUsageRecord
+	pending map[*QuotaReservation]bool
+}
+
+type quotaCheckTarget struct {
+	key    int64
+	config QuotaConfig
+	desc   string
+}
+
+// Returns the users and groups whose limits apply to the given request message.
+func (q *Quota) getTargets(msg *models.Message) (targets []quotaCheckTarget) {
+	if isAdmin(msg.From.ID) {
+		// Admins are exempt from the limits, unless admin limits are configured.
+		if getParams().AdminQuota.isSet() {
+			targets = append(targets, quotaCheckTarget{
+				key:    msg.From.ID,
+				config: getParams().AdminQuota,
+				desc:   "your",
+			})
+		}
+		return
+	}
+
+	if getParams().UserQuota.isSet() {
+		targets = append(targets, quotaCheckTarget{
+			key:    msg.From.ID,
+			config: getParams().UserQuota,
+			desc:   "your",
+		})
+	}
+	if msg.Chat.ID < 0 && getParams().GroupQuota.isSet() {
+		targets = append(targets, quotaCheckTarget{
+			key:    msg.Chat.ID,
+			config: getParams().GroupQuota,
+			desc:   "this group's",
+		})
+	}
+	return
+}
+
+func formatResetTime(t time.Time) string {
+	d := time.Until(t)
+	if d < time.Minute {
+		return "in less than a minute"
+	}
+	return "in " + d.Round(time.Minute).String()
+}
+
+// Checks the given limits. If reqType is nil, then the limits apply for all request types.
+func (q *Quota) checkLimits(target quotaCheckTarget, limits QuotaLimits, reqType *ReqType, audioDuration time.Duration) error {
+	typeDesc := ""
+	if reqType != nil {
+		typeDesc = " " + reqType.String()
+	}
+
+	if limits.Pending > 0 && audioDuration == 0 {
+		var pending int
+		for res := range q.pending {
+			if slices.Contains(res.keys, target.key) && (reqType == nil || res.reqType == *reqType) {
+				pending++
+			}
+		}
+		if pending >= limits.Pending {
+			return fmt.Errorf("%s quota of %d pending%s requests is used up, wait until a request finishes",
+				target.desc, limits.Pending, typeDesc)
+		}
+	}
+
+	var lastHourCount, lastDayCount int
+	var audioSum time.Duration
+	var oldestInHour, oldestInDay, oldestAudioInDay time.Time
+	for _, r := range q.usage[target.key] {
+		if reqType != nil && r.ReqType != *reqType {
+			continue
+		}
+		if time.Since(r.At) < time.Hour {
+			if lastHourCount == 0 {
+				oldestInHour = r.At
+			}
+			lastHourCount++
+		}
+		if time.Since(r.At) < 24*time.Hour {
+			if lastDayCount == 0 {
+				oldestInDay = r.At
+			}
+			lastDayCount++
+			if r.AudioDuration > 0 {
+				if audioSum == 0 {
+					oldestAudioInDay = r.At
+				}
+				audioSum += r.AudioDuration
+			}
+		}
+	}
+
+	if audioDuration == 0 {
+		if limits.PerHour > 0 && lastHourCount >= limits.PerHour {
+			return fmt.Errorf("%s quota of %d%s requests per hour is used up, it resets %s",
+				target.desc, limits.PerHour, typeDesc, formatResetTime(oldestInHour.Add(time.Hour)))
+		}
+		if limits.PerDay > 0 && lastDayCount >= limits.PerDay {
+			return fmt.Errorf("%s quota of %d%s requests per day is used up, it resets %s",
+				target.desc, limits.PerDay, typeDesc, formatResetTime(oldestInDay.Add(24*time.Hour)))
+		}
+	}
+
+	if limits.AudioMinPerDay > 0 {
+		limit := time.Duration(limits.AudioMinPerDay * float64(time.Minute))
+		if audioSum+audioDuration > limit || (audioDuration == 0 && audioSum >= limit) {
+			s := fmt.Sprintf("%s quota of %g%s audio minutes per day", target.desc, limits.AudioMinPerDay, typeDesc)
+			if audioSum > 0 {
+				s += fmt.Sprintf(" would be exceeded (%.1f minutes used), it resets %s", audioSum.Minutes(),
+					formatResetTime(oldestAudioInDay.Add(24*time.Hour)))
+			} else {
+				s += " would be exceeded"
+			}
+			return fmt.Errorf("%s", s)
+		}
+	}
+	return nil
+}
+
+// Must be called with the mutex locked.
+func (q *Quota) check(targets []quotaCheckTarget, reqType ReqType, audioDuration time.Duration) error {
+	for _, target := range targets {
+		if err := q.checkLimits(target, target.config.All, nil, audioDuration); err != nil {
+			return err
+		}
+		if typeLimits, ok := target.config.PerType[reqType]; ok {
+			if err := q.checkLimits(target, typeLimits, &reqType, audioDuration); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Loads the usage records from the given store, and saves them there on changes.
+func (q *Quota) Load(s *Store) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.store = s
+	usage, err := s.LoadQuotaUsage()
+	if err != nil {
+		return err
+	}
+	q.usage = make(map[int64][]quotaUsageRecord)
+	for key, records := range usage {
+		q.usage[key] = removeExpiredQuotaRecords(records)
+	}
+	return nil
+}
+
+// Must be called with the mutex locked.
+func (q *Quota) save(keys []int64) {
+	if q.store == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := q.store.SaveQuotaUsage(key, q.usage[key]); err != nil {
+			fmt.Println("can't store quota usage:", err)
+		}
+	}
+}
+
+// Removes the records which are too old to count.
+func removeExpiredQuotaRecords(records []quotaUsageRecord) []quotaUsageRecord {
+	for len(records) > 0 && time.Since(records[0].At) >= 24*time.Hour {
+		records = records[1:]
+	}
+	return records
+}
+
+// Must be called with the mutex locked.
+func (q *Quota) addUsage(keys []int64, r quotaUsageRecord) {
+	if q.usage == nil {
+		q.usage = make(map[int64][]quotaUsageRecord)
+	}
+	for _, key := range keys {
+		q.usage[key] = append(removeExpiredQuotaRecords(q.usage[key]), r)
+	}
+	q.save(keys)
+}
+
+// Must be called with the mutex locked.
+func (q *Quota) addPending(msg *models.Message, res *QuotaReservation) {
+	for _, target := range q.getTargets(msg) {
+		res.keys = append(res.keys, target.key)
+	}
+	if q.pending == nil {
+		q.pending = make(map[*QuotaReservation]bool)
+	}
+	q.pending[res] = true
+}
+
+// Returns true if an audio minutes limit applies to the given request type.
+func hasAudioQuotaLimit(targets []quotaCheckTarget, reqType ReqType) bool {
+	for _, target := range targets {
+		if target.config.All.AudioMinPerDay > 0 || target.config.PerType[reqType].AudioMinPerDay > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the user and group of the given request message can add a new request, and if they can,
+// then reserves the quota of the request. The reservation has to be released when the request finishes.
+func (q *Quota) Reserve(msg *models.Message, reqType ReqType) (*QuotaReservation, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.check(q.getTargets(msg), reqType, 0); err != nil {
+		return nil, err
+	}
+	res := &QuotaReservation{id: rand.Uint64(), reqType: reqType}
+	q.addPending(msg, res)
+	q.addUsage(res.keys, quotaUsageRecord{At: time.Now(), ReqType: reqType, ResID: res.id})
+	return res, nil
+}
+
+// Checks if the user and group of the given request message can process the given amount of audio, and if
+// they can, then adds it to the reservation of the request. If the audio duration is unknown (0), then the
+// request is rejected if an audio minutes limit applies to it.
+func (q *Quota) ReserveAudio(res *QuotaReservation, msg *models.Message, audioDuration time.Duration) error {
+	if res == nil {
+		return nil
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	targets := q.getTargets(msg)
+	if audioDuration <= 0 {
+		if hasAudioQuotaLimit(targets, res.reqType) {
+			return fmt.Errorf("can't get the length of the audio, which is needed for checking the audio minutes quota")
+		}
+		return nil
+	}
+	if err := q.check(targets, res.reqType, audioDuration); err != nil {
+		return err
+	}
+	// The audio is added to the record of the request, so the request is still counted once.
+	for _, key := range res.keys {
+		for i := range q.usage[key] {
+			if q.usage[key][i].ResID == res.id {
+				q.usage[key][i].AudioDuration += audioDuration
+			}
+		}
+	}
+	q.save(res.keys)
+	return nil
+}
+
+// Returns the ID of the reservation which is stored with the queue entry, or 0 if there's no reservation.
+func (res *QuotaReservation) ID() uint64 {
+	if res == nil {
+		return 0
+	}
+	return res.id
+}
+
+// Adds the pending reservation with the given stored ID without checking the limits. Used for requests
+// which were resumed after a restart, their usage is refunded if they don't complete.
+func (q *Quota) Restore(msg *models.Message, reqType ReqType, id uint64) *QuotaReservation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	res := &QuotaReservation{id: id, reqType: reqType}
+	q.addPending(msg, res)
+	return res
+}
+
+// Releases the reservation of a finished request. The reserved usage is refunded if the request was not
+// completed successfully (it was canceled, timed out or failed).
+func (q *Quota) Release(res *QuotaReservation, completed bool) {
+	if res == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.pending[res] {
+		return
+	}
+	delete(q.pending, res)
+	if completed {
+		return
+	}
+	for _, key := range res.keys {
+		var records []quotaUsageRecord
+		for _, r := range q.usage[key] {
+			if r.ResID != res.id {
+				records = append(records, r)
+			}
+		}
+		q.usage[key] = records
+	}
+	q.save(res.keys)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+func setTestParams(t *testing.T, p *paramsType) {
+	prev := currentParams.Load()
+	currentParams.Store(p)
+	t.Cleanup(func() { currentParams.Store(prev) })
+}
+
+func newTestMessage(userID, chatID int64) *models.Message {
+	return &models.Message{From: &models.User{ID: userID}, Chat: models.Chat{ID: chatID}}
+}
+
+func TestQuotaAudioRequestCountsOnce(t *testing.T) {
+	var p paramsType
+	p.UserQuota, _ = ParseQuotaConfig("hour=2,audio-min=10")
+	setTestParams(t, &p)
+
+	var q Quota
+	msg := newTestMessage(1, 1)
+	res, err := q.Reserve(msg, ReqTypeSTT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.ReserveAudio(res, msg, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	q.Release(res, true)
+
+	if n := len(q.usage[1]); n != 1 {
+		t.Fatalf("got %d usage records, want 1", n)
+	}
+	if _, err := q.Reserve(msg, ReqTypeSTT); err != nil {
+		t.Fatalf("second request rejected: %v", err)
+	}
+	if _, err := q.Reserve(msg, ReqTypeSTT); err == nil {
+		t.Fatal("third request accepted")
+	}
+}
+
+func TestParseQuotaConfig(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    QuotaConfig
+		wantErr bool
+	}{
+		{s: "", want: QuotaConfig{PerType: map[ReqType]QuotaLimits{}}},
+		{
+			s:    "pending=3, hour=20,day=100,audio-min=1.5",
+			want: QuotaConfig{All: QuotaLimits{Pending: 3, PerHour: 20, PerDay: 100, AudioMinPerDay: 1.5}, PerType: map[ReqType]QuotaLimits{}},
+		},
+		{
+			s: "day=10,rvc-train:day=2,rvc-train:pending=1",
+			want: QuotaConfig{All: QuotaLimits{PerDay: 10}, PerType: map[ReqType]QuotaLimits{
+				ReqTypeRVCTrain: {PerDay: 2, Pending: 1},
+			}},
+		},
+		{s: "day", wantErr: true},
+		{s: "day=x", wantErr: true},
+		{s: "day=-1", wantErr: true},
+		{s: "week=1", wantErr: true},
+		{s: "nosuchtype:day=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuotaConfig(tt.s)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseQuotaConfig(%q): expected error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuotaConfig(%q): %v", tt.s, err)
+			continue
+		}
+		if got.All != tt.want.All || len(got.PerType) != len(tt.want.PerType) {
+			t.Errorf("ParseQuotaConfig(%q) = %+v, want %+v", tt.s, got, tt.want)
+			continue
+		}
+		for reqType, limits := range tt.want.PerType {
+			if got.PerType[reqType] != limits {
+				t.Errorf("ParseQuotaConfig(%q) %s limits = %+v, want %+v", tt.s, reqType, got.PerType[reqType], limits)
+			}
+		}
+	}
+}
+
+func TestQuotaLimits(t *testing.T) {
+	const userID = 1
+	const groupID = -100
+	tests := []struct {
+		name       string
+		userQuota  string
+		groupQuota string
+		chatID     int64
+		reqType    ReqType
+		// Previous requests of the user, completed at the given times ago.
+		prev      []time.Duration
+		prevAudio time.Duration
+		pending   int
+		audio     time.Duration
+		wantErr   string
+	}{
+		{name: "no limits"},
+		{name: "hour ok", userQuota: "hour=2", prev: []time.Duration{10 * time.Minute}},
+		{name: "hour used up", userQuota: "hour=2", prev: []time.Duration{50 * time.Minute, 10 * time.Minute},
+			wantErr: "your quota of 2 requests per hour is used up, it resets in 10m0s"},
+		{name: "hour expired", userQuota: "hour=1", prev: []time.Duration{2 * time.Hour}},
+		{name: "day used up", userQuota: "day=1", prev: []time.Duration{2 * time.Hour},
+			wantErr: "your quota of 1 requests per day is used up, it resets in 22h0m0s"},
+		{name: "reset soon", userQuota: "day=1", prev: []time.Duration{24*time.Hour - 30*time.Second},
+			wantErr: "your quota of 1 requests per day is used up, it resets in less than a minute"},
+		{name: "type limit other type", userQuota: "rvc-train:day=1", reqType: ReqTypeTTS,
+			prev: []time.Duration{time.Hour}},
+		{name: "type limit", userQuota: "tts:day=1", reqType: ReqTypeTTS, prev: []time.Duration{time.Hour},
+			wantErr: "your quota of 1 tts requests per day is used up, it resets in 23h0m0s"},
+		{name: "pending", userQuota: "pending=1", pending: 1,
+			wantErr: "your quota of 1 pending requests is used up, wait until a request finishes"},
+		{name: "group", groupQuota: "hour=1", chatID: groupID, prev: []time.Duration{time.Minute},
+			wantErr: "this group's quota of 1 requests per hour is used up, it resets in 59m0s"},
+		{name: "group limit in private chat", groupQuota: "hour=1", prev: []time.Duration{time.Minute}},
+		{name: "audio ok", userQuota: "audio-min=5", audio: 4 * time.Minute},
+		{name: "audio exceeded", userQuota: "audio-min=5", prev: []time.Duration{time.Hour}, prevAudio: 2 * time.Minute,
+			audio: 4 * time.Minute, wantErr: "your quota of 5 audio minutes per day would be exceeded (2.0 minutes used), it resets in 23h0m0s"},
+		{name: "audio unknown", userQuota: "audio-min=5",
+			wantErr: "can't get the length of the audio, which is needed for checking the audio minutes quota"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p paramsType
+			p.UserQuota, _ = ParseQuotaConfig(tt.userQuota)
+			p.GroupQuota, _ = ParseQuotaConfig(tt.groupQuota)
+			setTestParams(t, &p)
+
+			chatID := tt.chatID
+			if chatID == 0 {
+				chatID = userID
+			}
+			msg := newTestMessage(userID, chatID)
+			keys := []int64{userID}
+			if chatID < 0 {
+				keys = append(keys, chatID)
+			}
+			var q Quota
+			for _, ago := range tt.prev {
+				q.addUsage(keys, quotaUsageRecord{At: time.Now().Add(-ago), ReqType: tt.reqType, AudioDuration: tt.prevAudio})
+			}
+			for i := 0; i < tt.pending; i++ {
+				if _, err := q.Reserve(msg, tt.reqType); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res, err := q.Reserve(msg, tt.reqType)
+			if err == nil {
+				err = q.ReserveAudio(res, msg, tt.audio)
+			}
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestQuotaRefund(t *testing.T) {
+	var p paramsType
+	p.UserQuota, _ = ParseQuotaConfig("pending=1,day=2,audio-min=5")
+	setTestParams(t, &p)
+
+	var q Quota
+	msg := newTestMessage(1, 1)
+	for i := 0; i < 3; i++ {
+		res, err := q.Reserve(msg, ReqTypeSTT)
+		if err != nil {
+			t.Fatalf("request %d rejected: %v", i, err)
+		}
+		if err := q.ReserveAudio(res, msg, 4*time.Minute); err != nil {
+			t.Fatalf("audio of request %d rejected: %v", i, err)
+		}
+		// Failed requests are refunded, and don't count as pending anymore.
+		q.Release(res, false)
+		q.Release(res, true) // Releasing again has no effect.
+	}
+	if n := len(q.usage[1]); n != 0 {
+		t.Fatalf("got %d usage records after refunds, want 0", n)
+	}
+}
+
+func TestQuotaStore(t *testing.T) {
+	var p paramsType
+	p.UserQuota, _ = ParseQuotaConfig("day=2")
+	p.GroupQuota, _ = ParseQuotaConfig("day=5")
+	setTestParams(t, &p)
+
+	var s Store
+	if err := s.Open(t.TempDir() + "/test.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var q Quota
+	if err := q.Load(&s); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(1, -100)
+	completed, _ := q.Reserve(msg, ReqTypeTTS)
+	q.Release(completed, true)
+	pending, _ := q.Reserve(msg, ReqTypeTTS)
+
+	// After a restart the usage is loaded, and the request which was pending can still be refunded.
+	var restarted Quota
+	if err := restarted.Load(&s); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.usage[1]) != 2 || len(restarted.usage[-100]) != 2 {
+		t.Fatalf("got usage %+v after restart", restarted.usage)
+	}
+	restored := restarted.Restore(msg, ReqTypeTTS, pending.ID())
+	restarted.Release(restored, false)
+	if _, err := restarted.Reserve(msg, ReqTypeTTS); err != nil {
+		t.Fatalf("request rejected after refund: %v", err)
+	}
+	if _, err := restarted.Reserve(msg, ReqTypeTTS); err == nil {
+		t.Fatal("request accepted over the daily limit")
+	}
+}
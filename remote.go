@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Remote workers run requests on other hosts (for example on GPU servers). They are started with the
+// -worker-connect argument, and connect to the bot's worker server over HTTP. Workers advertise the
+// request types they can run and pull jobs with long polling, then download the input audio of the job
+// separately. While running a job, the worker sends
+// progress updates (and heartbeats if there are no updates), then uploads the output files. If a worker
+// stops sending heartbeats, then its job is requeued for another worker.
+
+const remoteAPIPath = "/worker/"
+const remotePollTimeout = 30 * time.Second
+const remoteHeartbeatInterval = 10 * time.Second
+const remoteJobHeartbeatTimeout = 3 * remoteHeartbeatInterval
+
+// Workers which haven't polled for this long are considered disconnected.
+const remoteWorkerTimeout = remotePollTimeout + time.Minute
+
+// Max. size of the text fields of uploaded results.
+const remoteMaxFieldSize = 1024 * 1024
+
+const remoteWaitingStr = "Waiting for a remote worker"
+
+var errNoRemoteWorker = errors.New("no remote worker is connected which can run the request")
+
+type remotePollReq struct {
+	Name  string   `json:"name"`
+	Types []string `json:"types"`
+}
+
+// Job data sent to the worker. The input audio is not sent with the job, the worker downloads it from the
+// audio endpoint if its size is not 0.
+type remoteJobData struct {
+	ID            uint64          `json:"id"`
+	TaskID        uint64          `json:"task_id"`
+	Type          ReqType         `json:"type"`
+	Prompt        string          `json:"prompt"`
+	Params        json.RawMessage `json:"params"`
+	AudioFilename string          `json:"audio_filename,omitempty"`
+	AudioSize     int64           `json:"audio_size,omitempty"`
+	Timeout       time.Duration   `json:"timeout,omitempty"`
+}
+
+// Progress updates sent by the worker. Heartbeats only tell that the worker is still running the job.
+type remoteProgress struct {
+	Desc      string `json:"desc,omitempty"`
+	Percent   int    `json:"percent"`
+	Heartbeat bool   `json:"heartbeat,omitempty"`
+}
+
+type remoteJobResult struct {
+	res BackendResult
+	err error
+}
+
+type remoteJob struct {
+	id         uint64 // Changes when the job is requeued, so results of the previous worker are ignored.
+	qEntry     *ReqQueueEntry
+	workerName string
+	lastSeenAt time.Time
+	uploading  bool // The worker is uploading the result, it doesn't send heartbeats meanwhile.
+
+	progressChan chan remoteProgress
+	resultChan   chan remoteJobResult
+}
+
+type remoteWorker struct {
+	types      []ReqType
+	lastSeenAt time.Time
+}
+
+type RemoteWorkers struct {
+	mutex   sync.Mutex
+	workers map[string]*remoteWorker
+	pending []*remoteJob
+	running map[uint64]*remoteJob
+	// Closed and replaced when a new job gets pending, to wake up the polling workers.
+	pendingNotify chan struct{}
+	lastJobID     uint64
+}
+
+// Returns true if a connected remote worker can run requests of the given type.
+func (w *RemoteWorkers) CanRun(reqType ReqType) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.canRun(reqType)
+}
+
+// Same as CanRun, but the mutex has to be locked by the caller.
+func (w *RemoteWorkers) canRun(reqType ReqType) bool {
+	for _, worker := range w.workers {
+		if time.Since(worker.lastSeenAt) < remoteWorkerTimeout && slices.Contains(worker.types, reqType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *RemoteWorkers) addPending(job *remoteJob) {
+	w.lastJobID++
+	job.id = w.lastJobID
+	job.workerName = ""
+	w.pending = append(w.pending, job)
+	close(w.pendingNotify)
+	w.pendingNotify = make(chan struct{})
+}
+
+func (w *RemoteWorkers) remove(job *remoteJob) {
+	w.pending = slices.DeleteFunc(w.pending, func(j *remoteJob) bool { return j == job })
+	delete(w.running, job.id)
+}
+
+// Runs the request on a remote worker. Waits until a capable worker takes the job, and requeues it if
+// the worker disconnects while running it. Returns errNoRemoteWorker if no capable worker is left to take
+// the job.
+func (w *RemoteWorkers) Run(ctx context.Context, qEntry *ReqQueueEntry) (BackendResult, error) {
+	job := &remoteJob{
+		qEntry:       qEntry,
+		progressChan: make(chan remoteProgress, 1),
+		resultChan:   make(chan remoteJobResult, 1),
+	}
+	w.mutex.Lock()
+	w.addPending(job)
+	w.mutex.Unlock()
+
+	defer func() {
+		w.mutex.Lock()
+		w.remove(job)
+		w.mutex.Unlock()
+		qEntry.cancelProcessUpdate()
+	}()
+
+	qEntry.sendProcessUpdate(ctx, remoteWaitingStr, -1)
+
+	ticker := time.NewTicker(remoteHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return BackendResult{}, ctx.Err()
+		case p := <-job.progressChan:
+			qEntry.sendProcessUpdate(ctx, p.Desc, p.Percent)
+		case r := <-job.resultChan:
+			return r.res, r.err
+		case <-ticker.C:
+			w.mutex.Lock()
+			if job.workerName != "" && !job.uploading && time.Since(job.lastSeenAt) > remoteJobHeartbeatTimeout {
+				fmt.Println("  remote worker", job.workerName, "disconnected, requeueing job")
+				delete(w.running, job.id)
+				qEntry.sendProcessUpdate(ctx, "Remote worker "+job.workerName+" disconnected, waiting for another worker", -1)
+				w.addPending(job)
+			}
+			// Nobody would take the job if the remaining workers have disconnected too.
+			if job.workerName == "" && !w.canRun(qEntry.Req.Type) {
+				w.mutex.Unlock()
+				return BackendResult{}, errNoRemoteWorker
+			}
+			w.mutex.Unlock()
+		}
+	}
+}
+
+func (w *RemoteWorkers) checkAuth(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+getParams().WorkerToken)) == 1
+}
+
+// Returns the running job with the ID in the request's job query param, or nil if the job has been
+// canceled or requeued.
+func (w *RemoteWorkers) getRunningJob(r *http.Request) *remoteJob {
+	jobID, err := strconv.ParseUint(r.URL.Query().Get("job"), 10, 64)
+	if err != nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	job := w.running[jobID]
+	if job != nil {
+		job.lastSeenAt = time.Now()
+		if worker := w.workers[job.workerName]; worker != nil {
+			worker.lastSeenAt = time.Now()
+		}
+	}
+	return job
+}
+
+// Takes the first pending job which the worker can run.
+func (w *RemoteWorkers) takeJob(name string, types []ReqType) *remoteJob {
+	for i, job := range w.pending {
+		if !slices.Contains(types, job.qEntry.Req.Type) {
+			continue
+		}
+		w.pending = slices.Delete(w.pending, i, i+1)
+		job.workerName = name
+		job.lastSeenAt = time.Now()
+		w.running[job.id] = job
+		return job
+	}
+	return nil
+}
+
+func (w *RemoteWorkers) handlePoll(rw http.ResponseWriter, r *http.Request) {
+	var pollReq remotePollReq
+	if err := json.NewDecoder(r.Body).Decode(&pollReq); err != nil || pollReq.Name == "" {
+		http.Error(rw, "invalid poll request", http.StatusBadRequest)
+		return
+	}
+	var types []ReqType
+	for _, name := range pollReq.Types {
+		// Workers may know request types which the bot doesn't have.
+		if reqType, err := ReqTypeFromName(name); err == nil {
+			types = append(types, reqType)
+		}
+	}
+
+	timeout := time.NewTimer(remotePollTimeout)
+	defer timeout.Stop()
+	for {
+		w.mutex.Lock()
+		worker := w.workers[pollReq.Name]
+		if worker == nil {
+			fmt.Println("remote worker", pollReq.Name, "connected from", r.RemoteAddr, "with types", pollReq.Types)
+			worker = &remoteWorker{}
+			w.workers[pollReq.Name] = worker
+		}
+		worker.types = types
+		worker.lastSeenAt = time.Now()
+
+		job := w.takeJob(pollReq.Name, types)
+		notify := w.pendingNotify
+		w.mutex.Unlock()
+
+		if job != nil {
+			w.sendJob(rw, job)
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-timeout.C:
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (w *RemoteWorkers) sendJob(rw http.ResponseWriter, job *remoteJob) {
+	qEntry := job.qEntry
+	// The job may be requeued by Run meanwhile, which changes its ID and worker name.
+	w.mutex.Lock()
+	jobID, workerName := job.id, job.workerName
+	w.mutex.Unlock()
+	fmt.Println("  sending job", jobID, "of task", qEntry.TaskID, "to remote worker", workerName)
+
+	paramsData, err := json.Marshal(qEntry.Req.Params)
+	if err != nil {
+		job.resultChan <- remoteJobResult{err: fmt.Errorf("can't encode request params: %w", err)}
+		http.Error(rw, "can't encode request params", http.StatusInternalServerError)
+		return
+	}
+	data := remoteJobData{
+		ID:            jobID,
+		TaskID:        qEntry.TaskID,
+		Type:          qEntry.Req.Type,
+		Prompt:        qEntry.Req.Prompt,
+		Params:        paramsData,
+		AudioFilename: qEntry.AudioData.filename,
+		AudioSize:     qEntry.AudioData.size(),
+		Timeout:       reqQueue.getProcessTimeout(qEntry.Req),
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(data); err != nil {
+		// The worker won't send heartbeats, so the job gets requeued.
+		fmt.Println("  can't send job to remote worker:", err)
+	}
+}
+
+// Streams the input audio of the job to the worker.
+func (w *RemoteWorkers) handleAudio(rw http.ResponseWriter, r *http.Request) {
+	job := w.getRunningJob(r)
+	if job == nil {
+		http.Error(rw, "job not found", http.StatusGone)
+		return
+	}
+	f, err := job.qEntry.AudioData.open()
+	if err != nil {
+		http.Error(rw, "can't read audio data", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(rw, f); err != nil {
+		fmt.Println("  can't send audio to remote worker:", err)
+	}
+}
+
+func (w *RemoteWorkers) handleProgress(rw http.ResponseWriter, r *http.Request) {
+	job := w.getRunningJob(r)
+	if job == nil {
+		http.Error(rw, "job not found", http.StatusGone)
+		return
+	}
+	var p remoteProgress
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(rw, "invalid progress", http.StatusBadRequest)
+		return
+	}
+	if p.Heartbeat {
+		return
+	}
+	// Only the last update matters if the previous one hasn't been sent yet.
+	for {
+		select {
+		case job.progressChan <- p:
+			return
+		default:
+			select {
+			case <-job.progressChan:
+			default:
+			}
+		}
+	}
+}
+
+func (w *RemoteWorkers) setUploading(job *remoteJob, uploading bool) {
+	w.mutex.Lock()
+	job.uploading = uploading
+	job.lastSeenAt = time.Now()
+	w.mutex.Unlock()
+}
+
+func (w *RemoteWorkers) handleResult(rw http.ResponseWriter, r *http.Request) {
+	job := w.getRunningJob(r)
+	if job == nil {
+		http.Error(rw, "job not found", http.StatusGone)
+		return
+	}
+	w.setUploading(job, true)
+	defer w.setUploading(job, false)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(rw, "invalid result", http.StatusBadRequest)
+		return
+	}
+
+	// Output files are written to the work dir instead of keeping them in memory.
+	var result remoteJobResult
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeFiles()
+			http.Error(rw, "invalid result", http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "error", "text":
+			d, err := io.ReadAll(io.LimitReader(part, remoteMaxFieldSize))
+			if err != nil {
+				closeFiles()
+				http.Error(rw, "can't read result", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "error" {
+				result.err = errors.New(string(d))
+			} else {
+				result.res.Text = string(d)
+			}
+		case "voice", "audio":
+			f, err := w.writeResultFile(job, part, len(files))
+			if err != nil {
+				closeFiles()
+				fmt.Println("  can't write result file of job", job.id, ":", err)
+				http.Error(rw, "can't read result file", http.StatusBadRequest)
+				return
+			}
+			files = append(files, f)
+			if part.FormName() == "voice" {
+				result.res.Voice = f
+			} else {
+				result.res.Audio = append(result.res.Audio, UploadFileData{r: f, filename: part.FileName()})
+			}
+		}
+		part.Close()
+	}
+
+	w.mutex.Lock()
+	// The job may have been requeued or canceled while the result was uploaded.
+	if w.running[job.id] != job {
+		w.mutex.Unlock()
+		closeFiles()
+		http.Error(rw, "job not found", http.StatusGone)
+		return
+	}
+	delete(w.running, job.id)
+	jobID, workerName := job.id, job.workerName
+	w.mutex.Unlock()
+
+	fmt.Println("  got result of job", jobID, "from remote worker", workerName)
+	job.resultChan <- result
+}
+
+// Writes an uploaded result file to the work dir of the job, and returns it opened for reading. The file
+// is removed when the work dir of the request is removed.
+func (w *RemoteWorkers) writeResultFile(job *remoteJob, r io.Reader, index int) (*os.File, error) {
+	w.mutex.Lock()
+	filePath := path.Join(job.qEntry.WorkDir, fmt.Sprint("remote-", job.id, "-", index))
+	w.mutex.Unlock()
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (w *RemoteWorkers) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !w.checkAuth(r) {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, remoteAPIPath) {
+	case "poll":
+		w.handlePoll(rw, r)
+	case "audio":
+		w.handleAudio(rw, r)
+	case "progress":
+		w.handleProgress(rw, r)
+	case "result":
+		w.handleResult(rw, r)
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+// Starts the worker server which remote workers connect to.
+// Starts the worker server. Returns an error if it can't listen on the given address.
+func (w *RemoteWorkers) Start(ctx context.Context, addr string) error {
+	w.workers = make(map[string]*remoteWorker)
+	w.running = make(map[uint64]*remoteJob)
+	w.pendingNotify = make(chan struct{})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("can't start worker server: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(remoteAPIPath, w)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		fmt.Println("worker server listening on", addr)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Println("worker server error:", err)
+		}
+	}()
+	return nil
+}
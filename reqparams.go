@@ -2,45 +2,283 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/shlex"
 )
 
+// ReqParamDef declares a param of a request type. Parsing, validation, ReqParams.String() and the help
+// are all based on these declarations.
+type ReqParamDef struct {
+	Name    string   // The param is given as -name.
+	Aliases []string // Short forms, for example m for -m.
+	Arg     string   // Name of the value shown in the help, not used for bool params.
+	Desc    string
+
+	Value   any   // Pointer to the field: *string, *int, *float64, *bool or *time.Duration.
+	Set     *bool // Optional, set to true if the param has been given.
+	Default any   // Optional default value, it has the same type as the field.
+
+	Min  float64 // Limits of numeric params (durations are in seconds), used if they are not equal.
+	Max  float64
+	Enum []string // Allowed values of string params.
+
+	// Label of the value in ReqParams.String(). Params without a label are not shown.
+	Label string
+	Unit  string // Shown after the value in ReqParams.String().
+	Unset string // Shown in ReqParams.String() instead of an empty value.
+}
+
+func (d *ReqParamDef) isBool() bool {
+	_, ok := d.Value.(*bool)
+	return ok
+}
+
+func (d *ReqParamDef) hasLimits() bool {
+	return d.Min != d.Max
+}
+
+func (d *ReqParamDef) matches(attr string) bool {
+	if attr == d.Name {
+		return true
+	}
+	for _, a := range d.Aliases {
+		if attr == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *ReqParamDef) argName() string {
+	if d.Arg == "" {
+		return "v"
+	}
+	return d.Arg
+}
+
+// Returns the allowed range of the param, for example "between 0 and 1".
+func (d *ReqParamDef) limitsString() string {
+	min := strconv.FormatFloat(d.Min, 'f', -1, 64) + d.Unit
+	max := strconv.FormatFloat(d.Max, 'f', -1, 64) + d.Unit
+	if math.IsInf(d.Max, 1) {
+		return "at least " + min
+	}
+	if math.IsInf(d.Min, -1) {
+		return "at most " + max
+	}
+	return "between " + min + " and " + max
+}
+
+func (d *ReqParamDef) checkLimits(v float64) error {
+	if d.hasLimits() && (v < d.Min || v > d.Max) {
+		return fmt.Errorf("%s should be %s", d.Name, d.limitsString())
+	}
+	return nil
+}
+
+// Parses and validates the given value and stores it in the field of the param.
+func (d *ReqParamDef) parse(s string) error {
+	switch v := d.Value.(type) {
+	case *string:
+		if len(d.Enum) > 0 {
+			found := false
+			for _, e := range d.Enum {
+				if strings.EqualFold(s, e) {
+					s = e
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s should be one of: %s", d.Name, strings.Join(d.Enum, ", "))
+			}
+		}
+		*v = s
+	case *int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s value", d.Name)
+		}
+		if err := d.checkLimits(float64(i)); err != nil {
+			return err
+		}
+		*v = i
+	case *float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s value", d.Name)
+		}
+		if err := d.checkLimits(f); err != nil {
+			return err
+		}
+		*v = f
+	case *time.Duration:
+		t, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s value", d.Name)
+		}
+		if err := d.checkLimits(t.Seconds()); err != nil {
+			return err
+		}
+		*v = t
+	default:
+		return fmt.Errorf("invalid %s param type", d.Name)
+	}
+	return nil
+}
+
+func (d *ReqParamDef) setDefault() {
+	if d.Default == nil {
+		return
+	}
+	switch v := d.Value.(type) {
+	case *string:
+		*v = d.Default.(string)
+	case *int:
+		*v = d.Default.(int)
+	case *float64:
+		*v = d.Default.(float64)
+	case *bool:
+		*v = d.Default.(bool)
+	case *time.Duration:
+		*v = d.Default.(time.Duration)
+	}
+}
+
+func (d *ReqParamDef) valueString() string {
+	switch v := d.Value.(type) {
+	case *string:
+		return *v
+	case *float64:
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	case *int:
+		return fmt.Sprint(*v)
+	case *time.Duration:
+		return v.String()
+	}
+	return ""
+}
+
+// Returns the usage of the param, for example "-m [model]".
+func (d *ReqParamDef) usage() string {
+	name := d.Name
+	if len(d.Aliases) > 0 {
+		name = d.Aliases[0]
+	}
+	if d.isBool() {
+		return "-" + name
+	}
+	return "-" + name + " [" + d.argName() + "]"
+}
+
+// Returns the detailed help of the param.
+func (d *ReqParamDef) help() string {
+	names := "-" + d.Name
+	for _, a := range d.Aliases {
+		names += ", -" + a
+	}
+	s := names
+	if !d.isBool() {
+		s += " [" + d.argName() + "]"
+	}
+	s += " - " + d.Desc
+
+	var details []string
+	if len(d.Enum) > 0 {
+		details = append(details, "one of: "+strings.Join(d.Enum, ", "))
+	}
+	if d.hasLimits() {
+		details = append(details, d.limitsString())
+	}
+	if d.Default != nil && !d.isBool() {
+		if v := fmt.Sprint(d.Default); v != "" {
+			details = append(details, "default: "+v+d.Unit)
+		}
+	}
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+	return s
+}
+
+// Params which can be used with all request types.
+type ReqParamsCommon struct {
+	Timeout time.Duration
+	UseLast bool
+	Profile string
+}
+
+func (r ReqParamsCommon) Common() ReqParamsCommon {
+	return r
+}
+
+func (r *ReqParamsCommon) commonParamDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "timeout", Arg: "duration", Desc: "processing timeout for admins, for example 30m", Value: &r.Timeout,
+			Min: 1, Max: math.Inf(1), Unit: "s"},
+		{Name: "last", Desc: "use the last audio file of this chat as input", Value: &r.UseLast},
+		{Name: "profile", Arg: "name", Desc: "use the given profile of the command", Value: &r.Profile},
+	}
+}
+
 type ReqParamsTTS struct {
+	ReqParamsCommon
+
 	Model string
+	Voice string
 }
 
-func (r ReqParamsTTS) String() string {
-	return "🗣️ " + r.Model
+func (r *ReqParamsTTS) paramDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "model", Aliases: []string{"m"}, Arg: "model", Desc: "text to speech model, not used with the speech API", Value: &r.Model,
+			Default: getParams().TTSDefaultModel, Label: "🗣️ "},
+		{Name: "voice", Arg: "voice", Desc: "voice, only used with the speech API", Value: &r.Voice, Label: "🎙️ "},
+	}
 }
 
+func (r *ReqParamsTTS) String() string { return reqParamsString(r) }
+
 type ReqParamsSTT struct {
+	ReqParamsCommon
+
 	Language string
 }
 
-func (r ReqParamsSTT) String() string {
-	lang := r.Language
-	if lang == "" {
-		lang = "Autodetect"
+func (r *ReqParamsSTT) paramDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "lang", Arg: "language", Desc: "language of the speech, autodetected if not given", Value: &r.Language,
+			Label: "🏳️‍🌈 ", Unset: "Autodetect"},
 	}
-	return "🏳️‍🌈 " + lang
 }
 
+func (r *ReqParamsSTT) String() string { return reqParamsString(r) }
+
 type ReqParamsMDX struct {
+	ReqParamsCommon
+
 	FullOutput bool
 }
 
-func (r ReqParamsMDX) String() string {
-	if r.FullOutput {
-		return "👑 Full output"
+func (r *ReqParamsMDX) paramDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "full", Aliases: []string{"f"}, Desc: "full output including instrument and bassline tracks",
+			Value: &r.FullOutput, Label: "👑 Full output"},
 	}
-	return ""
 }
 
+func (r *ReqParamsMDX) String() string { return reqParamsString(r) }
+
+var rvcMethods = []string{"harvest", "pm", "crepe", "rmvpe"}
+
 type ReqParamsRVC struct {
+	ReqParamsCommon
+
 	Model           string
 	Pitch           int
 	PitchSet        bool
@@ -53,24 +291,30 @@ type ReqParamsRVC struct {
 	RMSMixRateSet   bool
 }
 
-func (r ReqParamsRVC) String() string {
-	args := []string{"🤡 " + r.Model + " 🎹 Method: " + r.Method}
-	if r.PitchSet {
-		args = append(args, "Pitch: "+fmt.Sprint(r.Pitch))
-	}
-	if r.FilterRadiusSet {
-		args = append(args, "Filter radius: "+fmt.Sprint(r.FilterRadius))
+func (r *ReqParamsRVC) paramDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "model", Aliases: []string{"m"}, Arg: "model", Desc: "rvc model, it can also be given after the params",
+			Value: &r.Model, Label: "🤡 "},
+		{Name: "method", Arg: "method", Desc: "pitch extraction method", Value: &r.Method, Default: "harvest",
+			Enum: rvcMethods, Label: "🎹 Method: "},
+		{Name: "pitch", Aliases: []string{"p"}, Arg: "pitch", Desc: "pitch shift in semitones", Value: &r.Pitch,
+			Set: &r.PitchSet, Min: -24, Max: 24, Label: "Pitch: "},
+		{Name: "filter-radius", Desc: "median filter radius for the pitch results", Value: &r.FilterRadius,
+			Set: &r.FilterRadiusSet, Default: 3, Min: 0, Max: 7, Label: "Filter radius: "},
+		{Name: "index-rate", Desc: "how much the model index affects the result", Value: &r.IndexRate,
+			Set: &r.IndexRateSet, Min: 0, Max: 1, Label: "Index rate: "},
+		{Name: "rms-mix-rate", Desc: "how much the volume envelope of the input is kept", Value: &r.RMSMixRate,
+			Set: &r.RMSMixRateSet, Min: 0, Max: 1, Label: "RMS mix rate: "},
 	}
-	if r.IndexRateSet {
-		args = append(args, "Index rate: "+fmt.Sprint(r.IndexRate))
-	}
-	if r.RMSMixRateSet {
-		args = append(args, "RMS mix rate: "+fmt.Sprint(r.RMSMixRate))
-	}
-	return strings.Join(args, " ")
 }
 
+func (r *ReqParamsRVC) String() string { return reqParamsString(r) }
+
+var rvcTrainMethods = []string{"harvest", "pm", "dio", "crepe", "mangio-crepe", "rmvpe"}
+
 type ReqParamsRVCTrain struct {
+	ReqParamsCommon
+
 	Model     string
 	Method    string
 	BatchSize int
@@ -78,68 +322,136 @@ type ReqParamsRVCTrain struct {
 	Delete    bool
 }
 
-func (r ReqParamsRVCTrain) String() string {
-	return "🤡 " + r.Model + " 🎹 Method: " + r.Method + " Batch size: " + fmt.Sprint(r.BatchSize) +
-		" Epochs: " + fmt.Sprint(r.Epochs)
+func (r *ReqParamsRVCTrain) paramDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "model", Aliases: []string{"m"}, Arg: "model", Desc: "name of the rvc model to train, it can also be given after the params",
+			Value: &r.Model, Label: "🤡 "},
+		{Name: "method", Arg: "method", Desc: "pitch extraction method", Value: &r.Method, Default: "harvest",
+			Enum: rvcTrainMethods, Label: "🎹 Method: "},
+		{Name: "batch-size", Desc: "training batch size", Value: &r.BatchSize, Default: getParams().RVCTrainDefaultBatchSize,
+			Min: 1, Max: 64, Label: "Batch size: "},
+		{Name: "epochs", Desc: "number of training epochs", Value: &r.Epochs, Default: getParams().RVCTrainDefaultEpochs,
+			Min: 1, Max: 10000, Label: "Epochs: "},
+		{Name: "delete", Desc: "delete the model instead of training", Value: &r.Delete},
+	}
 }
 
+func (r *ReqParamsRVCTrain) String() string { return reqParamsString(r) }
+
 type ReqParamsMusicgen struct {
+	ReqParamsCommon
+
 	LengthSec    int
 	LengthSecSet bool
 }
 
-func (r ReqParamsMusicgen) String() string {
-	if r.LengthSecSet {
-		return "🎹 Length: " + fmt.Sprint(r.LengthSec) + "s"
+func (r *ReqParamsMusicgen) paramDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "length", Aliases: []string{"l"}, Arg: "sec", Desc: "length of the generated music in seconds",
+			Value: &r.LengthSec, Set: &r.LengthSecSet, Min: 1, Max: 120, Label: "🎹 Length: ", Unit: "s"},
 	}
-	return ""
 }
 
+func (r *ReqParamsMusicgen) String() string { return reqParamsString(r) }
+
 type ReqParamsAudiogen struct {
+	ReqParamsCommon
+
 	LengthSec    int
 	LengthSecSet bool
 }
 
-func (r ReqParamsAudiogen) String() string {
-	if r.LengthSecSet {
-		return "🎹 Length: " + fmt.Sprint(r.LengthSec) + "s"
+func (r *ReqParamsAudiogen) paramDefs() []ReqParamDef {
+	return []ReqParamDef{
+		{Name: "length", Aliases: []string{"l"}, Arg: "sec", Desc: "length of the generated audio in seconds",
+			Value: &r.LengthSec, Set: &r.LengthSecSet, Min: 1, Max: 120, Label: "🎹 Length: ", Unit: "s"},
 	}
-	return ""
 }
 
+func (r *ReqParamsAudiogen) String() string { return reqParamsString(r) }
+
 type ReqParams interface {
 	String() string
+	Common() ReqParamsCommon
+
+	// Returns the declarations of the params of the request type. The values of the declarations
+	// point to the fields of the receiver.
+	paramDefs() []ReqParamDef
+	commonParamDefs() []ReqParamDef
 }
 
-// Returns -1 as firstCmdCharAt if no params have been found in the given string.
-func ReqParamsParse(ctx context.Context, s string, reqParams ReqParams) (prompt string, err error) {
-	lexer := shlex.NewLexer(strings.NewReader(s))
+// Sets the default values of the given request params.
+func ReqParamsSetDefaults(r ReqParams) {
+	for _, d := range append(r.paramDefs(), r.commonParamDefs()...) {
+		d.setDefault()
+	}
+}
 
-	var reqParamsTTS *ReqParamsTTS
-	var reqParamsSTT *ReqParamsSTT
-	var reqParamsMDX *ReqParamsMDX
-	var reqParamsRVC *ReqParamsRVC
-	var reqParamsRVCTrain *ReqParamsRVCTrain
-	var reqParamsMusicgen *ReqParamsMusicgen
-	var reqParamsAudiogen *ReqParamsAudiogen
-	switch v := reqParams.(type) {
-	case *ReqParamsTTS:
-		reqParamsTTS = v
-	case *ReqParamsSTT:
-		reqParamsSTT = v
-	case *ReqParamsMDX:
-		reqParamsMDX = v
-	case *ReqParamsRVC:
-		reqParamsRVC = v
-	case *ReqParamsRVCTrain:
-		reqParamsRVCTrain = v
-	case *ReqParamsMusicgen:
-		reqParamsMusicgen = v
-	case *ReqParamsAudiogen:
-		reqParamsAudiogen = v
-	default:
-		return "", fmt.Errorf("invalid reqParams type")
+func reqParamsString(r ReqParams) string {
+	var sa []string
+	for _, d := range r.paramDefs() {
+		if d.Label == "" || (d.Set != nil && !*d.Set) {
+			continue
+		}
+		if v, ok := d.Value.(*bool); ok {
+			if *v {
+				sa = append(sa, d.Label)
+			}
+			continue
+		}
+		v := d.valueString()
+		if v == "" {
+			if d.Unset == "" {
+				continue
+			}
+			v = d.Unset
+		}
+		sa = append(sa, d.Label+v+d.Unit)
+	}
+	return strings.Join(sa, " ")
+}
+
+// Returns the short usage of the params of the request type, for example "(-m [model]) (-f)".
+func ReqParamsUsage(r ReqParams) string {
+	var sa []string
+	for _, d := range r.paramDefs() {
+		sa = append(sa, "("+d.usage()+")")
+	}
+	return strings.Join(sa, " ")
+}
+
+// Returns the detailed help of the params of the request type, one param per line.
+func ReqParamsHelp(r ReqParams) string {
+	var sa []string
+	for _, d := range r.paramDefs() {
+		sa = append(sa, d.help())
 	}
+	return strings.Join(sa, "\n")
+}
+
+// Returns the detailed help of the params which can be used with all request types.
+func ReqParamsCommonHelp(r ReqParams) string {
+	var sa []string
+	for _, d := range r.commonParamDefs() {
+		sa = append(sa, d.help())
+	}
+	return strings.Join(sa, "\n")
+}
+
+// Decodes JSON encoded request params of the given request type.
+func ReqParamsUnmarshal(reqType ReqType, d []byte) (ReqParams, error) {
+	r := getBackend(reqType).NewParams()
+	if err := json.Unmarshal(d, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Parses the params in the given string into reqParams, which should be a pointer returned by
+// Backend.NewParams. Returns the rest of the string after the params as the prompt.
+func ReqParamsParse(ctx context.Context, s string, reqParams ReqParams) (prompt string, err error) {
+	lexer := shlex.NewLexer(strings.NewReader(s))
+	defs := append(reqParams.paramDefs(), reqParams.commonParamDefs()...)
 
 	for {
 		token, lexErr := lexer.Next()
@@ -159,167 +471,30 @@ func ReqParamsParse(ctx context.Context, s string, reqParams ReqParams) (prompt
 		}
 
 		attr := strings.ToLower(token[1:])
-		validAttr := false
-
-		switch attr {
-		case "model", "m":
-			if reqParamsTTS == nil && reqParamsRVC == nil && reqParamsRVCTrain == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			if reqParamsTTS != nil {
-				reqParamsTTS.Model = val
-			} else if reqParamsRVC != nil {
-				reqParamsRVC.Model = val
-			} else if reqParamsRVCTrain != nil {
-				reqParamsRVCTrain.Model = val
-			}
-			fmt.Println("model:", val)
-			validAttr = true
-		case "lang":
-			if reqParamsSTT == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			reqParamsSTT.Language = val
-			validAttr = true
-		case "full", "f":
-			if reqParamsMDX == nil {
-				break
-			}
-			reqParamsMDX.FullOutput = true
-			validAttr = true
-		case "pitch", "p":
-			if reqParamsRVC == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			reqParamsRVC.Pitch, err = strconv.Atoi(val)
-			if err != nil {
-				return "", fmt.Errorf("invalid pitch value")
-			}
-			reqParamsRVC.PitchSet = true
-			validAttr = true
-		case "method":
-			if reqParamsRVC == nil && reqParamsRVCTrain == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			if reqParamsRVC != nil {
-				reqParamsRVC.Method = val
-			} else if reqParamsRVCTrain != nil {
-				reqParamsRVCTrain.Method = val
-			}
-			validAttr = true
-		case "filter-radius":
-			if reqParamsRVC == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			reqParamsRVC.FilterRadius, err = strconv.Atoi(val)
-			if err != nil {
-				return "", fmt.Errorf("invalid filter radius value")
-			}
-			reqParamsRVC.FilterRadiusSet = true
-			validAttr = true
-		case "index-rate":
-			if reqParamsRVC == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			reqParamsRVC.IndexRate, err = strconv.ParseFloat(val, 32)
-			if err != nil {
-				return "", fmt.Errorf("invalid index rate value")
-			}
-			reqParamsRVC.IndexRateSet = true
-			validAttr = true
-		case "rms-mix-rate":
-			if reqParamsRVC == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			reqParamsRVC.RMSMixRate, err = strconv.ParseFloat(val, 32)
-			if err != nil {
-				return "", fmt.Errorf("invalid rms mix rate value")
-			}
-			reqParamsRVC.RMSMixRateSet = true
-			validAttr = true
-		case "length", "l":
-			if reqParamsMusicgen == nil && reqParamsAudiogen == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			if reqParamsMusicgen != nil {
-				reqParamsMusicgen.LengthSec, err = strconv.Atoi(val)
-				reqParamsMusicgen.LengthSecSet = true
-			} else if reqParamsAudiogen != nil {
-				reqParamsAudiogen.LengthSec, err = strconv.Atoi(val)
-				reqParamsAudiogen.LengthSecSet = true
-			}
-			if err != nil {
-				return "", fmt.Errorf("invalid length value")
-			}
-			validAttr = true
-		case "batch-size":
-			if reqParamsRVCTrain == nil {
-				break
-			}
-			val, lexErr := lexer.Next()
-			if lexErr != nil {
-				return "", fmt.Errorf(attr + " is missing value")
-			}
-			reqParamsRVCTrain.BatchSize, err = strconv.Atoi(val)
-			if err != nil {
-				return "", fmt.Errorf("invalid batch size value")
-			}
-			validAttr = true
-		case "epochs":
-			if reqParamsRVCTrain == nil {
+		var def *ReqParamDef
+		for i := range defs {
+			if defs[i].matches(attr) {
+				def = &defs[i]
 				break
 			}
+		}
+		if def == nil {
+			return "", fmt.Errorf("unknown param " + token)
+		}
+
+		if v, ok := def.Value.(*bool); ok {
+			*v = true
+		} else {
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
 				return "", fmt.Errorf(attr + " is missing value")
 			}
-			reqParamsRVCTrain.Epochs, err = strconv.Atoi(val)
-			if err != nil {
-				return "", fmt.Errorf("invalid epochs value")
-			}
-			validAttr = true
-		case "delete":
-			if reqParamsRVCTrain == nil {
-				break
+			if err := def.parse(val); err != nil {
+				return "", err
 			}
-			reqParamsRVCTrain.Delete = true
-			validAttr = true
 		}
-
-		if !validAttr {
-			return "", fmt.Errorf("unknown param " + token)
+		if def.Set != nil {
+			*def.Set = true
 		}
 	}
 
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReqParamsParse(t *testing.T) {
+	tests := []struct {
+		s          string
+		params     ReqParams // Empty params to parse into.
+		want       ReqParams
+		wantPrompt string
+		wantErr    string
+	}{
+		{s: "", params: &ReqParamsRVC{}, want: &ReqParamsRVC{}},
+		{s: "-m voice -p 12 hello there", params: &ReqParamsRVC{},
+			want: &ReqParamsRVC{Model: "voice", Pitch: 12, PitchSet: true}, wantPrompt: "hello there"},
+		{s: "-model voice -P -3", params: &ReqParamsRVC{},
+			want: &ReqParamsRVC{Model: "voice", Pitch: -3, PitchSet: true}},
+		{s: `-m "my voice" 'quoted prompt'`, params: &ReqParamsRVC{},
+			want: &ReqParamsRVC{Model: "my voice"}, wantPrompt: "quoted prompt"},
+		{s: "prompt -p 1", params: &ReqParamsRVC{}, want: &ReqParamsRVC{}, wantPrompt: "prompt -p 1"},
+		{s: "-method CREPE -index-rate 0.5 -rms-mix-rate 1 -filter-radius 0", params: &ReqParamsRVC{},
+			want: &ReqParamsRVC{Method: "crepe", IndexRate: 0.5, IndexRateSet: true, RMSMixRate: 1, RMSMixRateSet: true,
+				FilterRadiusSet: true}},
+		{s: "-full", params: &ReqParamsMDX{}, want: &ReqParamsMDX{FullOutput: true}},
+		{s: "-f -last -profile fast", params: &ReqParamsMDX{},
+			want: &ReqParamsMDX{ReqParamsCommon: ReqParamsCommon{UseLast: true, Profile: "fast"}, FullOutput: true}},
+		{s: "-timeout 30m -l 120 jazz", params: &ReqParamsMusicgen{},
+			want:       &ReqParamsMusicgen{ReqParamsCommon: ReqParamsCommon{Timeout: 30 * time.Minute}, LengthSec: 120, LengthSecSet: true},
+			wantPrompt: "jazz"},
+
+		{s: "-method foo", params: &ReqParamsRVC{}, wantErr: "method should be one of: harvest, pm, crepe, rmvpe"},
+		{s: "-p 25", params: &ReqParamsRVC{}, wantErr: "pitch should be between -24 and 24"},
+		{s: "-p -25", params: &ReqParamsRVC{}, wantErr: "pitch should be between -24 and 24"},
+		{s: "-p 1.5", params: &ReqParamsRVC{}, wantErr: "invalid pitch value"},
+		{s: "-index-rate 1.01", params: &ReqParamsRVC{}, wantErr: "index-rate should be between 0 and 1"},
+		{s: "-index-rate x", params: &ReqParamsRVC{}, wantErr: "invalid index-rate value"},
+		{s: "-l 0", params: &ReqParamsMusicgen{}, wantErr: "length should be between 1s and 120s"},
+		{s: "-timeout 500ms", params: &ReqParamsMusicgen{}, wantErr: "timeout should be at least 1s"},
+		{s: "-timeout 30", params: &ReqParamsMusicgen{}, wantErr: "invalid timeout value"},
+		{s: "-m", params: &ReqParamsRVC{}, wantErr: "m is missing value"},
+		{s: "-x 1", params: &ReqParamsRVC{}, wantErr: "unknown param -x"},
+		{s: "-m voice -full", params: &ReqParamsRVC{}, wantErr: "unknown param -full"},
+	}
+	for _, tt := range tests {
+		prompt, err := ReqParamsParse(context.Background(), tt.s, tt.params)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%q: got error %v, want %q", tt.s, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(tt.params, tt.want) {
+			t.Errorf("%q: got params %+v, want %+v", tt.s, tt.params, tt.want)
+		}
+		if prompt != tt.wantPrompt {
+			t.Errorf("%q: got prompt %q, want %q", tt.s, prompt, tt.wantPrompt)
+		}
+	}
+}
+
+func TestReqParamsDefaults(t *testing.T) {
+	var r ReqParamsRVC
+	ReqParamsSetDefaults(&r)
+	if _, err := ReqParamsParse(context.Background(), "-p 2", &r); err != nil {
+		t.Fatal(err)
+	}
+	want := ReqParamsRVC{Method: "harvest", FilterRadius: 3, Pitch: 2, PitchSet: true}
+	if r != want {
+		t.Fatalf("got %+v, want %+v", r, want)
+	}
+	// Params which were not given are not shown, even if they have a default value.
+	if s := r.String(); s != "🎹 Method: harvest Pitch: 2" {
+		t.Fatalf("got string %q", s)
+	}
+}
+
+func TestReqParamsHelp(t *testing.T) {
+	if s := ReqParamsUsage(&ReqParamsRVC{}); s !=
+		"(-m [model]) (-method [method]) (-p [pitch]) (-filter-radius [v]) (-index-rate [v]) (-rms-mix-rate [v])" {
+		t.Errorf("got usage %q", s)
+	}
+
+	want := strings.Join([]string{
+		"-model, -m [model] - rvc model, it can also be given after the params",
+		"-method [method] - pitch extraction method (one of: harvest, pm, crepe, rmvpe, default: harvest)",
+		"-pitch, -p [pitch] - pitch shift in semitones (between -24 and 24)",
+		"-filter-radius [v] - median filter radius for the pitch results (between 0 and 7, default: 3)",
+		"-index-rate [v] - how much the model index affects the result (between 0 and 1)",
+		"-rms-mix-rate [v] - how much the volume envelope of the input is kept (between 0 and 1)",
+	}, "\n")
+	if s := ReqParamsHelp(&ReqParamsRVC{}); s != want {
+		t.Errorf("got help:\n%s\nwant:\n%s", s, want)
+	}
+
+	want = "-length, -l [sec] - length of the generated music in seconds (between 1s and 120s)"
+	if s := ReqParamsHelp(&ReqParamsMusicgen{}); s != want {
+		t.Errorf("got help %q, want %q", s, want)
+	}
+
+	want = strings.Join([]string{
+		"-timeout [duration] - processing timeout for admins, for example 30m (at least 1s)",
+		"-last - use the last audio file of this chat as input",
+		"-profile [name] - use the given profile of the command",
+	}, "\n")
+	if s := ReqParamsCommonHelp(&ReqParamsMDX{}); s != want {
+		t.Errorf("got common help:\n%s\nwant:\n%s", s, want)
+	}
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-telegram/bot/models"
@@ -21,13 +21,18 @@ const uploadingStr = "☁ ️ Uploading..."
 const doneStr = "✅ Done"
 const errorStr = "❌ Error"
 const canceledStr = "❌ Canceled"
+const timeoutStr = "❌ Timeout"
+const resumedStr = "🔁 Request resumed after bot restart"
+const interruptedStr = "❌ Request interrupted by bot restart"
 
-const processTimeout = 5 * time.Minute
+const defaultProcessTimeout = 5 * time.Minute
+const audioWaitTimeout = 3 * time.Minute
 const groupChatProgressUpdateInterval = 3 * time.Second
 const privateChatProgressUpdateInterval = 500 * time.Millisecond
 
 type ReqType int
 
+// Request types of the built-in backends, in the order of the backends registry.
 const (
 	ReqTypeTTS ReqType = iota
 	ReqTypeSTT
@@ -39,41 +44,110 @@ const (
 )
 
 type ReqQueueEntry struct {
-	TaskID uint64
-
-	ReplyMessage *models.Message
+	TaskID  uint64
+	StoreID uint64
+	WorkDir string
+	Running bool
+	// Prioritized entries are processed before all other entries in the lane.
+	Prioritized bool
+
+	ReplyMessage *models.Message // Guarded by replyMutex, as replies can be sent asynchronously.
 	Message      *models.Message
 	Req          ReqQueueReq
+	AudioData    AudioFileData
+
+	AddedAt   time.Time
+	StartedAt time.Time
+	Progress  string // The last process update, shown in the queue status.
 
 	LastProcessUpdateAt time.Time
 	ProcessUpdateTimer  *time.Timer
-}
 
-func (e *ReqQueueEntry) checkWaitError(err error) time.Duration {
-	var retryRegex = regexp.MustCompile(`{"retry_after":([0-9]+)}`)
-	match := retryRegex.FindStringSubmatch(err.Error())
-	if len(match) < 2 {
-		return 0
-	}
+	// If set, process updates are passed to this function instead of being sent to Telegram. Used by
+	// remote workers.
+	progressFunc func(processDesc string, percent int)
 
-	retryAfter, err := strconv.Atoi(match[1])
-	if err != nil {
-		return 0
-	}
-	return time.Duration(retryAfter) * time.Second
+	quotaRes *QuotaReservation // Released when the request finishes.
+
+	replyMutex sync.Mutex
+	// The ID of the reply message, it can be read without locking the reply mutex.
+	replyMessageID atomic.Int64
+	// Incremented by each reply which is sent directly, so async replies which became outdated are dropped.
+	replySeq atomic.Uint64
+
+	asyncReplyMutex   sync.Mutex
+	asyncReply        *reqQueueAsyncReply
+	asyncReplySending bool
 }
 
-func (e *ReqQueueEntry) sendReply(ctx context.Context, s string) {
+type reqQueueAsyncReply struct {
+	s   string
+	seq uint64 // The reply seq of the entry when the async reply was added.
+}
+
+// Must be called with the reply mutex locked.
+func (e *ReqQueueEntry) sendReplyLocked(ctx context.Context, s string) {
 	if e.ReplyMessage == nil {
 		e.ReplyMessage = sendReplyToMessage(ctx, e.Message, s)
+		if e.ReplyMessage != nil {
+			e.replyMessageID.Store(int64(e.ReplyMessage.ID))
+		}
 	} else if e.ReplyMessage.Text != s {
 		e.ReplyMessage.Text = s
-		err := editReplyToMessage(ctx, e.ReplyMessage, s)
-		if err != nil {
-			waitNeeded := e.checkWaitError(err)
-			fmt.Println("  waiting", waitNeeded, "...")
-			time.Sleep(waitNeeded)
+		_ = editReplyToMessage(ctx, e.ReplyMessage, s)
+	}
+}
+
+func (e *ReqQueueEntry) sendReply(ctx context.Context, s string) {
+	e.replySeq.Add(1)
+	e.replyMutex.Lock()
+	defer e.replyMutex.Unlock()
+	e.sendReplyLocked(ctx, s)
+}
+
+// Sends the reply in the background, so callers which hold the queue mutex are not blocked by the rate
+// limiting of the Telegram API. If multiple async replies are waiting to be sent, only the last one gets
+// sent, and it's dropped if a reply has been sent directly since it was added.
+func (e *ReqQueueEntry) sendReplyAsync(ctx context.Context, s string) {
+	e.asyncReplyMutex.Lock()
+	defer e.asyncReplyMutex.Unlock()
+
+	e.asyncReply = &reqQueueAsyncReply{s: s, seq: e.replySeq.Load()}
+	if e.asyncReplySending {
+		return
+	}
+	e.asyncReplySending = true
+	go func() {
+		for {
+			e.asyncReplyMutex.Lock()
+			r := e.asyncReply
+			e.asyncReply = nil
+			if r == nil {
+				e.asyncReplySending = false
+				e.asyncReplyMutex.Unlock()
+				return
+			}
+			e.asyncReplyMutex.Unlock()
+
+			e.replyMutex.Lock()
+			if e.replySeq.Load() == r.seq {
+				e.sendReplyLocked(ctx, r.s)
+			}
+			e.replyMutex.Unlock()
 		}
+	}()
+}
+
+// Sets the message the replies are sent to. If newReply is true, then the next reply is sent as a new
+// message instead of editing the current reply.
+func (e *ReqQueueEntry) setReplyTo(msg *models.Message, newReply bool) {
+	e.replySeq.Add(1)
+	e.replyMutex.Lock()
+	defer e.replyMutex.Unlock()
+	e.Message = msg
+	if newReply {
+		e.ReplyMessage = nil
+		e.replyMessageID.Store(0)
 	}
 }
 
@@ -89,6 +163,10 @@ func (e *ReqQueueEntry) cancelProcessUpdate() {
 }
 
 func (e *ReqQueueEntry) sendProcessUpdate(ctx context.Context, processDesc string, percent int) {
+	if e.progressFunc != nil {
+		e.progressFunc(processDesc, percent)
+		return
+	}
 	e.cancelProcessUpdate()
 	updateInterval := groupChatProgressUpdateInterval
 	if e.Message.Chat.ID > 0 {
@@ -117,6 +195,7 @@ func (e *ReqQueueEntry) sendProcessUpdate(ctx context.Context, processDesc strin
 			str += "..."
 		}
 	}
+	e.Progress = str
 	reqParamsStr := e.Req.Params.String()
 	if len(reqParamsStr) > 0 {
 		str += "\n" + reqParamsStr
@@ -124,12 +203,20 @@ func (e *ReqQueueEntry) sendProcessUpdate(ctx context.Context, processDesc strin
 	e.sendReply(ctx, str)
 }
 
-func (e *ReqQueueEntry) sendUpdate(ctx context.Context, s string) {
+func (e *ReqQueueEntry) getUpdateString(s string) string {
 	reqParamsStr := e.Req.Params.String()
 	if len(reqParamsStr) > 0 {
 		s += "\n" + reqParamsStr
 	}
-	e.sendReply(ctx, s)
+	return s
+}
+
+func (e *ReqQueueEntry) sendUpdate(ctx context.Context, s string) {
+	e.sendReply(ctx, e.getUpdateString(s))
+}
+
+func (e *ReqQueueEntry) sendUpdateAsync(ctx context.Context, s string) {
+	e.sendReplyAsync(ctx, e.getUpdateString(s))
 }
 
 // func (e *ReqQueueEntry) deleteReply(ctx context.Context) {
@@ -150,273 +237,559 @@ type ReqQueueReq struct {
 	Params  ReqParams
 }
 
-type ReqQueueCurrentEntry struct {
+// Returns true if the request needs an input audio file.
+func (r ReqQueueReq) NeedsAudio() bool {
+	return getBackend(r.Type).NeedsAudio(r.Params)
+}
+
+type ReqQueueSlot struct {
 	entry     *ReqQueueEntry
 	canceled  bool
 	ctxCancel context.CancelFunc
+}
+
+// Request types which don't have worker slots configured share the default lane.
+const defaultLaneName = "default"
+
+type ReqQueueLane struct {
+	name    string
+	entries []*ReqQueueEntry // In the order they were added, see getScheduledEntries for the processing order.
+	slots   []*ReqQueueSlot
+	cond    *sync.Cond
 
-	gotAudioChan chan AudioFileData
+	userVirtualTimes map[int64]float64
+	virtualClock     float64
 }
 
-type ReqQueue struct {
-	mutex          sync.Mutex
-	ctx            context.Context
-	entries        []ReqQueueEntry
-	processReqChan chan bool
+func (l *ReqQueueLane) hasFreeSlot() bool {
+	for _, slot := range l.slots {
+		if slot.entry == nil {
+			return true
+		}
+	}
+	return false
+}
 
-	currentEntry ReqQueueCurrentEntry
+type reqQueueAudioWaitKey struct {
+	chatID int64
+	userID int64
 }
 
-func (q *ReqQueue) Add(req ReqQueueReq) {
-	q.mutex.Lock()
+type reqQueueAudioWaiter struct {
+	entry *ReqQueueEntry
+	timer *time.Timer
+}
+
+type ReqQueue struct {
+	mutex       sync.Mutex
+	ctx         context.Context
+	lanes       []*ReqQueueLane
+	laneByType  map[ReqType]*ReqQueueLane
+	userWeights map[int64]float64
+
+	// Entries waiting for the user to post the input audio file. They get into the queue after the
+	// audio file has been downloaded.
+	audioWaiters map[reqQueueAudioWaitKey]reqQueueAudioWaiter
+}
 
-	newEntry := ReqQueueEntry{
-		TaskID:  rand.Uint64(),
-		Message: req.Message,
-		Req:     req,
+func (q *ReqQueue) Add(req ReqQueueReq, quotaRes *QuotaReservation) {
+	newEntry := &ReqQueueEntry{
+		TaskID:   rand.Uint64(),
+		Message:  req.Message,
+		Req:      req,
+		AddedAt:  time.Now(),
+		quotaRes: quotaRes,
 	}
 
-	if len(q.entries) > 0 {
-		fmt.Println("  queueing request at position #", len(q.entries))
-		newEntry.sendReply(q.ctx, q.getQueuePositionString(len(q.entries)))
+	if req.NeedsAudio() {
+		if audioMsg := getInputAudioMessage(req.Message); audioMsg != nil {
+			fileID, filename := getMessageAudioFile(audioMsg)
+			downloadAudioAndAddToQueue(q.ctx, newEntry, fileID, filename)
+			return
+		}
+
+		useLast := req.Params.Common().UseLast
+		if useLast || getParams().ClipboardDefault {
+			if e, ok := clipboard.Get(req.Message.Chat.ID); ok {
+				fmt.Println("  using audio file from clipboard")
+				downloadAudioAndAddToQueue(q.ctx, newEntry, e.FileID, e.Filename)
+				return
+			}
+			if useLast {
+				quota.Release(quotaRes, false)
+				newEntry.sendReply(q.ctx, errorStr+": clipboard is empty")
+				return
+			}
+		}
+
+		q.waitForAudio(newEntry)
+		return
 	}
 
-	q.entries = append(q.entries, newEntry)
-	q.mutex.Unlock()
+	q.enqueue(newEntry)
+}
+
+func (q *ReqQueue) waitForAudio(newEntry *ReqQueueEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-	select {
-	case q.processReqChan <- true:
-	default:
+	key := reqQueueAudioWaitKey{chatID: newEntry.Message.Chat.ID, userID: newEntry.Message.From.ID}
+	if prevWaiter, ok := q.audioWaiters[key]; ok {
+		prevWaiter.timer.Stop()
+		quota.Release(prevWaiter.entry.quotaRes, false)
+		prevWaiter.entry.sendUpdateAsync(q.ctx, canceledStr)
 	}
+
+	fmt.Println("  waiting for audio file...")
+	newEntry.sendUpdateAsync(q.ctx, audioReqStr)
+
+	var waiter reqQueueAudioWaiter
+	waiter.entry = newEntry
+	waiter.timer = time.AfterFunc(audioWaitTimeout, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		if w, ok := q.audioWaiters[key]; !ok || w.entry != newEntry {
+			return
+		}
+		delete(q.audioWaiters, key)
+		fmt.Println("  waiting for audio file timeout")
+		quota.Release(newEntry.quotaRes, false)
+		newEntry.sendReplyAsync(q.ctx, errorStr+": waiting for audio data timeout")
+	})
+	q.audioWaiters[key] = waiter
 }
 
-func (q *ReqQueue) CancelCurrentEntry(ctx context.Context) (err error) {
+// Returns the entry which is waiting for audio data from the given user in the given chat, or nil if
+// there is no such entry. The returned entry is not waiting for audio anymore, it should be added to the
+// queue using AddWithAudio.
+func (q *ReqQueue) GetEntryWaitingForAudio(chatID, userID int64) *ReqQueueEntry {
 	q.mutex.Lock()
-	if len(q.entries) > 0 {
-		fmt.Println("  cancelling active request")
-		q.currentEntry.canceled = true
-		q.currentEntry.ctxCancel()
-	} else {
-		fmt.Println("  no active request to cancel")
-		err = fmt.Errorf("no active request to cancel")
+	defer q.mutex.Unlock()
+
+	key := reqQueueAudioWaitKey{chatID: chatID, userID: userID}
+	waiter, ok := q.audioWaiters[key]
+	if !ok {
+		return nil
 	}
-	q.mutex.Unlock()
-	return
+	waiter.timer.Stop()
+	delete(q.audioWaiters, key)
+	return waiter.entry
 }
 
-func (q *ReqQueue) getQueuePositionString(pos int) string {
-	return "👨‍👦‍👦 Request queued at position #" + fmt.Sprint(pos)
+// Adds the given entry which was waiting for audio to the queue with the given audio data.
+func (q *ReqQueue) AddWithAudio(qEntry *ReqQueueEntry, audioData AudioFileData) {
+	qEntry.AudioData = audioData
+	q.enqueue(qEntry)
 }
 
-func (q *ReqQueue) processQueueEntry(processCtx context.Context, qEntry *ReqQueueEntry, audioData AudioFileData) error {
-	fmt.Print("processing request from ", q.currentEntry.entry.Message.From.Username, "#", q.currentEntry.entry.Message.From.ID,
-		": ", q.currentEntry.entry.Req.Message.Text, "\n")
+func (q *ReqQueue) enqueue(newEntry *ReqQueueEntry) {
+	// The entry is not in the queue yet, so it can be stored without locking the queue mutex. Storing
+	// the audio file may need copying a large file.
+	if err := store.SaveEntry(newEntry); err != nil {
+		fmt.Println("  can't store queue entry:", err)
+	} else if !newEntry.AudioData.isEmpty() {
+		if err := store.SaveAudio(newEntry); err != nil {
+			fmt.Println("  can't store audio data:", err)
+		}
+	}
 
-	qEntry.sendProcessUpdate(q.ctx, "", -1)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	lane := q.laneByType[newEntry.Req.Type]
+	q.addEntryToLane(lane, newEntry)
+	if len(lane.entries) > 1 || !lane.hasFreeSlot() {
+		pos := q.getScheduledPosition(lane, newEntry)
+		fmt.Println("  queueing request in lane", lane.name, "at position #", pos)
+		newEntry.sendReplyAsync(q.ctx, q.getQueuePositionString(lane, pos)+"\n🆔 Task ID: "+fmt.Sprint(newEntry.TaskID))
+	}
 
-	switch qEntry.Req.Type {
-	case ReqTypeTTS:
-		reader, err := tts.TTS(processCtx, qEntry.Req.Params.(ReqParamsTTS), qEntry.Req.Prompt)
-		if err != nil {
-			return err
-		}
+	lane.cond.Signal()
+}
 
-		defer tts.CleanupOutputFiles()
+// Returns true if the given message is the request message, the reply of the bot or the message with the
+// input audio file of the entry.
+func (e *ReqQueueEntry) isRelatedMessage(msg *models.Message) bool {
+	if msg.Chat.ID != e.Req.Message.Chat.ID {
+		return false
+	}
+	return msg.ID == e.Req.Message.ID || msg.ID == e.Message.ID || int64(msg.ID) == e.replyMessageID.Load()
+}
 
-		err = upload.Voice(q.ctx, q.currentEntry.entry, reader, true)
-		if err != nil {
-			return err
-		}
+// Cancels all requests (waiting for audio, queued or being processed) for which the given filter
+// function returns true. Returns the number of canceled requests.
+func (q *ReqQueue) Cancel(filter func(e *ReqQueueEntry) bool) (count int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-		q.currentEntry.entry.sendUpdate(q.ctx, doneStr)
-	case ReqTypeSTT:
-		text, err := stt.STT(processCtx, qEntry.Req.Params.(ReqParamsSTT), audioData)
-		if err != nil {
-			return err
+	for key, waiter := range q.audioWaiters {
+		if !filter(waiter.entry) {
+			continue
 		}
+		fmt.Println("  cancelling request", waiter.entry.TaskID, "waiting for audio")
+		waiter.timer.Stop()
+		delete(q.audioWaiters, key)
+		quota.Release(waiter.entry.quotaRes, false)
+		waiter.entry.sendUpdateAsync(q.ctx, canceledStr)
+		count++
+	}
 
-		fmt.Println("  result:", text)
-		q.currentEntry.entry.sendReply(q.ctx, text)
-	case ReqTypeMDX:
-		files, err := mdx.MDX(processCtx, qEntry.Req.Params.(ReqParamsMDX), audioData)
-		if err != nil {
-			return err
+	for _, lane := range q.lanes {
+		var remainingEntries []*ReqQueueEntry
+		for _, e := range lane.entries {
+			if !filter(e) {
+				remainingEntries = append(remainingEntries, e)
+				continue
+			}
+			fmt.Println("  cancelling queued request", e.TaskID, "in lane", lane.name)
+			if err := store.DeleteEntry(e); err != nil {
+				fmt.Println("  can't delete stored queue entry:", err)
+			}
+			removeWorkDir(e.WorkDir)
+			quota.Release(e.quotaRes, false)
+			e.sendUpdateAsync(q.ctx, canceledStr)
+			count++
+		}
+		if len(remainingEntries) != len(lane.entries) {
+			lane.entries = remainingEntries
+			q.updateQueuePositions(lane)
 		}
 
-		if len(files) == 0 {
-			return fmt.Errorf("got no output files from MDX")
+		for _, slot := range lane.slots {
+			if slot.entry == nil || slot.canceled || !filter(slot.entry) {
+				continue
+			}
+			fmt.Println("  cancelling active request", slot.entry.TaskID, "in lane", lane.name)
+			slot.canceled = true
+			slot.ctxCancel()
+			count++
 		}
+	}
+	return
+}
 
-		defer mdx.CleanupOutputFiles()
+// Returns the processing timeout for the given request. The timeout set in the request params has
+// priority over the configured request type timeout.
+func (q *ReqQueue) getProcessTimeout(req ReqQueueReq) time.Duration {
+	if t := req.Params.Common().Timeout; t > 0 {
+		return t
+	}
+	if t, ok := getParams().Timeouts[req.Type]; ok {
+		return t
+	}
+	return defaultProcessTimeout
+}
 
-		err = upload.Audio(q.ctx, q.currentEntry.entry, files, true)
-		if err != nil {
-			return err
-		}
+// Moves the queued entry with the given task ID to the front of its lane. Returns false if there's no
+// such queued entry.
+func (q *ReqQueue) MoveToFront(taskID uint64) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-		q.currentEntry.entry.sendUpdate(q.ctx, doneStr)
-	case ReqTypeRVC:
-		file, err := rvc.RVC(processCtx, qEntry.Req.Params.(ReqParamsRVC), audioData)
-		if err != nil {
-			return err
+	for _, lane := range q.lanes {
+		for i, e := range lane.entries {
+			if e.TaskID != taskID {
+				continue
+			}
+			fmt.Println("  moving request", taskID, "to the front of lane", lane.name)
+			e.Prioritized = true
+			copy(lane.entries[1:i+1], lane.entries[:i])
+			lane.entries[0] = e
+			q.updateQueuePositions(lane)
+			return true
 		}
+	}
+	return false
+}
 
-		defer rvc.CleanupOutputFiles()
+// A snapshot of a queue entry, used for displaying the queue status.
+type ReqQueueStatusEntry struct {
+	TaskID   uint64
+	User     *models.User
+	Type     ReqType
+	Params   string
+	Lane     string
+	Pos      int       // Position in the lane, 0 for running entries.
+	Since    time.Time // When the entry has been added to the queue, or started for running entries.
+	Progress string
+}
 
-		err = upload.Voice(q.ctx, q.currentEntry.entry, file, true)
-		if err != nil {
-			return err
-		}
+// Returns the running and waiting entries of all lanes.
+func (q *ReqQueue) GetStatus() (running, waiting []ReqQueueStatusEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-		q.currentEntry.entry.sendUpdate(q.ctx, doneStr)
-	case ReqTypeRVCTrain:
-		reqParams := qEntry.Req.Params.(ReqParamsRVCTrain)
-		if reqParams.Delete {
-			err := rvc.DeleteModel(reqParams.Model)
-			if err != nil {
-				return err
+	for _, lane := range q.lanes {
+		for _, slot := range lane.slots {
+			if slot.entry == nil {
+				continue
 			}
-		} else {
-			err := rvc.Train(processCtx, reqParams, audioData)
-			if err != nil {
-				return err
-			}
-
-			defer rvc.TrainCleanupOutputFiles(reqParams.Model)
+			running = append(running, ReqQueueStatusEntry{
+				TaskID:   slot.entry.TaskID,
+				User:     slot.entry.Req.Message.From,
+				Type:     slot.entry.Req.Type,
+				Params:   slot.entry.Req.Params.String(),
+				Lane:     lane.name,
+				Since:    slot.entry.StartedAt,
+				Progress: slot.entry.Progress,
+			})
 		}
-
-		q.currentEntry.entry.sendUpdate(q.ctx, doneStr)
-	case ReqTypeMusicgen:
-		file, err := musicgen.Musicgen(processCtx, qEntry.Req.Params.(ReqParamsMusicgen), qEntry.Req.Prompt, audioData)
-		if err != nil {
-			return err
+		for i, e := range q.getScheduledEntries(lane) {
+			waiting = append(waiting, ReqQueueStatusEntry{
+				TaskID: e.TaskID,
+				User:   e.Req.Message.From,
+				Type:   e.Req.Type,
+				Params: e.Req.Params.String(),
+				Lane:   lane.name,
+				Pos:    i + 1,
+				Since:  e.AddedAt,
+			})
 		}
+	}
+	return
+}
 
-		defer musicgen.CleanupOutputFiles()
+// Updates the replies of all waiting entries of the given lane with their current queue positions. The
+// replies are sent asynchronously, as this is called with the queue mutex locked.
+func (q *ReqQueue) updateQueuePositions(lane *ReqQueueLane) {
+	for i, e := range q.getScheduledEntries(lane) {
+		e.sendReplyAsync(q.ctx, q.getQueuePositionString(lane, i+1)+"\n🆔 Task ID: "+fmt.Sprint(e.TaskID))
+	}
+}
 
-		err = upload.Voice(q.ctx, q.currentEntry.entry, file, true)
-		if err != nil {
-			return err
-		}
+func (q *ReqQueue) getQueuePositionString(lane *ReqQueueLane, pos int) string {
+	s := "👨‍👦‍👦 Request queued at position #" + fmt.Sprint(pos)
+	if len(q.lanes) > 1 {
+		s += " in the " + lane.name + " lane"
+	}
+	return s
+}
 
-		q.currentEntry.entry.sendUpdate(q.ctx, doneStr)
-	case ReqTypeAudiogen:
-		file, err := audiogen.Audiogen(processCtx, qEntry.Req.Params.(ReqParamsAudiogen), qEntry.Req.Prompt)
-		if err != nil {
-			return err
-		}
+func (q *ReqQueue) processQueueEntry(processCtx context.Context, qEntry *ReqQueueEntry) error {
+	fmt.Print("processing request from ", qEntry.Message.From.Username, "#", qEntry.Message.From.ID,
+		": ", qEntry.Req.Message.Text, "\n")
 
-		defer audiogen.CleanupOutputFiles()
+	qEntry.sendProcessUpdate(q.ctx, "", -1)
 
-		err = upload.Voice(q.ctx, q.currentEntry.entry, file, true)
-		if err != nil {
-			return err
+	b := getBackend(qEntry.Req.Type)
+	var result BackendResult
+	var err error
+	if remoteWorkers.CanRun(qEntry.Req.Type) {
+		result, err = remoteWorkers.Run(processCtx, qEntry)
+		if errors.Is(err, errNoRemoteWorker) {
+			if b.SelfCheck() != nil {
+				return err
+			}
+			fmt.Println("  no remote worker left, running the request locally")
+			result, err = b.Run(processCtx, qEntry)
 		}
+	} else {
+		result, err = b.Run(processCtx, qEntry)
+	}
+	if err != nil {
+		return err
+	}
 
-		q.currentEntry.entry.sendUpdate(q.ctx, doneStr)
+	switch b.OutputKind() {
+	case BackendOutputVoice:
+		if result.Voice == nil {
+			return fmt.Errorf("got no output from " + b.Name())
+		}
+		err = upload.Voice(q.ctx, qEntry, result.Voice)
+	case BackendOutputAudio:
+		if len(result.Audio) == 0 {
+			return fmt.Errorf("got no output files from " + b.Name())
+		}
+		err = upload.Audio(q.ctx, qEntry, result.Audio)
+	case BackendOutputText:
+		fmt.Println("  result:", result.Text)
+		qEntry.sendReply(q.ctx, result.Text)
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
+	qEntry.sendUpdate(q.ctx, doneStr)
 	return nil
 }
 
-func (q *ReqQueue) processor() {
+func (q *ReqQueue) processor(lane *ReqQueueLane, slot *ReqQueueSlot) {
 	for {
 		q.mutex.Lock()
-		if (len(q.entries)) == 0 {
+		for len(lane.entries) == 0 && q.ctx.Err() == nil {
+			lane.cond.Wait()
+		}
+		if q.ctx.Err() != nil { // Shutting down? Stored entries will be processed after restart.
 			q.mutex.Unlock()
-			<-q.processReqChan
-			continue
+			return
 		}
 
-		// Updating queue positions for all waiting entries.
-		for i := 1; i < len(q.entries); i++ {
-			sendReplyToMessage(q.ctx, q.entries[i].Message, q.getQueuePositionString(i))
-		}
+		*slot = ReqQueueSlot{entry: q.takeNextEntry(lane)}
 
-		q.currentEntry = ReqQueueCurrentEntry{}
+		q.updateQueuePositions(lane)
+
+		qEntry := slot.entry
+		qEntry.Running = true
+		qEntry.StartedAt = time.Now()
+		if err := store.SaveEntry(qEntry); err != nil {
+			fmt.Println("  can't store queue entry:", err)
+		}
+		processTimeout := q.getProcessTimeout(qEntry.Req)
 		var processCtx context.Context
-		processCtx, q.currentEntry.ctxCancel = context.WithTimeout(q.ctx, processTimeout)
-		q.currentEntry.entry = &q.entries[0]
+		processCtx, slot.ctxCancel = context.WithTimeout(q.ctx, processTimeout)
 		q.mutex.Unlock()
 
-		reqParamsStr := q.currentEntry.entry.Req.Params.String()
+		reqParamsStr := qEntry.Req.Params.String()
 		if len(reqParamsStr) > 0 {
 			fmt.Println("  request params:", reqParamsStr)
 		}
 
 		var err error
-		var audioData AudioFileData
-		audioNeededFirst := false
-		switch q.currentEntry.entry.Req.Type {
-		case ReqTypeSTT, ReqTypeMDX, ReqTypeMusicgen:
-			audioNeededFirst = true
-		case ReqTypeRVC:
-			if !rvc.ModelExists(q.currentEntry.entry.Req.Params.(ReqParamsRVC).Model) {
-				err = fmt.Errorf("model does not exist")
-			} else {
-				audioNeededFirst = true
-			}
-		case ReqTypeRVCTrain:
-			reqParams := q.currentEntry.entry.Req.Params.(ReqParamsRVCTrain)
-			modelExists := rvc.ModelExists(reqParams.Model)
-			if reqParams.Delete {
-				if !modelExists {
-					err = fmt.Errorf("model does not exist")
-				}
-			} else {
-				if modelExists {
-					err = fmt.Errorf("model already exists, delete it first")
-				}
-			}
-			if err == nil {
-				audioNeededFirst = true
-			}
+		qEntry.WorkDir, err = createWorkDir(qEntry.TaskID)
+
+		if err == nil && qEntry.Req.NeedsAudio() && qEntry.AudioData.isEmpty() {
+			err = fmt.Errorf("got no audio data")
 		}
-		if audioNeededFirst {
-			fmt.Println("  waiting for audio file...")
-			q.currentEntry.entry.sendUpdate(q.ctx, audioReqStr)
-			q.currentEntry.gotAudioChan = make(chan AudioFileData)
-			select {
-			case audioData = <-q.currentEntry.gotAudioChan:
-			case <-processCtx.Done():
-				q.currentEntry.canceled = true
-			case <-time.NewTimer(3 * time.Minute).C:
-				fmt.Println("  waiting for audio file timeout")
-				err = fmt.Errorf("waiting for audio data timeout")
-			}
-			close(q.currentEntry.gotAudioChan)
-			q.currentEntry.gotAudioChan = nil
 
-			if err == nil && len(audioData.data) == 0 {
-				err = fmt.Errorf("got no audio data")
-			}
+		if err == nil {
+			err = checkReqTypeEnabled(qEntry.Req.Type)
 		}
 
 		if err == nil {
-			err = q.processQueueEntry(processCtx, q.currentEntry.entry, audioData)
+			err = getBackend(qEntry.Req.Type).Check(qEntry.Req)
+		}
+
+		if err == nil {
+			err = q.processQueueEntry(processCtx, qEntry)
 		}
 
 		q.mutex.Lock()
-		if q.currentEntry.canceled {
+		// Interrupted by shutdown? Keeping the stored entry, it will be handled after restart.
+		if q.ctx.Err() != nil {
+			fmt.Println("  interrupted by shutdown")
+			slot.ctxCancel()
+			removeWorkDir(qEntry.WorkDir)
+			q.mutex.Unlock()
+			return
+		}
+
+		// The reply is sent after unlocking the queue mutex.
+		var reply string
+		if slot.canceled {
 			fmt.Print("  canceled\n")
-			q.currentEntry.entry.sendReply(q.ctx, canceledStr)
+			reply = canceledStr
+		} else if processCtx.Err() == context.DeadlineExceeded {
+			fmt.Println("  timeout after", processTimeout)
+			reply = timeoutStr + ": processing took longer than " + processTimeout.String()
 		} else if err != nil {
 			fmt.Println("  error:", err)
-			q.currentEntry.entry.sendReply(q.ctx, errorStr+": "+err.Error())
+			reply = errorStr + ": " + err.Error()
 		}
 
-		q.currentEntry.ctxCancel()
+		slot.ctxCancel()
+		removeWorkDir(qEntry.WorkDir)
+		quota.Release(qEntry.quotaRes, reply == "")
+		if err := store.DeleteEntry(qEntry); err != nil {
+			fmt.Println("  can't delete stored queue entry:", err)
+		}
 
-		q.entries = q.entries[1:]
-		if len(q.entries) == 0 {
-			fmt.Print("finished queue processing\n")
+		slot.entry = nil
+		if len(lane.entries) == 0 {
+			fmt.Print("finished queue processing in lane ", lane.name, "\n")
 		}
 		q.mutex.Unlock()
+
+		// A pending progress update would overwrite the reply.
+		qEntry.cancelProcessUpdate()
+		if reply != "" {
+			qEntry.sendReply(q.ctx, reply)
+		}
+	}
+}
+
+func (q *ReqQueue) addLane(name string, slotCount int) *ReqQueueLane {
+	lane := &ReqQueueLane{
+		name:             name,
+		cond:             sync.NewCond(&q.mutex),
+		userVirtualTimes: make(map[int64]float64),
+	}
+	for i := 0; i < slotCount; i++ {
+		lane.slots = append(lane.slots, &ReqQueueSlot{})
+	}
+	q.lanes = append(q.lanes, lane)
+	return lane
+}
+
+// Loads the entries which were in the queue when the bot was stopped.
+func (q *ReqQueue) loadStoredEntries() {
+	entries, err := store.LoadEntries()
+	if err != nil {
+		fmt.Println("can't load stored queue entries:", err)
+		return
+	}
+
+	for _, e := range entries {
+		if e.Running && !e.Req.Type.RerunAfterRestart() {
+			fmt.Println("stored request", e.TaskID, "was interrupted by restart, dropping")
+			sendReplyToMessage(q.ctx, e.Message, interruptedStr+"\n"+e.Req.Params.String())
+			getBackend(e.Req.Type).Interrupted(e.Req)
+			if err := store.DeleteEntry(e); err != nil {
+				fmt.Println("can't delete stored queue entry:", err)
+			}
+			continue
+		}
+
+		e.Running = false
+		e.quotaRes = quota.Restore(e.Message, e.Req.Type, e.quotaRes.ID())
+		q.addEntryToLane(q.laneByType[e.Req.Type], e)
+	}
+
+	for _, lane := range q.lanes {
+		for i, e := range q.getScheduledEntries(lane) {
+			s := resumedStr
+			if pos := i - len(lane.slots) + 1; pos > 0 {
+				s += "\n" + q.getQueuePositionString(lane, pos)
+			}
+			sendReplyToMessage(q.ctx, e.Message, s)
+		}
+		if len(lane.entries) > 0 {
+			fmt.Println("resumed", len(lane.entries), "stored request(s) in lane", lane.name)
+		}
 	}
 }
 
 func (q *ReqQueue) Init(ctx context.Context) {
 	q.ctx = ctx
-	q.processReqChan = make(chan bool)
-	go q.processor()
+	sweepStaleWorkDirs()
+
+	q.laneByType = make(map[ReqType]*ReqQueueLane)
+	q.userWeights = make(map[int64]float64)
+	for userID, weight := range getParams().UserWeights {
+		q.userWeights[userID] = weight
+	}
+	q.audioWaiters = make(map[reqQueueAudioWaitKey]reqQueueAudioWaiter)
+	var defaultLane *ReqQueueLane
+	for i := range backends {
+		reqType := ReqType(i)
+		slotCount, ok := getParams().Workers[reqType]
+		if ok {
+			q.laneByType[reqType] = q.addLane(reqType.String(), slotCount)
+			continue
+		}
+		if defaultLane == nil {
+			defaultLane = q.addLane(defaultLaneName, 1)
+		}
+		q.laneByType[reqType] = defaultLane
+	}
+
+	q.loadStoredEntries()
+
+	for _, lane := range q.lanes {
+		fmt.Println("request queue lane", lane.name, "has", len(lane.slots), "worker slot(s)")
+		for _, slot := range lane.slots {
+			go q.processor(lane, slot)
+		}
+	}
 }
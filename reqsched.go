@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Requests are scheduled fairly between users in each lane: every user has a virtual time which grows
+// by 1/weight each time a request of the user gets processed, and the user with the lowest virtual time
+// is served next. This way requests of different users are interleaved, and users with higher weights
+// get more turns. Prioritized entries (moved to the front by an admin) are processed before all others.
+
+const defaultUserWeight = 1.0
+
+func (q *ReqQueue) getUserWeight(userID int64) float64 {
+	if w, ok := q.userWeights[userID]; ok && w > 0 {
+		return w
+	}
+	return defaultUserWeight
+}
+
+func (q *ReqQueue) GetUserWeight(userID int64) float64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.getUserWeight(userID)
+}
+
+// Sets the scheduling weight of the given user. Setting the weight to 0 restores the default weight.
+func (q *ReqQueue) SetUserWeight(userID int64, weight float64) error {
+	if weight < 0 {
+		return fmt.Errorf("weight can't be negative")
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if weight == 0 {
+		delete(q.userWeights, userID)
+	} else {
+		q.userWeights[userID] = weight
+	}
+	return nil
+}
+
+// Applies the changes of the configured user weights after a config reload. Weights which were set with
+// the aaiweight command are kept, unless the weight of the user was changed in the config.
+func (q *ReqQueue) UpdateUserWeights(oldWeights, newWeights map[int64]float64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for userID, weight := range oldWeights {
+		if _, ok := newWeights[userID]; !ok && q.userWeights[userID] == weight {
+			delete(q.userWeights, userID)
+		}
+	}
+	for userID, weight := range newWeights {
+		if oldWeights[userID] != weight {
+			q.userWeights[userID] = weight
+		}
+	}
+}
+
+// Returns the waiting entries of the given lane in the order they will be processed.
+func (q *ReqQueue) getScheduledEntries(lane *ReqQueueLane) (scheduled []*ReqQueueEntry) {
+	userEntries := make(map[int64][]*ReqQueueEntry)
+	var users []int64
+	for _, e := range lane.entries {
+		if e.Prioritized {
+			scheduled = append(scheduled, e)
+			continue
+		}
+		userID := e.Req.Message.From.ID
+		if _, ok := userEntries[userID]; !ok {
+			users = append(users, userID)
+		}
+		userEntries[userID] = append(userEntries[userID], e)
+	}
+
+	virtualTimes := make(map[int64]float64)
+	for _, userID := range users {
+		virtualTimes[userID] = lane.userVirtualTimes[userID]
+	}
+
+	for len(users) > 0 {
+		// Selecting the user with the lowest virtual time. Users are in the order of their first
+		// waiting entry, so ties are broken by the waiting time.
+		nextIdx := 0
+		for i := 1; i < len(users); i++ {
+			if virtualTimes[users[i]] < virtualTimes[users[nextIdx]] {
+				nextIdx = i
+			}
+		}
+
+		userID := users[nextIdx]
+		scheduled = append(scheduled, userEntries[userID][0])
+		userEntries[userID] = userEntries[userID][1:]
+		virtualTimes[userID] += 1 / q.getUserWeight(userID)
+		if len(userEntries[userID]) == 0 {
+			users = append(users[:nextIdx], users[nextIdx+1:]...)
+		}
+	}
+	return
+}
+
+// Returns the position of the given entry in the scheduling order of the lane, starting from 1.
+func (q *ReqQueue) getScheduledPosition(lane *ReqQueueLane, entry *ReqQueueEntry) int {
+	for i, e := range q.getScheduledEntries(lane) {
+		if e == entry {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (q *ReqQueue) addEntryToLane(lane *ReqQueueLane, newEntry *ReqQueueEntry) {
+	userID := newEntry.Req.Message.From.ID
+	userHasEntries := false
+	for _, e := range lane.entries {
+		if e.Req.Message.From.ID == userID {
+			userHasEntries = true
+			break
+		}
+	}
+	// Users who were idle can't use their unused turns to get ahead of everyone else.
+	if !userHasEntries && lane.userVirtualTimes[userID] < lane.virtualClock {
+		lane.userVirtualTimes[userID] = lane.virtualClock
+	}
+
+	lane.entries = append(lane.entries, newEntry)
+}
+
+// Removes the next entry to process from the lane and returns it.
+func (q *ReqQueue) takeNextEntry(lane *ReqQueueLane) *ReqQueueEntry {
+	next := q.getScheduledEntries(lane)[0]
+	for i, e := range lane.entries {
+		if e == next {
+			lane.entries = append(lane.entries[:i], lane.entries[i+1:]...)
+			break
+		}
+	}
+
+	if !next.Prioritized {
+		userID := next.Req.Message.From.ID
+		lane.virtualClock = lane.userVirtualTimes[userID]
+		lane.userVirtualTimes[userID] += 1 / q.getUserWeight(userID)
+	}
+
+	// Forgetting the virtual times which would be raised to the virtual clock anyway when the user adds
+	// a new request, so the map doesn't grow forever.
+	waitingUsers := make(map[int64]bool)
+	for _, e := range lane.entries {
+		waitingUsers[e.Req.Message.From.ID] = true
+	}
+	for userID, vt := range lane.userVirtualTimes {
+		if vt <= lane.virtualClock && !waitingUsers[userID] {
+			delete(lane.userVirtualTimes, userID)
+		}
+	}
+	return next
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReqSched(t *testing.T) {
+	// Steps:
+	// - "add <user id>": adds a request of the user, task IDs are assigned from 1.
+	// - "front <task id>": prioritizes the request like the move to front button.
+	// - "order <task ids>": checks the scheduled order of the waiting requests.
+	// - "take <task id>": checks the next request to process and removes it from the lane.
+	tests := []struct {
+		name    string
+		weights map[int64]float64
+		steps   []string
+	}{
+		{name: "single user keeps the order", steps: []string{
+			"add 1", "add 1", "add 1",
+			"order 1 2 3",
+			"take 1", "take 2", "take 3",
+		}},
+		{name: "users are interleaved", steps: []string{
+			"add 1", "add 1", "add 1", "add 2", "add 2", "add 3",
+			"order 1 4 6 2 5 3",
+			"take 1", "take 4", "take 6", "take 2", "take 5", "take 3",
+		}},
+		{name: "weights", weights: map[int64]float64{2: 2}, steps: []string{
+			"add 1", "add 1", "add 1", "add 2", "add 2", "add 2", "add 2",
+			"order 1 4 5 2 6 7 3",
+			"take 1", "take 4", "take 5", "take 2", "take 6", "take 7", "take 3",
+		}},
+		{name: "fractional weight", weights: map[int64]float64{1: 0.5}, steps: []string{
+			"add 1", "add 1", "add 2", "add 2", "add 2",
+			"order 1 3 4 2 5",
+		}},
+		{name: "prioritized entries go first", steps: []string{
+			"add 1", "add 1", "add 2", "add 2",
+			"front 4",
+			"order 4 1 3 2",
+			"front 2",
+			"order 2 4 1 3",
+			"take 2", "take 4", "take 1", "take 3",
+		}},
+		{name: "prioritized entries don't use turns", steps: []string{
+			"add 1", "add 1", "add 2",
+			"front 2",
+			"take 2",
+			"order 1 3",
+		}},
+		{name: "new user gets the next turn", steps: []string{
+			"add 1", "add 1", "add 1",
+			"take 1",
+			"add 2",
+			"order 4 2 3",
+		}},
+		{name: "idle user catches up with the virtual clock", steps: []string{
+			"add 2",
+			"take 1",
+			"add 1", "add 1", "add 1", "add 1",
+			"take 2", "take 3", "take 4",
+			// User 2 was idle while user 1's requests were processed, so the virtual time of user 2
+			// is raised to the virtual clock and user 2 doesn't get several turns in a row.
+			"add 2", "add 2",
+			"order 6 5 7",
+		}},
+		{name: "idle user with a weight", weights: map[int64]float64{2: 2}, steps: []string{
+			"add 1", "add 1", "add 1",
+			"take 1", "take 2",
+			"add 2", "add 2", "add 2",
+			"order 4 5 3 6",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &ReqQueue{userWeights: make(map[int64]float64)}
+			for userID, w := range tt.weights {
+				q.userWeights[userID] = w
+			}
+			lane := &ReqQueueLane{userVirtualTimes: make(map[int64]float64)}
+
+			var taskID uint64
+			taskIDs := func(entries []*ReqQueueEntry) string {
+				var s []string
+				for _, e := range entries {
+					s = append(s, fmt.Sprint(e.TaskID))
+				}
+				return strings.Join(s, " ")
+			}
+			for _, step := range tt.steps {
+				op, arg, _ := strings.Cut(step, " ")
+				switch op {
+				case "add":
+					var userID int64
+					fmt.Sscan(arg, &userID)
+					taskID++
+					q.addEntryToLane(lane, &ReqQueueEntry{TaskID: taskID, Req: ReqQueueReq{Message: newTestMessage(userID, userID)}})
+				case "front":
+					for i, e := range lane.entries {
+						if fmt.Sprint(e.TaskID) == arg {
+							e.Prioritized = true
+							copy(lane.entries[1:i+1], lane.entries[:i])
+							lane.entries[0] = e
+							break
+						}
+					}
+				case "order":
+					if got := taskIDs(q.getScheduledEntries(lane)); got != arg {
+						t.Fatalf("%s: got order %s", step, got)
+					}
+				case "take":
+					if got := q.takeNextEntry(lane); fmt.Sprint(got.TaskID) != arg {
+						t.Fatalf("%s: got task %d", step, got.TaskID)
+					}
+				default:
+					t.Fatalf("invalid step %q", step)
+				}
+			}
+		})
+	}
+}
+
+func TestReqSchedForgetsVirtualTimes(t *testing.T) {
+	q := &ReqQueue{userWeights: make(map[int64]float64)}
+	lane := &ReqQueueLane{userVirtualTimes: make(map[int64]float64)}
+	for i, userID := range []int64{1, 1, 2} {
+		q.addEntryToLane(lane, &ReqQueueEntry{TaskID: uint64(i + 1), Req: ReqQueueReq{Message: newTestMessage(userID, userID)}})
+	}
+	for len(lane.entries) > 0 {
+		q.takeNextEntry(lane)
+	}
+	// The virtual time of user 2 reached the virtual clock, so it's not needed anymore.
+	if len(lane.userVirtualTimes) != 1 || lane.userVirtualTimes[1] != 2 || lane.virtualClock != 1 {
+		t.Fatalf("got virtual times %v, clock %v", lane.userVirtualTimes, lane.virtualClock)
+	}
+}
@@ -7,13 +7,53 @@ if [ ! -x "$bin" ]; then
 	bin="go run *.go"
 fi
 
+CONFIG=$CONFIG \
 BOT_TOKEN=$BOT_TOKEN \
+BOT_API_URL=$BOT_API_URL \
+BOT_API_LOCAL=$BOT_API_LOCAL \
+CHECK_PROBE=$CHECK_PROBE \
 ALLOWED_USERIDS=$ALLOWED_USERIDS \
 ADMIN_USERIDS=$ADMIN_USERIDS \
 ALLOWED_GROUPIDS=$ALLOWED_GROUPIDS \
+QUEUE_DB=$QUEUE_DB \
+TOOLS_CONFIG=$TOOLS_CONFIG \
+CLIPBOARD_TTL=$CLIPBOARD_TTL \
+CLIPBOARD_DEFAULT=$CLIPBOARD_DEFAULT \
+USER_WEIGHTS=$USER_WEIGHTS \
+USER_QUOTA=$USER_QUOTA \
+GROUP_QUOTA=$GROUP_QUOTA \
+ADMIN_QUOTA=$ADMIN_QUOTA \
+WORKERS=$WORKERS \
+DAEMONS=$DAEMONS \
+DAEMON_IDLE_TIMEOUT=$DAEMON_IDLE_TIMEOUT \
+MAX_UPLOAD_SIZE=$MAX_UPLOAD_SIZE \
+FILE_SERVER=$FILE_SERVER \
+FILE_SERVER_URL=$FILE_SERVER_URL \
+FILE_SERVER_DIR=$FILE_SERVER_DIR \
+FILE_SERVER_TTL=$FILE_SERVER_TTL \
+FILE_SERVER_SECRET=$FILE_SERVER_SECRET \
+WEBHOOK=$WEBHOOK \
+WEBHOOK_URL=$WEBHOOK_URL \
+WEBHOOK_SECRET=$WEBHOOK_SECRET \
+WEBHOOK_CERT=$WEBHOOK_CERT \
+WEBHOOK_KEY=$WEBHOOK_KEY \
+WORKER_SERVER=$WORKER_SERVER \
+WORKER_TOKEN=$WORKER_TOKEN \
+WORKER_CONNECT=$WORKER_CONNECT \
+WORKER_NAME=$WORKER_NAME \
+WORKER_TYPES=$WORKER_TYPES \
 TTS_BIN=$TTS_BIN \
 TTS_DEFAULT_MODEL=$TTS_DEFAULT_MODEL \
+TTS_API_URL=$TTS_API_URL \
+TTS_API_KEY=$TTS_API_KEY \
+TTS_API_MODEL=$TTS_API_MODEL \
+TTS_API_VOICE=$TTS_API_VOICE \
+TTS_API_TIMEOUT=$TTS_API_TIMEOUT \
 STT_BIN=$STT_BIN \
+STT_API_URL=$STT_API_URL \
+STT_API_KEY=$STT_API_KEY \
+STT_API_MODEL=$STT_API_MODEL \
+STT_API_TIMEOUT=$STT_API_TIMEOUT \
 MDX_BIN=$MDX_BIN \
 RVC_BIN=$RVC_BIN \
 RVC_MODEL_PATH=$RVC_MODEL_PATH \
@@ -23,4 +63,11 @@ RVC_TRAIN_DEFAULT_BATCH_SIZE=$RVC_TRAIN_DEFAULT_BATCH_SIZE \
 RVC_TRAIN_DEFAULT_EPOCHS=$RVC_TRAIN_DEFAULT_EPOCHS \
 MUSICGEN_BIN=$MUSICGEN_BIN \
 AUDIOGEN_BIN=$AUDIOGEN_BIN \
+TTS_TIMEOUT=$TTS_TIMEOUT \
+STT_TIMEOUT=$STT_TIMEOUT \
+MDX_TIMEOUT=$MDX_TIMEOUT \
+RVC_TIMEOUT=$RVC_TIMEOUT \
+RVC_TRAIN_TIMEOUT=$RVC_TRAIN_TIMEOUT \
+MUSICGEN_TIMEOUT=$MUSICGEN_TIMEOUT \
+AUDIOGEN_TIMEOUT=$AUDIOGEN_TIMEOUT \
 $bin $*
@@ -11,19 +11,166 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/go-telegram/bot/models"
 )
 
 type RVC struct {
+	backendBase
 }
 
-var RVCInFilePath = os.TempDir() + "/rvc-in.wav"
-var RVCOutFilePath = os.TempDir() + "/rvc-out.wav"
+const RVCInFileName = "rvc-in.wav"
+const RVCOutFileName = "rvc-out.wav"
+const RVCTrainConfigFileName = "rvc-train-config.json"
+
+func (t *RVC) Name() string        { return "rvc" }
+func (t *RVC) Description() string { return "retrieval based voice conversion" }
+func (t *RVC) PromptUsage() string { return "(model)" }
+
+func (t *RVC) NewParams() ReqParams {
+	r := &ReqParamsRVC{}
+	ReqParamsSetDefaults(r)
+	return r
+}
+
+// The model can be given as the prompt.
+func (t *RVC) Prepare(req *ReqQueueReq) error {
+	reqParams := req.Params.(*ReqParamsRVC)
+	if reqParams.Model == "" {
+		reqParams.Model = req.Prompt
+	}
+	if reqParams.Model == "" {
+		reqParams.Model = getParams().RVCDefaultModel
+	}
+	reqParams.Model = strings.Trim(reqParams.Model, " ")
+	if reqParams.Model == "" {
+		return fmt.Errorf("no model given")
+	}
+	return nil
+}
+
+func (t *RVC) Check(req ReqQueueReq) error {
+	if !t.ModelExists(req.Params.(*ReqParamsRVC).Model) {
+		return fmt.Errorf("model does not exist")
+	}
+	return nil
+}
+
+func (t *RVC) SelfCheck() error {
+	if err := checkBackendDir(getParams().RVCModelPath); err != nil {
+		return fmt.Errorf("model path: %w", err)
+	}
+	return checkBackendBin(getParams().RVCBin)
+}
+
+func (t *RVC) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	res.Voice, err = t.RVC(ctx, qEntry, *qEntry.Req.Params.(*ReqParamsRVC), qEntry.AudioData)
+	return
+}
+
+// RVCTrain is the backend of RVC training requests.
+type RVCTrain struct {
+	backendBase
+
+	// The RVC train binary uses a training dir named after the model, so the same model can't be trained
+	// by multiple requests at the same time.
+	mutex          sync.Mutex
+	trainingModels map[string]bool
+}
+
+func (t *RVCTrain) Name() string                  { return "rvc-train" }
+func (t *RVCTrain) Description() string           { return "retrieval based voice conversion training" }
+func (t *RVCTrain) PromptUsage() string           { return "(model)" }
+func (t *RVCTrain) OutputKind() BackendOutputKind { return BackendOutputNone }
+
+// Training can't be continued after a restart.
+func (t *RVCTrain) RerunAfterRestart() bool { return false }
+
+func (t *RVCTrain) NeedsAudio(reqParams ReqParams) bool {
+	return !reqParams.(*ReqParamsRVCTrain).Delete
+}
+
+func (t *RVCTrain) NewParams() ReqParams {
+	r := &ReqParamsRVCTrain{}
+	ReqParamsSetDefaults(r)
+	return r
+}
+
+// The model can be given as the prompt.
+func (t *RVCTrain) Prepare(req *ReqQueueReq) error {
+	reqParams := req.Params.(*ReqParamsRVCTrain)
+	if reqParams.Model == "" {
+		reqParams.Model = req.Prompt
+	}
+	reqParams.Model = strings.Trim(reqParams.Model, " ")
+	if reqParams.Model == "" {
+		return fmt.Errorf("no model given")
+	}
+	return nil
+}
+
+func (t *RVCTrain) Check(req ReqQueueReq) error {
+	reqParams := req.Params.(*ReqParamsRVCTrain)
+	modelExists := rvc.ModelExists(reqParams.Model)
+	if reqParams.Delete && !modelExists {
+		return fmt.Errorf("model does not exist")
+	} else if !reqParams.Delete && modelExists {
+		return fmt.Errorf("model already exists, delete it first")
+	}
+	return nil
+}
+
+func (t *RVCTrain) SelfCheck() error {
+	if err := checkBackendDir(getParams().RVCModelPath); err != nil {
+		return fmt.Errorf("model path: %w", err)
+	}
+	return checkBackendBin(getParams().RVCTrainBin)
+}
+
+func (t *RVCTrain) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	reqParams := qEntry.Req.Params.(*ReqParamsRVCTrain)
+	if reqParams.Delete {
+		return res, rvc.DeleteModel(reqParams.Model)
+	}
+
+	if !t.startTraining(reqParams.Model) {
+		return res, fmt.Errorf("model %s is already being trained", reqParams.Model)
+	}
+	defer t.finishTraining(reqParams.Model)
+
+	defer rvc.TrainCleanupOutputFiles(reqParams.Model)
+	return res, rvc.Train(ctx, qEntry, *reqParams, qEntry.AudioData)
+}
+
+// Returns false if the given model is already being trained.
+func (t *RVCTrain) startTraining(modelName string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.trainingModels[modelName] {
+		return false
+	}
+	if t.trainingModels == nil {
+		t.trainingModels = make(map[string]bool)
+	}
+	t.trainingModels[modelName] = true
+	return true
+}
+
+func (t *RVCTrain) finishTraining(modelName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.trainingModels, modelName)
+}
+
+func (t *RVCTrain) Interrupted(req ReqQueueReq) {
+	rvc.TrainCleanupOutputFiles(req.Params.(*ReqParamsRVCTrain).Model)
+}
 
 func (t *RVC) GetModels() ([]string, error) {
 	var models []string
-	err := filepath.Walk(params.RVCModelPath, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(getParams().RVCModelPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -40,9 +187,9 @@ func (t *RVC) GetModelPaths(modelName string) (modelFilename, modelPath, indexPa
 	if !strings.HasSuffix(modelFilename, ".pth") {
 		modelFilename += ".pth"
 	}
-	modelPath = path.Join(params.RVCModelPath, modelFilename)
+	modelPath = path.Join(getParams().RVCModelPath, modelFilename)
 	indexFilename := fileNameWithoutExt(modelFilename) + "_added.index"
-	indexPath = path.Join(params.RVCModelPath, indexFilename)
+	indexPath = path.Join(getParams().RVCModelPath, indexFilename)
 
 	if _, err := os.Stat(modelPath); os.IsNotExist(err) {
 		return modelFilename, modelPath, indexPath, fmt.Errorf("model %s not found", modelName)
@@ -84,15 +231,11 @@ func (t *RVC) ListModels(ctx context.Context, msg *models.Message) {
 	sendReplyToMessage(ctx, msg, "🤡 Available RVC models: "+strings.Join(models, ", "))
 }
 
-func (t *RVC) CleanupOutputFiles() {
-	os.Remove(RVCOutFilePath)
-}
-
-func (t *RVC) RVC(ctx context.Context, reqParams ReqParamsRVC, audioData AudioFileData) (io.ReadCloser, error) {
-	rvc.CleanupOutputFiles()
+func (t *RVC) RVC(ctx context.Context, qEntry *ReqQueueEntry, reqParams ReqParamsRVC, audioData AudioFileData) (io.ReadCloser, error) {
+	inFilePath := path.Join(qEntry.WorkDir, RVCInFileName)
+	outFilePath := path.Join(qEntry.WorkDir, RVCOutFileName)
 
-	defer os.Remove(RVCInFilePath)
-	err := os.WriteFile(RVCInFilePath, audioData.data, 0644)
+	err := audioData.writeFile(inFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("can't write rvc input file: %w", err)
 	}
@@ -102,8 +245,8 @@ func (t *RVC) RVC(ctx context.Context, reqParams ReqParamsRVC, audioData AudioFi
 		return nil, err
 	}
 
-	args := []string{"--input_path", RVCInFilePath, "--model_name", modelFilename,
-		"--index_path", indexPath, "--opt_path", RVCOutFilePath, "--f0method", reqParams.Method}
+	args := []string{"--input_path", inFilePath, "--model_name", modelFilename,
+		"--index_path", indexPath, "--opt_path", outFilePath, "--f0method", reqParams.Method}
 	if reqParams.FilterRadiusSet {
 		args = append(args, "--filter_radius", strconv.Itoa(reqParams.FilterRadius))
 	}
@@ -116,36 +259,25 @@ func (t *RVC) RVC(ctx context.Context, reqParams ReqParamsRVC, audioData AudioFi
 	if reqParams.PitchSet {
 		args = append(args, "--f0up_key", strconv.Itoa(reqParams.Pitch))
 	}
-	cmd := NewCommand(ctx, params.RVCBin, args...)
-	cmd.Dir = path.Dir(params.RVCBin)
+	cmd := newBackendCommand(ctx, qEntry, getParams().RVCBin, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		rvc.CleanupOutputFiles()
 		return nil, fmt.Errorf("RVC error: %w: %s", err, string(output))
 	}
 
 	// Check output .wav file
-	if stat, err := os.Stat(RVCOutFilePath); os.IsNotExist(err) || stat.Size() == 0 {
-		rvc.CleanupOutputFiles()
-		return nil, fmt.Errorf("output file not found: %s", RVCOutFilePath)
+	if stat, err := os.Stat(outFilePath); os.IsNotExist(err) || stat.Size() == 0 {
+		return nil, fmt.Errorf("output file not found: %s", outFilePath)
 	}
 
-	r, err := converter.ConvertToOpus(ctx, RVCOutFilePath)
-	if err != nil {
-		rvc.CleanupOutputFiles()
-		return nil, err
-	}
-
-	return r, nil
+	return converter.ConvertToOpus(ctx, outFilePath)
 }
 
 func (t *RVC) TrainCleanupOutputFiles(modelName string) {
-	rvcTrainBinPath := path.Dir(params.RVCTrainBin)
-	path.Join(rvcTrainBinPath, "rvc-train-config.json")
-	os.RemoveAll(path.Join(path.Dir(params.RVCTrainBin), "data", "training", "RVC", modelName))
+	os.RemoveAll(path.Join(path.Dir(getParams().RVCTrainBin), "data", "training", "RVC", modelName))
 }
 
-func (t *RVC) Train(ctx context.Context, reqParams ReqParamsRVCTrain, audioData AudioFileData) error {
+func (t *RVC) Train(ctx context.Context, qEntry *ReqQueueEntry, reqParams ReqParamsRVCTrain, audioData AudioFileData) error {
 	modelFilename, modelPath, indexPath, err := rvc.GetModelPaths(reqParams.Model)
 	if err == nil {
 		return fmt.Errorf("model %s already exists", reqParams.Model)
@@ -153,20 +285,20 @@ func (t *RVC) Train(ctx context.Context, reqParams ReqParamsRVCTrain, audioData
 
 	rvc.TrainCleanupOutputFiles(reqParams.Model)
 
-	trainDataDir, err := os.MkdirTemp("", "rvc-train")
+	trainDataDir := path.Join(qEntry.WorkDir, "train-data")
+	err = os.Mkdir(trainDataDir, 0700)
 	if err != nil {
 		rvc.TrainCleanupOutputFiles(reqParams.Model)
 		return fmt.Errorf("can't create directory for training data: %w", err)
 	}
-	defer os.RemoveAll(trainDataDir)
 
-	err = os.WriteFile(path.Join(trainDataDir, "in.wav"), audioData.data, 0644)
+	err = audioData.writeFile(path.Join(trainDataDir, "in.wav"))
 	if err != nil {
 		rvc.TrainCleanupOutputFiles(reqParams.Model)
 		return fmt.Errorf("can't write rvc train input file: %w", err)
 	}
 
-	rvcTrainBinPath := path.Dir(params.RVCTrainBin)
+	rvcTrainBinPath := path.Dir(getParams().RVCTrainBin)
 
 	type TrainParams struct {
 		Model     string `json:"model"`
@@ -183,7 +315,8 @@ func (t *RVC) Train(ctx context.Context, reqParams ReqParamsRVCTrain, audioData
 		Epochs:    reqParams.Epochs,
 	}
 
-	cfgFile, err := os.Create(path.Join(rvcTrainBinPath, "rvc-train-config.json"))
+	cfgFilePath := path.Join(qEntry.WorkDir, RVCTrainConfigFileName)
+	cfgFile, err := os.Create(cfgFilePath)
 	if err != nil {
 		rvc.TrainCleanupOutputFiles(reqParams.Model)
 		return fmt.Errorf("can't write rvc train config file: %w", err)
@@ -198,7 +331,7 @@ func (t *RVC) Train(ctx context.Context, reqParams ReqParamsRVCTrain, audioData
 	}
 	cfgFile.Close()
 
-	cmd := NewCommand(ctx, params.RVCTrainBin)
+	cmd := newBackendCommand(ctx, qEntry, getParams().RVCTrainBin, cfgFilePath)
 	cmd.Dir = rvcTrainBinPath
 
 	var prevPercent int
@@ -215,12 +348,13 @@ func (t *RVC) Train(ctx context.Context, reqParams ReqParamsRVCTrain, audioData
 				}
 				if percent > prevPercent {
 					fmt.Print("    progress: ", percent, "%\n")
-					reqQueue.currentEntry.entry.sendProcessUpdate(ctx, processDesc, percent)
+					qEntry.sendProcessUpdate(ctx, processDesc, percent)
 					prevPercent = percent
 				}
 			}
 		}
 	})
+	qEntry.cancelProcessUpdate()
 
 	if canceled {
 		rvc.TrainCleanupOutputFiles(reqParams.Model)
@@ -234,24 +368,39 @@ func (t *RVC) Train(ctx context.Context, reqParams ReqParamsRVCTrain, audioData
 		return fmt.Errorf("RVC train error: %w", err)
 	}
 
-	reqQueue.currentEntry.entry.sendProcessUpdate(ctx, "Copying results...", -1)
+	qEntry.sendProcessUpdate(ctx, "Copying results...", -1)
 
-	dst := modelPath
-	src := path.Join(path.Dir(params.RVCTrainBin), "data", "training", "RVC", reqParams.Model, "models", fmt.Sprint("e_", reqParams.Epochs-1), modelFilename)
-	fmt.Println("  copying model file from", src, "to", dst)
-	if err = copyFile(modelPath, src); err != nil {
-		rvc.TrainCleanupOutputFiles(reqParams.Model)
-		_ = rvc.DeleteModel(reqParams.Model)
-		return fmt.Errorf("can't copy model file to RVC model path: %w", err)
-	}
-	dst = indexPath
-	src = path.Join(path.Dir(params.RVCTrainBin), "data", "training", "RVC", reqParams.Model, reqParams.Model+"_added.index")
+	// The index is copied first, as the model is listed as soon as its model file appears.
+	dst := indexPath
+	src := path.Join(path.Dir(getParams().RVCTrainBin), "data", "training", "RVC", reqParams.Model, reqParams.Model+"_added.index")
 	fmt.Println("  copying index file from", src, "to", dst)
-	if err = copyFile(dst, src); err != nil {
+	if err = copyFileAtomic(dst, src); err != nil {
 		rvc.TrainCleanupOutputFiles(reqParams.Model)
-		_ = rvc.DeleteModel(reqParams.Model)
 		return fmt.Errorf("can't copy index file to RVC model path: %w", err)
 	}
+	dst = modelPath
+	src = path.Join(path.Dir(getParams().RVCTrainBin), "data", "training", "RVC", reqParams.Model, "models", fmt.Sprint("e_", reqParams.Epochs-1), modelFilename)
+	fmt.Println("  copying model file from", src, "to", dst)
+	if err = copyFileAtomic(dst, src); err != nil {
+		rvc.TrainCleanupOutputFiles(reqParams.Model)
+		os.Remove(indexPath)
+		return fmt.Errorf("can't copy model file to RVC model path: %w", err)
+	}
+
+	return nil
+}
 
+// Copies the file to a temporary file next to the destination, then renames it, so a partially copied
+// file is never seen at the destination.
+func copyFileAtomic(dst, src string) error {
+	tmpPath := dst + ".tmp"
+	if err := copyFile(tmpPath, src); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
 	return nil
 }
@@ -3,22 +3,32 @@ from audiocraft.models import AudioGen
 from audiocraft.data.audio import audio_write
 import argparse
 import sys
+import daemon
 
-def arg_parse() -> tuple:
+def arg_parse(argv) -> tuple:
     parser = argparse.ArgumentParser()
     parser.add_argument("--description", type=str, help="description")
     parser.add_argument("--duration", type=int, default=8, help="duration in seconds")
     parser.add_argument("--output_path", type=str, help="output path")
+    parser.add_argument("--model", type=str, default="facebook/audiogen-medium", help="pretrained model")
 
-    args = parser.parse_args()
+    args = parser.parse_args(argv)
     sys.argv = sys.argv[:1]
 
     return args
 
-def main():
-    args = arg_parse()
+# Loaded models are kept when running as a daemon.
+models = {}
+
+def get_model(name):
+    if name not in models:
+        models[name] = AudioGen.get_pretrained(name)
+    return models[name]
+
+def run(argv):
+    args = arg_parse(argv)
 
-    model = AudioGen.get_pretrained('facebook/audiogen-medium')
+    model = get_model(args.model)
     model.set_generation_params(duration=args.duration)
     descriptions = [args.description]
     wav = model.generate(descriptions)
@@ -27,5 +37,11 @@ def main():
         # Will save under {idx}.wav, with loudness normalization at -14 db LUFS.
         audio_write(f'{args.output_path}/{idx}', one_wav.cpu(), model.sample_rate, strategy="loudness", loudness_compressor=True)
 
+def main():
+    if "--daemon" in sys.argv[1:]:
+        daemon.serve(run)
+    else:
+        run(sys.argv[1:])
+
 if __name__ == "__main__":
     main()
@@ -0,0 +1,68 @@
+# Helper for running a backend script as a warm daemon of the bot. The bot starts the script with the
+# --daemon argument and sends requests as JSON lines to its stdin. See the "Warm daemons" section of the
+# README for the protocol.
+import json
+import os
+import sys
+import traceback
+
+class _OutputWriter:
+    # Sends the lines printed while processing a request to the bot as output messages.
+    def __init__(self, send, req_id):
+        self.send = send
+        self.req_id = req_id
+        self.buf = ""
+
+    def write(self, s):
+        self.buf += s
+        while "\n" in self.buf:
+            line, self.buf = self.buf.split("\n", 1)
+            self.send({"id": self.req_id, "type": "output", "line": line})
+        return len(s)
+
+    def flush(self):
+        if self.buf:
+            self.send({"id": self.req_id, "type": "output", "line": self.buf})
+            self.buf = ""
+
+def serve(run):
+    """Processes the requests of the bot until stdin is closed. run(args) is called with the command
+    line arguments of each request, and should raise an exception on error."""
+    out = sys.stdout
+
+    def send(msg):
+        out.write(json.dumps(msg) + "\n")
+        out.flush()
+
+    send({"type": "ready"})
+    for line in sys.stdin:
+        try:
+            req = json.loads(line)
+        except ValueError:
+            continue
+
+        req_id = req.get("id")
+        if req.get("type") == "ping":
+            send({"id": req_id, "type": "pong"})
+            continue
+        if req.get("type") != "run":
+            send({"id": req_id, "type": "done", "exit_code": 1, "error": "unknown request type"})
+            continue
+
+        exit_code, error = 0, ""
+        writer = _OutputWriter(send, req_id)
+        sys.stdout = writer
+        try:
+            if req.get("cwd"):
+                os.chdir(req["cwd"])
+            run(req.get("args", []))
+        except SystemExit as e:
+            if e.code:
+                exit_code, error = (e.code, "") if isinstance(e.code, int) else (1, str(e.code))
+        except Exception as e:
+            traceback.print_exc(file=sys.stderr)
+            exit_code, error = 1, str(e)
+        finally:
+            writer.flush()
+            sys.stdout = out
+        send({"id": req_id, "type": "done", "exit_code": exit_code, "error": error})
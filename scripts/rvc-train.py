@@ -1,6 +1,7 @@
 import webui.ui.tabs.training.rvc as rvc
 import webui.ui.tabs.training.training.rvc_workspace as rvc_ws
 import json
+import sys
 
 # From webui/ui/tabs/training/rvc.py
 def load_workspace(name):
@@ -16,7 +17,10 @@ def create_workspace(name, vsr):
     load_workspace(name)
 
 def main():
-	with open('rvc-train-config.json') as f:
+	cfg_file = 'rvc-train-config.json'
+	if len(sys.argv) > 1:
+		cfg_file = sys.argv[1]
+	with open(cfg_file) as f:
 		args = json.load(f)
 
 	create_workspace(args['model'], "v2 40k")
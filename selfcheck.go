@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+)
+
+// At startup all backends are checked, and the commands of the backends which fail the check are
+// disabled, so they are not advertised in the help. If the probe is enabled, then the binaries are also
+// run with the --help argument, which should succeed.
+
+const backendProbeTimeout = 30 * time.Second
+
+// Backends which failed the self check, with the errors of the checks.
+var disabledBackends = make(map[ReqType]error)
+
+func checkBackendBin(bin string) error {
+	if bin == "" {
+		return fmt.Errorf("binary not set")
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return fmt.Errorf("binary " + bin + " not found or not executable")
+	}
+	if !getParams().CheckProbe {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "--help")
+	cmd.Dir = path.Dir(bin)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("probe run of " + bin + " timed out")
+		}
+		return fmt.Errorf("probe run of %s failed: %w", bin, err)
+	}
+	return nil
+}
+
+func checkBackendDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("not set")
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf(dir + " not found")
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf(dir + " is not a directory")
+	}
+	return nil
+}
+
+// Returns an error if the command of the given request type is disabled.
+func checkReqTypeEnabled(reqType ReqType) error {
+	if _, ok := disabledBackends[reqType]; ok {
+		return fmt.Errorf("the " + backendCmdPrefix + reqType.String() + " command is disabled")
+	}
+	return nil
+}
+
+// Checks all backends and returns the report of the checks, and the failed ones separately. The failed
+// backends are disabled if disable is true.
+func checkBackends(disable bool) (report, failed string) {
+	for i, b := range backends {
+		if err := b.SelfCheck(); err != nil {
+			report += "❌ " + b.Name() + ": " + err.Error() + "\n"
+			failed += backendCmdPrefix + b.Name() + ": " + err.Error() + "\n"
+			if disable {
+				disabledBackends[ReqType(i)] = err
+			}
+		} else {
+			report += "✅ " + b.Name() + "\n"
+		}
+	}
+	return
+}
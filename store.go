@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store persists the request queue on disk, so queued requests survive restarts. The input audio files of
+// the entries are kept in the audio dir next to the database, named after the store IDs of the entries.
+type Store struct {
+	db       *bolt.DB
+	audioDir string
+}
+
+var storeQueueBucket = []byte("queue")
+var storeQuotaBucket = []byte("quota")
+
+type storeQueueEntry struct {
+	TaskID        uint64          `json:"task_id"`
+	Type          ReqType         `json:"type"`
+	Message       *models.Message `json:"message"`
+	ReqMessage    *models.Message `json:"req_message"`
+	Prompt        string          `json:"prompt"`
+	Params        json.RawMessage `json:"params"`
+	AudioFilename string          `json:"audio_filename,omitempty"`
+	Running       bool            `json:"running,omitempty"`
+	Prioritized   bool            `json:"prioritized,omitempty"`
+	AddedAt       time.Time       `json:"added_at"`
+	QuotaResID    uint64          `json:"quota_res_id,omitempty"`
+}
+
+func (s *Store) Open(dbPath string) error {
+	var err error
+	s.db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("can't open store %s: %w", dbPath, err)
+	}
+
+	s.audioDir = path.Clean(dbPath + "-audio")
+	if err := os.MkdirAll(s.audioDir, 0700); err != nil {
+		return fmt.Errorf("can't create store audio dir: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(storeQueueBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(storeQuotaBucket)
+		return err
+	})
+}
+
+func (s *Store) Close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+func storeKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// Saves the given entry. Entries which haven't been stored yet get a new store ID, so loading returns
+// the entries in the order they were added.
+func (s *Store) SaveEntry(e *ReqQueueEntry) error {
+	paramsData, err := json.Marshal(e.Req.Params)
+	if err != nil {
+		return fmt.Errorf("can't encode request params: %w", err)
+	}
+
+	d, err := json.Marshal(storeQueueEntry{
+		TaskID:        e.TaskID,
+		Type:          e.Req.Type,
+		Message:       e.Message,
+		ReqMessage:    e.Req.Message,
+		Prompt:        e.Req.Prompt,
+		Params:        paramsData,
+		AudioFilename: e.AudioData.filename,
+		Running:       e.Running,
+		Prioritized:   e.Prioritized,
+		AddedAt:       e.AddedAt,
+		QuotaResID:    e.quotaRes.ID(),
+	})
+	if err != nil {
+		return fmt.Errorf("can't encode queue entry: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storeQueueBucket)
+		if e.StoreID == 0 {
+			if e.StoreID, err = b.NextSequence(); err != nil {
+				return err
+			}
+		}
+		return b.Put(storeKey(e.StoreID), d)
+	})
+}
+
+func (s *Store) getAudioPath(storeID uint64, filename string) string {
+	return path.Join(s.audioDir, fmt.Sprint(storeID)+path.Ext(filename))
+}
+
+// Writes the audio data of the entry to the audio dir. The audio data of the entry is replaced with the
+// stored file, so the entry doesn't keep the data in memory.
+func (s *Store) SaveAudio(e *ReqQueueEntry) error {
+	if e.StoreID == 0 {
+		return fmt.Errorf("entry is not stored")
+	}
+	audioPath := s.getAudioPath(e.StoreID, e.AudioData.filename)
+	if err := e.AudioData.writeFile(audioPath); err != nil {
+		os.Remove(audioPath)
+		return fmt.Errorf("can't write audio file: %w", err)
+	}
+	e.AudioData = AudioFileData{path: audioPath, filename: e.AudioData.filename}
+	return nil
+}
+
+func (s *Store) removeAudio(audioPath string) {
+	if err := os.Remove(audioPath); err != nil && !os.IsNotExist(err) {
+		fmt.Println("can't remove stored audio file:", err)
+	}
+}
+
+func (s *Store) DeleteEntry(e *ReqQueueEntry) error {
+	if e.StoreID == 0 {
+		return nil
+	}
+	s.removeAudio(s.getAudioPath(e.StoreID, e.AudioData.filename))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeQueueBucket).Delete(storeKey(e.StoreID))
+	})
+}
+
+// Returns the stored entries in the order they were added. Entries which can't be decoded (for example
+// the tool of the request has been removed from the tools config) are dropped. Audio files which don't
+// belong to any entry are removed.
+func (s *Store) LoadEntries() (entries []*ReqQueueEntry, err error) {
+	used := make(map[string]bool)
+	var invalidKeys [][]byte
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeQueueBucket).ForEach(func(k, v []byte) error {
+			var se storeQueueEntry
+			if err := json.Unmarshal(v, &se); err != nil {
+				fmt.Println("can't decode stored queue entry, dropping:", err)
+				invalidKeys = append(invalidKeys, append([]byte{}, k...))
+				return nil
+			}
+			reqParams, err := ReqParamsUnmarshal(se.Type, se.Params)
+			if err != nil {
+				fmt.Println("can't decode stored request params, dropping:", err)
+				invalidKeys = append(invalidKeys, append([]byte{}, k...))
+				return nil
+			}
+
+			e := &ReqQueueEntry{
+				TaskID:  se.TaskID,
+				StoreID: binary.BigEndian.Uint64(k),
+				Message: se.Message,
+				Req: ReqQueueReq{
+					Type:    se.Type,
+					Message: se.ReqMessage,
+					Prompt:  se.Prompt,
+					Params:  reqParams,
+				},
+				Running:     se.Running,
+				Prioritized: se.Prioritized,
+				AddedAt:     se.AddedAt,
+				quotaRes:    &QuotaReservation{id: se.QuotaResID},
+			}
+			audioPath := s.getAudioPath(e.StoreID, se.AudioFilename)
+			if _, err := os.Stat(audioPath); err == nil {
+				e.AudioData = AudioFileData{path: audioPath, filename: se.AudioFilename}
+				used[audioPath] = true
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return
+	}
+
+	s.removeUnusedAudio(used)
+	if len(invalidKeys) == 0 {
+		return
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, k := range invalidKeys {
+			if err := tx.Bucket(storeQueueBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Removes the files of the audio dir which are not in the given set of used paths.
+func (s *Store) removeUnusedAudio(used map[string]bool) {
+	dirEntries, err := os.ReadDir(s.audioDir)
+	if err != nil {
+		fmt.Println("can't read store audio dir:", err)
+		return
+	}
+	for _, d := range dirEntries {
+		if p := path.Join(s.audioDir, d.Name()); !used[p] {
+			fmt.Println("removing unused stored audio file", d.Name())
+			s.removeAudio(p)
+		}
+	}
+}
+
+// Saves the quota usage records of the given user or group.
+func (s *Store) SaveQuotaUsage(key int64, records []quotaUsageRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storeQuotaBucket)
+		if len(records) == 0 {
+			return b.Delete(storeKey(uint64(key)))
+		}
+		d, err := json.Marshal(records)
+		if err != nil {
+			return fmt.Errorf("can't encode quota usage: %w", err)
+		}
+		return b.Put(storeKey(uint64(key)), d)
+	})
+}
+
+// Returns the stored quota usage records of users and groups. Records which can't be decoded (for example
+// the tool of the request has been removed from the tools config) are dropped.
+func (s *Store) LoadQuotaUsage() (usage map[int64][]quotaUsageRecord, err error) {
+	usage = make(map[int64][]quotaUsageRecord)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeQuotaBucket).ForEach(func(k, v []byte) error {
+			var rawRecords []json.RawMessage
+			if err := json.Unmarshal(v, &rawRecords); err != nil {
+				fmt.Println("can't decode stored quota usage, dropping:", err)
+				return nil
+			}
+			key := int64(binary.BigEndian.Uint64(k))
+			for _, d := range rawRecords {
+				var r quotaUsageRecord
+				if err := json.Unmarshal(d, &r); err != nil {
+					fmt.Println("can't decode stored quota usage record, dropping:", err)
+					continue
+				}
+				usage[key] = append(usage[key], r)
+			}
+			return nil
+		})
+	})
+	return
+}
@@ -8,18 +8,44 @@ import (
 )
 
 type STT struct {
+	backendBase
 }
 
-var STTInFilePath = os.TempDir() + "/tts.wav"
-var STTOutFilePath = os.TempDir() + "/tts.txt"
+const STTInFileName = "stt.wav"
+const STTOutFileName = "stt.txt"
 
-func (t *STT) STT(ctx context.Context, reqParams ReqParamsSTT, audioData AudioFileData) (string, error) {
-	os.Remove(STTInFilePath)
-	os.Remove(STTOutFilePath)
-	defer os.Remove(STTInFilePath)
-	defer os.Remove(STTOutFilePath)
+func (t *STT) Name() string        { return "stt" }
+func (t *STT) Description() string { return "speech to text" }
+func (t *STT) NewParams() ReqParams {
+	r := &ReqParamsSTT{}
+	ReqParamsSetDefaults(r)
+	return r
+}
+func (t *STT) OutputKind() BackendOutputKind { return BackendOutputText }
+
+func (t *STT) SelfCheck() error {
+	if getParams().STTAPI.URL != "" {
+		return nil
+	}
+	return checkBackendBin(getParams().STTBin)
+}
+
+func (t *STT) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	res.Text, err = t.STT(ctx, qEntry, *qEntry.Req.Params.(*ReqParamsSTT), qEntry.AudioData)
+	return
+}
+
+func (t *STT) STT(ctx context.Context, qEntry *ReqQueueEntry, reqParams ReqParamsSTT, audioData AudioFileData) (string, error) {
+	if api := getOpenAIAPIConfig(qEntry.Req.Type, getParams().STTAPI); api.URL != "" {
+		text, err := api.Transcribe(ctx, audioData, reqParams.Language)
+		if err != nil {
+			return "", fmt.Errorf("STT error: %w", err)
+		}
+		return text, nil
+	}
 
-	err := os.WriteFile(STTInFilePath, audioData.data, 0644)
+	inFilePath := path.Join(qEntry.WorkDir, STTInFileName)
+	err := audioData.writeFile(inFilePath)
 	if err != nil {
 		return "", fmt.Errorf("can't write stt input file: %w", err)
 	}
@@ -28,15 +54,14 @@ func (t *STT) STT(ctx context.Context, reqParams ReqParamsSTT, audioData AudioFi
 	if reqParams.Language != "" {
 		args = append(args, "--language", reqParams.Language)
 	}
-	args = append(args, STTInFilePath)
-	cmd := NewCommand(ctx, params.STTBin, args...)
-	cmd.Dir = path.Dir(params.STTBin)
+	args = append(args, "--output_dir", qEntry.WorkDir, inFilePath)
+	cmd := newBackendCommand(ctx, qEntry, getParams().STTBin, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("STT error: %w: %s", err, string(output))
 	}
 
-	result, err := os.ReadFile(STTOutFilePath)
+	result, err := os.ReadFile(path.Join(qEntry.WorkDir, STTOutFileName))
 	if err != nil {
 		return "", fmt.Errorf("can't read stt output file: %w", err)
 	}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// All Telegram API calls go through TelegramAPI. Requests are rate limited using a global and per chat
+// token buckets which match Telegram's limits. Requests which fail with a retry_after error or a server
+// error are retried with backoff, and edits of the same message which are waiting to be sent are
+// coalesced, so only the last text gets sent.
+
+const telegramGlobalRate = 30           // Requests per second.
+const telegramPrivateChatRate = 1       // Requests per second.
+const telegramGroupChatRate = 20.0 / 60 // Requests per second.
+const telegramChatBurst = 3
+const telegramMaxAttempts = 4
+const telegramRetryInterval = time.Second
+const telegramMaxRetryAfter = 2 * time.Minute
+const telegramBucketIdleTimeout = 10 * time.Minute
+
+var telegramErrorRegex = regexp.MustCompile(`statusCode (\d+) for method \w+, (\{.*\})`)
+
+// TelegramError is an error response of the Telegram API.
+type TelegramError struct {
+	Code        int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// Returns the Telegram API error response from the given error returned by the bot library, or nil if
+// the error is not an API error response.
+func getTelegramError(err error) *TelegramError {
+	match := telegramErrorRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return nil
+	}
+	var tgErr TelegramError
+	if json.Unmarshal([]byte(match[2]), &tgErr) != nil {
+		tgErr.Description = match[2]
+	}
+	if tgErr.Code == 0 {
+		tgErr.Code, _ = strconv.Atoi(match[1])
+	}
+	return &tgErr
+}
+
+type tokenBucket struct {
+	rate         float64 // Tokens per second.
+	burst        float64
+	tokens       float64
+	lastRefillAt time.Time
+	blockedUntil time.Time // Set by retry_after errors.
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, lastRefillAt: time.Now()}
+}
+
+// Takes a token and returns how long the caller has to wait before it can use it. Tokens can be taken
+// in advance, so callers are served in order.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.lastRefillAt).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastRefillAt = now
+	b.tokens--
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if blocked := b.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+	return wait
+}
+
+type telegramEditKey struct {
+	chatKey   string
+	messageID int
+}
+
+type TelegramAPI struct {
+	bot *bot.Bot
+
+	mutex        sync.Mutex
+	globalBucket *tokenBucket
+	chatBuckets  map[string]*tokenBucket // Keyed by getChatKey().
+	// Edits which are waiting to be sent. Newer edits of the same message replace the params.
+	pendingEdits map[telegramEditKey]*bot.EditMessageTextParams
+}
+
+func (t *TelegramAPI) Init(b *bot.Bot) {
+	t.bot = b
+	t.globalBucket = newTokenBucket(telegramGlobalRate, telegramGlobalRate)
+	t.chatBuckets = make(map[string]*tokenBucket)
+	t.pendingEdits = make(map[telegramEditKey]*bot.EditMessageTextParams)
+}
+
+func (t *TelegramAPI) getChatBucket(chatKey string) *tokenBucket {
+	for key, b := range t.chatBuckets {
+		if time.Since(b.lastRefillAt) > telegramBucketIdleTimeout {
+			delete(t.chatBuckets, key)
+		}
+	}
+	b := t.chatBuckets[chatKey]
+	if b == nil {
+		// Group chat IDs are negative, and only groups and channels have usernames which can be used as chat IDs.
+		if strings.HasPrefix(chatKey, "-") || strings.HasPrefix(chatKey, "@") {
+			b = newTokenBucket(telegramGroupChatRate, telegramChatBurst)
+		} else {
+			b = newTokenBucket(telegramPrivateChatRate, telegramChatBurst)
+		}
+		t.chatBuckets[chatKey] = b
+	}
+	return b
+}
+
+// Waits until a request can be sent to the given chat. An empty chat key means the request is not sent to
+// a chat.
+func (t *TelegramAPI) wait(ctx context.Context, chatKey string) error {
+	t.mutex.Lock()
+	now := time.Now()
+	wait := t.globalBucket.take(now)
+	if chatKey != "" {
+		if chatWait := t.getChatBucket(chatKey).take(now); chatWait > wait {
+			wait = chatWait
+		}
+	}
+	t.mutex.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// Blocks requests to the given chat (or all requests if the chat key is empty) for the given duration.
+func (t *TelegramAPI) block(chatKey string, d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	b := t.globalBucket
+	if chatKey != "" {
+		b = t.getChatBucket(chatKey)
+	}
+	if until := time.Now().Add(d); until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+// Calls the given function with rate limiting for the given chat. The function is called again if it
+// fails with a retry_after or a server error, so it should create the request again, for example reopen
+// the files to upload.
+func (t *TelegramAPI) Do(ctx context.Context, chatID any, f func(b *bot.Bot) error) error {
+	chatKey := getChatKey(chatID)
+	for attempt := 1; ; attempt++ {
+		if err := t.wait(ctx, chatKey); err != nil {
+			return err
+		}
+		err := f(t.bot)
+		if err == nil {
+			return nil
+		}
+
+		tgErr := getTelegramError(err)
+		if tgErr == nil {
+			return err
+		}
+		var delay time.Duration
+		if tgErr.Parameters.RetryAfter > 0 {
+			delay = time.Duration(tgErr.Parameters.RetryAfter) * time.Second
+			t.block(chatKey, delay)
+			if delay > telegramMaxRetryAfter {
+				return err
+			}
+		} else if tgErr.Code >= 500 {
+			delay = telegramRetryInterval << (attempt - 1)
+		} else {
+			return err
+		}
+		if attempt == telegramMaxAttempts {
+			return err
+		}
+
+		fmt.Println("  telegram api error, retrying after", delay, ":", tgErr.Description)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Returns the key of the rate limit bucket of the given chat. Chat IDs can be numeric IDs, or usernames
+// of groups and channels (like "@channel"). Returns an empty string for chat ID 0, which means the request
+// is not sent to a chat.
+func getChatKey(chatID any) string {
+	switch v := chatID.(type) {
+	case int64:
+		if v != 0 {
+			return strconv.FormatInt(v, 10)
+		}
+	case int:
+		if v != 0 {
+			return strconv.Itoa(v)
+		}
+	case string:
+		return v
+	}
+	return ""
+}
+
+func (t *TelegramAPI) SendMessage(ctx context.Context, params *bot.SendMessageParams) (msg *models.Message, err error) {
+	err = t.Do(ctx, params.ChatID, func(b *bot.Bot) (err error) {
+		msg, err = b.SendMessage(ctx, params)
+		return
+	})
+	return
+}
+
+// Sends the edit of the message. If an edit of the same message is already waiting to be sent, then that
+// edit is sent with the given params instead, and this function returns without waiting.
+func (t *TelegramAPI) EditMessageText(ctx context.Context, params *bot.EditMessageTextParams) error {
+	key := telegramEditKey{chatKey: getChatKey(params.ChatID), messageID: params.MessageID}
+
+	t.mutex.Lock()
+	if _, ok := t.pendingEdits[key]; ok {
+		t.pendingEdits[key] = params
+		t.mutex.Unlock()
+		return nil
+	}
+	t.pendingEdits[key] = params
+	t.mutex.Unlock()
+
+	var sent bool
+	err := t.Do(ctx, params.ChatID, func(b *bot.Bot) error {
+		if !sent {
+			// Taking the params of the newest edit. Edits arriving from now on are sent separately.
+			t.mutex.Lock()
+			params = t.pendingEdits[key]
+			delete(t.pendingEdits, key)
+			t.mutex.Unlock()
+			sent = true
+		}
+		_, err := b.EditMessageText(ctx, params)
+		return err
+	})
+	if !sent {
+		t.mutex.Lock()
+		delete(t.pendingEdits, key)
+		t.mutex.Unlock()
+	}
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+func (t *TelegramAPI) AnswerCallbackQuery(ctx context.Context, params *bot.AnswerCallbackQueryParams) error {
+	return t.Do(ctx, 0, func(b *bot.Bot) error {
+		_, err := b.AnswerCallbackQuery(ctx, params)
+		return err
+	})
+}
+
+func (t *TelegramAPI) GetFile(ctx context.Context, params *bot.GetFileParams) (f *models.File, err error) {
+	err = t.Do(ctx, 0, func(b *bot.Bot) (err error) {
+		f, err = b.GetFile(ctx, params)
+		return
+	})
+	return
+}
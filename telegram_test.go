@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+)
+
+// Returns a TelegramAPI which sends the requests of the bot library to a stand-in server.
+func newTestTelegramAPI(t *testing.T, handler http.HandlerFunc) *TelegramAPI {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	b, err := bot.New("test-token", bot.WithServerURL(server.URL), bot.WithSkipGetMe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var api TelegramAPI
+	api.Init(b)
+	return &api
+}
+
+func TestGetTelegramError(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		body           string
+		wantNil        bool
+		wantCode       int
+		wantRetryAfter int
+		wantDesc       string
+	}{
+		{name: "retry after", status: http.StatusTooManyRequests,
+			body:     `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 35","parameters":{"retry_after":35}}`,
+			wantCode: 429, wantRetryAfter: 35, wantDesc: "Too Many Requests: retry after 35"},
+		{name: "bad request", status: http.StatusBadRequest,
+			body:     `{"ok":false,"error_code":400,"description":"Bad Request: message is not modified"}`,
+			wantCode: 400, wantDesc: "Bad Request: message is not modified"},
+		{name: "server error without json", status: http.StatusBadGateway, body: `{bad gateway}`,
+			wantCode: 502, wantDesc: "{bad gateway}"},
+		{name: "not an api error response", status: http.StatusOK, body: `{"ok":false,"description":"something"}`,
+			wantNil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestTelegramAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+			_, err := api.bot.SendMessage(context.Background(), &bot.SendMessageParams{ChatID: 1, Text: "test"})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			tgErr := getTelegramError(err)
+			if tt.wantNil {
+				if tgErr != nil {
+					t.Fatalf("got %+v from %q, want nil", tgErr, err)
+				}
+				return
+			}
+			if tgErr == nil {
+				t.Fatalf("got nil from %q", err)
+			}
+			if tgErr.Code != tt.wantCode || tgErr.Parameters.RetryAfter != tt.wantRetryAfter || tgErr.Description != tt.wantDesc {
+				t.Fatalf("got %+v from %q", tgErr, err)
+			}
+		})
+	}
+
+	if tgErr := getTelegramError(errors.New("error do request for method sendMessage, connection refused")); tgErr != nil {
+		t.Fatalf("got %+v for a network error", tgErr)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	type take struct {
+		at   time.Duration // Since the creation of the bucket.
+		want time.Duration
+	}
+	tests := []struct {
+		name         string
+		rate         float64
+		blockedUntil time.Duration
+		takes        []take
+	}{
+		{name: "burst", rate: telegramPrivateChatRate, takes: []take{
+			{0, 0}, {0, 0}, {0, 0}, {0, time.Second}, {0, 2 * time.Second},
+		}},
+		{name: "refill", rate: telegramPrivateChatRate, takes: []take{
+			{0, 0}, {0, 0}, {0, 0}, {0, time.Second},
+			{2 * time.Second, 0},
+			{10 * time.Second, 0}, {10 * time.Second, 0}, {10 * time.Second, 0}, {10 * time.Second, time.Second},
+		}},
+		{name: "group rate", rate: telegramGroupChatRate, takes: []take{
+			{0, 0}, {0, 0}, {0, 0}, {0, 3 * time.Second}, {time.Second, 5 * time.Second},
+		}},
+		{name: "blocked", rate: telegramPrivateChatRate, blockedUntil: 30 * time.Second, takes: []take{
+			{0, 30 * time.Second}, {10 * time.Second, 20 * time.Second}, {30 * time.Second, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			b := newTokenBucket(tt.rate, telegramChatBurst)
+			b.lastRefillAt = start
+			if tt.blockedUntil > 0 {
+				b.blockedUntil = start.Add(tt.blockedUntil)
+			}
+			for i, tk := range tt.takes {
+				if got := b.take(start.Add(tk.at)).Round(time.Millisecond); got != tk.want {
+					t.Fatalf("take %d at %v: got wait %v, want %v", i, tk.at, got, tk.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTelegramEditCoalescing(t *testing.T) {
+	var mutex sync.Mutex
+	var texts []string
+	api := newTestTelegramAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+			return
+		}
+		mutex.Lock()
+		texts = append(texts, r.FormValue("text"))
+		mutex.Unlock()
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":10,"date":0,"chat":{"id":1,"type":"private"}}}`))
+	})
+
+	// Blocking the chat, so the first edit waits and the following edits replace its params.
+	api.block(getChatKey(int64(1)), 200*time.Millisecond)
+	edit := func(text string) error {
+		return api.EditMessageText(context.Background(), &bot.EditMessageTextParams{ChatID: int64(1), MessageID: 10, Text: text})
+	}
+	errChan := make(chan error)
+	go func() { errChan <- edit("first") }()
+	for {
+		api.mutex.Lock()
+		pending := len(api.pendingEdits)
+		api.mutex.Unlock()
+		if pending > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, text := range []string{"second", "third"} {
+		if err := edit(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	// Edits after the pending edit has been sent are sent separately.
+	if err := edit("fourth"); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(texts) != 2 || texts[0] != "third" || texts[1] != "fourth" {
+		t.Fatalf("got edits %q", texts)
+	}
+}
+
+func TestTelegramEditNotModified(t *testing.T) {
+	api := newTestTelegramAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: message is not modified"}`))
+	})
+	err := api.EditMessageText(context.Background(), &bot.EditMessageTextParams{ChatID: int64(1), MessageID: 10, Text: "same"})
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+}
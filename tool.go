@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// External tools can be added as new commands using a JSON config file, without changing the code.
+// See tools.json-example for an example.
+
+type ToolParamConfig struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+	Type    string   `json:"type"` // string, int, float or bool.
+	Desc    string   `json:"desc"`
+	Default any      `json:"default"`
+	Min     *float64 `json:"min"`
+	Max     *float64 `json:"max"`
+	Enum    []string `json:"enum"`
+	// Label of the value in the request info, the param is not shown if it's empty.
+	Label string `json:"label"`
+	// Arguments added to the command line if the param has a value (bool params if they are given).
+	// {value} is replaced with the value of the param.
+	Args []string `json:"args"`
+}
+
+type ToolConfig struct {
+	Name        string `json:"name"` // The command will be "aai" + name.
+	Description string `json:"description"`
+	Bin         string `json:"bin"`
+	// Command line arguments. Placeholders: {input} (input audio file path), {output} (suggested output
+	// file path), {output_dir} (the work directory), {prompt}, and {[param name]} for the params. The
+	// "{params}" argument is replaced with the args of the params, which are added to the end if it's
+	// not present.
+	Args   []string          `json:"args"`
+	Params []ToolParamConfig `json:"params"`
+	Prompt string            `json:"prompt"` // none (default), optional or required.
+	Input  bool              `json:"input"`  // True if the tool needs an input audio file.
+	// Regexp matching the progress percent in the tool's output with its first group.
+	ProgressRegex string `json:"progress_regex"`
+	// Output files in the work directory, the default is "output*".
+	OutputGlob string `json:"output_glob"`
+	// voice (default), audio or text. If the output is text and there's no matching output file, then
+	// the output of the tool is used.
+	Output  string `json:"output"`
+	Timeout string `json:"timeout"`
+}
+
+type ToolsConfig struct {
+	Tools    []ToolConfig    `json:"tools"`
+	Profiles []ProfileConfig `json:"profiles"`
+}
+
+const toolInFileName = "input"
+const toolOutFileName = "output.wav"
+const toolDefaultOutputGlob = "output*"
+
+var toolNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Commands which are not backends, tools can't use these names.
+var reservedCmdNames = []string{"clipboard", "queue", "weight", "cancel", "help"}
+
+// ToolBackend runs an external tool defined in the tools config file.
+type ToolBackend struct {
+	backendBase
+
+	cfg           ToolConfig
+	progressRegex *regexp.Regexp
+	outputKind    BackendOutputKind
+	timeout       time.Duration
+	defaults      []any // Default values of the params converted to the param types.
+}
+
+type ReqParamsToolValue struct {
+	String string  `json:"s,omitempty"`
+	Int    int     `json:"i,omitempty"`
+	Float  float64 `json:"f,omitempty"`
+	Bool   bool    `json:"b,omitempty"`
+	Set    bool    `json:"set,omitempty"`
+}
+
+type ReqParamsTool struct {
+	ReqParamsCommon
+
+	Values map[string]*ReqParamsToolValue
+
+	tool *ToolBackend
+}
+
+func (r *ReqParamsTool) value(name string) *ReqParamsToolValue {
+	if r.Values == nil {
+		r.Values = make(map[string]*ReqParamsToolValue)
+	}
+	v, ok := r.Values[name]
+	if !ok {
+		v = &ReqParamsToolValue{}
+		r.Values[name] = v
+	}
+	return v
+}
+
+func (r *ReqParamsTool) paramDefs() (defs []ReqParamDef) {
+	for i, p := range r.tool.cfg.Params {
+		v := r.value(p.Name)
+		d := ReqParamDef{
+			Name:    p.Name,
+			Aliases: p.Aliases,
+			Desc:    p.Desc,
+			Default: r.tool.defaults[i],
+			Enum:    p.Enum,
+			Label:   p.Label,
+		}
+		// Params without a default value are only used if they are given.
+		if d.Default == nil {
+			d.Set = &v.Set
+		}
+		switch p.Type {
+		case "int":
+			d.Value = &v.Int
+		case "float":
+			d.Value = &v.Float
+		case "bool":
+			d.Value = &v.Bool
+		default:
+			d.Value = &v.String
+		}
+		if p.Min != nil || p.Max != nil {
+			d.Min, d.Max = math.Inf(-1), math.Inf(1)
+			if p.Min != nil {
+				d.Min = *p.Min
+			}
+			if p.Max != nil {
+				d.Max = *p.Max
+			}
+		}
+		defs = append(defs, d)
+	}
+	return
+}
+
+func (r *ReqParamsTool) String() string { return reqParamsString(r) }
+
+func (t *ToolBackend) Name() string        { return t.cfg.Name }
+func (t *ToolBackend) Description() string { return t.cfg.Description }
+
+func (t *ToolBackend) PromptUsage() string {
+	switch t.cfg.Prompt {
+	case "required":
+		return "[prompt]"
+	case "optional":
+		return "(prompt)"
+	}
+	return ""
+}
+
+func (t *ToolBackend) NeedsAudio(reqParams ReqParams) bool { return t.cfg.Input }
+func (t *ToolBackend) OutputKind() BackendOutputKind       { return t.outputKind }
+
+func (t *ToolBackend) NewParams() ReqParams {
+	r := &ReqParamsTool{tool: t}
+	ReqParamsSetDefaults(r)
+	return r
+}
+
+func (t *ToolBackend) Prepare(req *ReqQueueReq) error {
+	if t.cfg.Prompt == "required" && req.Prompt == "" {
+		return fmt.Errorf("empty prompt")
+	}
+	return nil
+}
+
+// Returns the command line arguments of the params which have a value.
+func (t *ToolBackend) getParamArgs(reqParams *ReqParamsTool) (args []string) {
+	// The param defs are in the order of the params in the config.
+	for i, d := range reqParams.paramDefs() {
+		p := t.cfg.Params[i]
+		if d.Set != nil && !*d.Set {
+			continue
+		}
+		if v, ok := d.Value.(*bool); ok && !*v {
+			continue
+		}
+		for _, arg := range p.Args {
+			args = append(args, strings.ReplaceAll(arg, "{value}", d.valueString()))
+		}
+	}
+	return
+}
+
+func (t *ToolBackend) getArgs(reqParams *ReqParamsTool, prompt, inFilePath, outFilePath, workDir string) (args []string) {
+	replacements := []string{"{input}", inFilePath, "{output}", outFilePath, "{output_dir}", workDir, "{prompt}", prompt}
+	for _, d := range reqParams.paramDefs() {
+		v := d.valueString()
+		if b, ok := d.Value.(*bool); ok {
+			v = strconv.FormatBool(*b)
+		}
+		replacements = append(replacements, "{"+d.Name+"}", v)
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	paramArgs := t.getParamArgs(reqParams)
+	paramArgsAdded := false
+	for _, arg := range t.cfg.Args {
+		if arg == "{params}" {
+			args = append(args, paramArgs...)
+			paramArgsAdded = true
+			continue
+		}
+		args = append(args, replacer.Replace(arg))
+	}
+	if !paramArgsAdded {
+		args = append(args, paramArgs...)
+	}
+	return
+}
+
+// Returns the output files in the work directory, without the input file.
+func (t *ToolBackend) getOutputFiles(workDir, inFilePath string) ([]string, error) {
+	glob := t.cfg.OutputGlob
+	if glob == "" {
+		glob = toolDefaultOutputGlob
+	}
+	matches, err := filepath.Glob(path.Join(workDir, glob))
+	if err != nil {
+		return nil, fmt.Errorf("invalid output glob: %w", err)
+	}
+	var files []string
+	for _, m := range matches {
+		if m == inFilePath {
+			continue
+		}
+		if stat, err := os.Stat(m); err != nil || !stat.Mode().IsRegular() || stat.Size() == 0 {
+			continue
+		}
+		files = append(files, m)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (t *ToolBackend) SelfCheck() error { return checkBackendBin(t.cfg.Bin) }
+
+func (t *ToolBackend) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	reqParams := qEntry.Req.Params.(*ReqParamsTool)
+
+	var inFilePath string
+	if t.cfg.Input {
+		ext := path.Ext(qEntry.AudioData.filename)
+		if ext == "" {
+			ext = ".wav"
+		}
+		inFilePath = path.Join(qEntry.WorkDir, toolInFileName+ext)
+		if err = qEntry.AudioData.writeFile(inFilePath); err != nil {
+			return res, fmt.Errorf("can't write %s input file: %w", t.cfg.Name, err)
+		}
+	}
+	outFilePath := path.Join(qEntry.WorkDir, toolOutFileName)
+
+	cmd := newBackendCommand(ctx, qEntry, t.cfg.Bin, t.getArgs(reqParams, qEntry.Req.Prompt, inFilePath, outFilePath, qEntry.WorkDir)...)
+
+	var outputLines []string
+	canceled, err := cmd.RunAndProcessOutput(func(line string) {
+		if t.progressRegex != nil {
+			match := t.progressRegex.FindStringSubmatch(line)
+			if len(match) > 1 {
+				if percent, convErr := strconv.ParseFloat(match[1], 64); convErr == nil {
+					percent = math.Min(math.Max(percent, 0), 100)
+					fmt.Print("    progress: ", int(percent), "%\n")
+					qEntry.sendProcessUpdate(ctx, "", int(percent))
+					return
+				}
+			}
+		}
+		if line != "" {
+			outputLines = append(outputLines, line)
+		}
+	})
+	qEntry.cancelProcessUpdate()
+	if canceled {
+		return res, nil
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		return res, fmt.Errorf("%s error: %w: %s", t.cfg.Name, err, strings.Join(outputLines, "\n"))
+	}
+
+	files, err := t.getOutputFiles(qEntry.WorkDir, inFilePath)
+	if err != nil {
+		return res, err
+	}
+
+	switch t.outputKind {
+	case BackendOutputText:
+		if len(files) == 0 {
+			res.Text = strings.Join(outputLines, "\n")
+			break
+		}
+		d, err := os.ReadFile(files[0])
+		if err != nil {
+			return res, fmt.Errorf("can't read %s output file: %w", t.cfg.Name, err)
+		}
+		res.Text = string(d)
+	case BackendOutputVoice:
+		if len(files) == 0 {
+			return res, fmt.Errorf("output file not found")
+		}
+		res.Voice, err = converter.ConvertToOpus(ctx, files[0])
+	case BackendOutputAudio:
+		for _, f := range files {
+			var r io.ReadCloser
+			r, err = converter.ConvertToMP3(ctx, f)
+			if err != nil {
+				for i := range res.Audio {
+					res.Audio[i].r.Close()
+				}
+				return BackendResult{}, err
+			}
+			res.Audio = append(res.Audio, UploadFileData{
+				r:        r,
+				filename: fileNameWithoutExt(path.Base(f)) + ".mp3",
+			})
+		}
+	}
+	return
+}
+
+// Converts the default value from the JSON config to the type of the param.
+func (p *ToolParamConfig) getDefault() (any, error) {
+	if p.Default == nil {
+		return nil, nil
+	}
+	switch p.Type {
+	case "int":
+		if f, ok := p.Default.(float64); ok && f == math.Trunc(f) {
+			return int(f), nil
+		}
+	case "float":
+		if f, ok := p.Default.(float64); ok {
+			return f, nil
+		}
+	case "bool":
+		if b, ok := p.Default.(bool); ok {
+			return b, nil
+		}
+	case "string", "":
+		if s, ok := p.Default.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid default value for param %s", p.Name)
+}
+
+func newToolBackend(cfg ToolConfig) (*ToolBackend, error) {
+	if !toolNameRegex.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("invalid tool name: %s", cfg.Name)
+	}
+	if _, err := ReqTypeFromName(cfg.Name); err == nil {
+		return nil, fmt.Errorf("tool name %s is already used", cfg.Name)
+	}
+	if slices.Contains(reservedCmdNames, cfg.Name) || strings.HasSuffix(cfg.Name, "-models") {
+		return nil, fmt.Errorf("tool name %s is reserved", cfg.Name)
+	}
+	if cfg.Bin == "" {
+		return nil, fmt.Errorf("tool %s has no bin set", cfg.Name)
+	}
+
+	t := &ToolBackend{cfg: cfg}
+
+	var err error
+	if cfg.ProgressRegex != "" {
+		if t.progressRegex, err = regexp.Compile(cfg.ProgressRegex); err != nil {
+			return nil, fmt.Errorf("tool %s has invalid progress regex: %w", cfg.Name, err)
+		}
+	}
+	if cfg.OutputGlob != "" {
+		if _, err := filepath.Match(cfg.OutputGlob, ""); err != nil {
+			return nil, fmt.Errorf("tool %s has invalid output glob: %w", cfg.Name, err)
+		}
+	}
+	switch cfg.Output {
+	case "voice", "":
+		t.outputKind = BackendOutputVoice
+	case "audio":
+		t.outputKind = BackendOutputAudio
+	case "text":
+		t.outputKind = BackendOutputText
+	default:
+		return nil, fmt.Errorf("tool %s has invalid output: %s", cfg.Name, cfg.Output)
+	}
+	switch cfg.Prompt {
+	case "none", "", "optional", "required":
+	default:
+		return nil, fmt.Errorf("tool %s has invalid prompt setting: %s", cfg.Name, cfg.Prompt)
+	}
+	if cfg.Timeout != "" {
+		if t.timeout, err = time.ParseDuration(cfg.Timeout); err != nil || t.timeout <= 0 {
+			return nil, fmt.Errorf("tool %s has invalid timeout: %s", cfg.Name, cfg.Timeout)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, p := range (&ReqParamsCommon{}).commonParamDefs() {
+		names[p.Name] = true
+	}
+	for i := range cfg.Params {
+		p := &cfg.Params[i]
+		switch p.Type {
+		case "string", "", "int", "float", "bool":
+		default:
+			return nil, fmt.Errorf("tool %s param %s has invalid type: %s", cfg.Name, p.Name, p.Type)
+		}
+		for _, n := range append([]string{p.Name}, p.Aliases...) {
+			if !toolNameRegex.MatchString(n) || names[n] {
+				return nil, fmt.Errorf("tool %s has invalid or duplicate param name: %s", cfg.Name, n)
+			}
+			names[n] = true
+		}
+		d, err := p.getDefault()
+		if err != nil {
+			return nil, fmt.Errorf("tool %s: %w", cfg.Name, err)
+		}
+		t.defaults = append(t.defaults, d)
+	}
+	return t, nil
+}
+
+// Loads the tools config file and registers the tools and profiles as backends.
+func loadToolsConfig(configPath string) error {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return fmt.Errorf("can't open tools config: %w", err)
+	}
+	defer f.Close()
+
+	var cfg ToolsConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return fmt.Errorf("can't parse tools config %s: %w", configPath, err)
+	}
+
+	for _, toolCfg := range cfg.Tools {
+		t, err := newToolBackend(toolCfg)
+		if err != nil {
+			return fmt.Errorf("tools config: %w", err)
+		}
+		backends = append(backends, t)
+		fmt.Println("loaded tool", t.Name())
+	}
+	// Profiles are loaded after the tools, so tools can also have profiles.
+	for _, profileCfg := range cfg.Profiles {
+		p, err := newProfileBackend(profileCfg)
+		if err != nil {
+			return fmt.Errorf("tools config: %w", err)
+		}
+		backends = append(backends, p)
+		fmt.Println("loaded profile", p.Name())
+	}
+	return nil
+}
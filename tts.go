@@ -13,14 +13,57 @@ import (
 )
 
 type TTS struct {
+	backendBase
 }
 
-var TTSOutFilePath = os.TempDir() + "/tts.wav"
+const TTSOutFileName = "tts.wav"
+
+func (t *TTS) Name() string                        { return "tts" }
+func (t *TTS) Description() string                 { return "text to speech" }
+func (t *TTS) PromptUsage() string                 { return "[prompt]" }
+func (t *TTS) NeedsAudio(reqParams ReqParams) bool { return false }
+
+func (t *TTS) NewParams() ReqParams {
+	r := &ReqParamsTTS{}
+	ReqParamsSetDefaults(r)
+	return r
+}
+
+func (t *TTS) Prepare(req *ReqQueueReq) error {
+	if req.Prompt == "" {
+		return fmt.Errorf("empty prompt")
+	}
+	reqParams := req.Params.(*ReqParamsTTS)
+	if api := getOpenAIAPIConfig(req.Type, getParams().TTSAPI); api.URL != "" {
+		// The model of the API is set in the config.
+		if reqParams.Model != "" && reqParams.Model != getParams().TTSDefaultModel {
+			return fmt.Errorf("the model can't be selected when using the speech API")
+		}
+		reqParams.Model = api.Model
+		return nil
+	}
+	if reqParams.Model == "" {
+		return fmt.Errorf("no model given")
+	}
+	return nil
+}
+
+func (t *TTS) SelfCheck() error {
+	if getParams().TTSAPI.URL != "" {
+		return nil
+	}
+	return checkBackendBin(getParams().TTSBin)
+}
+
+func (t *TTS) Run(ctx context.Context, qEntry *ReqQueueEntry) (res BackendResult, err error) {
+	res.Voice, err = t.TTS(ctx, qEntry, *qEntry.Req.Params.(*ReqParamsTTS), qEntry.Req.Prompt)
+	return
+}
 
 func (t *TTS) ListModels(ctx context.Context, msg *models.Message) {
 	msg = sendReplyToMessage(ctx, msg, "👅 Querying...")
-	cmd := exec.Command(params.TTSBin, "--list_models")
-	cmd.Dir = path.Dir(params.TTSBin)
+	cmd := exec.Command(getParams().TTSBin, "--list_models")
+	cmd.Dir = path.Dir(getParams().TTSBin)
 	output, err := cmd.Output()
 	if err != nil {
 		sendReplyToMessage(ctx, msg, errorStr+": can't list models: "+err.Error())
@@ -29,33 +72,28 @@ func (t *TTS) ListModels(ctx context.Context, msg *models.Message) {
 	_ = editReplyToMessage(ctx, msg, "👅 Available models:\n\n"+string(output))
 }
 
-func (t *TTS) CleanupOutputFiles() {
-	os.Remove(TTSOutFilePath)
-}
+func (t *TTS) TTS(ctx context.Context, qEntry *ReqQueueEntry, reqParams ReqParamsTTS, prompt string) (io.ReadCloser, error) {
+	if api := getOpenAIAPIConfig(qEntry.Req.Type, getParams().TTSAPI); api.URL != "" {
+		outFilePath := path.Join(qEntry.WorkDir, openAITTSOutFileName)
+		if err := api.Speech(ctx, prompt, reqParams.Voice, outFilePath); err != nil {
+			return nil, fmt.Errorf("TTS error: %w", err)
+		}
+		return converter.ConvertToOpus(ctx, outFilePath)
+	}
 
-func (t *TTS) TTS(ctx context.Context, reqParams ReqParamsTTS, prompt string) (io.ReadCloser, error) {
-	t.CleanupOutputFiles()
+	outFilePath := path.Join(qEntry.WorkDir, TTSOutFileName)
 
-	cmd := NewCommand(ctx, params.TTSBin, "--model_name", reqParams.Model, "--out_path", TTSOutFilePath)
-	cmd.Dir = path.Dir(params.TTSBin)
+	cmd := newBackendCommand(ctx, qEntry, getParams().TTSBin, "--model_name", reqParams.Model, "--out_path", outFilePath)
 	cmd.Stdin = strings.NewReader(prompt)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		t.CleanupOutputFiles()
 		return nil, fmt.Errorf("TTS error: %w: %s", err, string(output))
 	}
 
 	// Check output .wav file
-	if stat, err := os.Stat(TTSOutFilePath); os.IsNotExist(err) || stat.Size() == 0 {
-		t.CleanupOutputFiles()
-		return nil, fmt.Errorf("output file not found: %s", TTSOutFilePath)
-	}
-
-	r, err := converter.ConvertToOpus(ctx, TTSOutFilePath)
-	if err != nil {
-		t.CleanupOutputFiles()
-		return nil, err
+	if stat, err := os.Stat(outFilePath); os.IsNotExist(err) || stat.Size() == 0 {
+		return nil, fmt.Errorf("output file not found: %s", outFilePath)
 	}
 
-	return r, nil
+	return converter.ConvertToOpus(ctx, outFilePath)
 }
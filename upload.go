@@ -4,56 +4,178 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 )
 
+const defaultMaxUploadSizeMB = 50
+const localBotAPIMaxUploadSizeMB = 2000
+
 type Upload struct {
 }
 
-func (u *Upload) Voice(ctx context.Context, qEntry *ReqQueueEntry, r io.ReadCloser, retryAllowed bool) error {
-	defer r.Close()
+type UploadFileData struct {
+	r        io.ReadCloser
+	filename string
+}
 
-	fmt.Println("  uploading...")
-	qEntry.sendUpdate(ctx, uploadingStr)
+// An upload file which has been written to the work dir.
+type uploadFile struct {
+	path     string
+	filename string
+	size     int64
+}
 
-	params := &bot.SendVoiceParams{
-		ChatID:           qEntry.Message.Chat.ID,
-		ReplyToMessageID: qEntry.Message.ID,
-		Voice: &models.InputFileUpload{
-			Filename: "tts-" + fmt.Sprint(qEntry.TaskID) + ".ogg",
-			Data:     r,
-		},
-		// Caption: qEntry.Req.Message.Text,
+func getMaxUploadSize() int64 {
+	if getParams().MaxUploadSizeMB > 0 {
+		return int64(getParams().MaxUploadSizeMB) * 1024 * 1024
+	}
+	if getBotAPIURL() != defaultBotAPIURL {
+		return localBotAPIMaxUploadSizeMB * 1024 * 1024
 	}
-	_, err := telegramBot.SendVoice(ctx, params)
+	return defaultMaxUploadSizeMB * 1024 * 1024
+}
+
+func isTooLargeError(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "too large")
+}
+
+// Writes the data to a file in the work dir, so its size is known and it can be read again if the upload
+// has to be retried.
+func (u *Upload) spool(qEntry *ReqQueueEntry, r io.ReadCloser, index int, filename string) (f uploadFile, err error) {
+	defer r.Close()
+
+	f.filename = filename
+	f.path = path.Join(qEntry.WorkDir, fmt.Sprint("upload-", index, path.Ext(filename)))
+	file, err := os.Create(f.path)
 	if err != nil {
-		fmt.Println("  send error:", err)
+		return f, fmt.Errorf("can't create upload file: %w", err)
+	}
+	defer file.Close()
+	if f.size, err = io.Copy(file, r); err != nil {
+		return f, fmt.Errorf("can't write upload file: %w", err)
+	}
+	return f, nil
+}
 
-		if !retryAllowed {
-			return fmt.Errorf("send error: %w", err)
+// Moves the files to the file server and sends their download links. Used for files which are too large
+// to be uploaded to Telegram.
+func (u *Upload) sendLinks(ctx context.Context, qEntry *ReqQueueEntry, files []uploadFile) error {
+	var totalSize int64
+	for _, f := range files {
+		totalSize += f.size
+	}
+	if !fileServer.Enabled() {
+		return fmt.Errorf("result is too large to upload (%.1f MB)", float64(totalSize)/1024/1024)
+	}
+
+	fmt.Println("  result is too large to upload, sending links...")
+	s := "📦 The result is too large for Telegram, you can download it from these links:\n"
+	var expiresAt time.Time
+	for _, f := range files {
+		var link string
+		var err error
+		link, expiresAt, err = fileServer.Add(f.path, f.filename)
+		if err != nil {
+			return err
 		}
+		s += fmt.Sprintf("\n%s (%.1f MB): %s\n", f.filename, float64(f.size)/1024/1024, link)
+	}
+	s += "\nThe links expire in " + time.Until(expiresAt).Round(time.Minute).String() + "."
+	if sendReplyToMessage(ctx, qEntry.Message, s) == nil {
+		return fmt.Errorf("can't send download links")
+	}
+	return nil
+}
 
-		retryAfter := qEntry.checkWaitError(err)
-		if retryAfter > 0 {
-			fmt.Println("  retrying after", retryAfter, "...")
-			time.Sleep(retryAfter)
-			return u.Voice(ctx, qEntry, r, false)
+func (u *Upload) uploadVoice(ctx context.Context, qEntry *ReqQueueEntry, f uploadFile) error {
+	// The file is opened again on every attempt, as a failed upload may have read it already.
+	err := telegramAPI.Do(ctx, qEntry.Message.Chat.ID, func(b *bot.Bot) error {
+		r, err := os.Open(f.path)
+		if err != nil {
+			return fmt.Errorf("can't open upload file: %w", err)
+		}
+		defer r.Close()
+
+		params := &bot.SendVoiceParams{
+			ChatID:           qEntry.Message.Chat.ID,
+			ReplyToMessageID: qEntry.Message.ID,
+			Voice: &models.InputFileUpload{
+				Filename: f.filename,
+				Data:     r,
+			},
+			// Caption: qEntry.Req.Message.Text,
 		}
+		_, err = b.SendVoice(ctx, params)
 		return err
+	})
+	if err != nil {
+		fmt.Println("  send error:", err)
+
+		if isTooLargeError(err) {
+			return u.sendLinks(ctx, qEntry, []uploadFile{f})
+		}
+		return fmt.Errorf("send error: %w", err)
 	}
 
 	return nil
 }
 
-type UploadFileData struct {
-	r        io.ReadCloser
-	filename string
+func (u *Upload) Voice(ctx context.Context, qEntry *ReqQueueEntry, r io.ReadCloser) error {
+	fmt.Println("  uploading...")
+	qEntry.sendUpdate(ctx, uploadingStr)
+
+	f, err := u.spool(qEntry, r, 0, "tts-"+fmt.Sprint(qEntry.TaskID)+".ogg")
+	if err != nil {
+		return err
+	}
+	if f.size > getMaxUploadSize() {
+		return u.sendLinks(ctx, qEntry, []uploadFile{f})
+	}
+	return u.uploadVoice(ctx, qEntry, f)
+}
+
+func (u *Upload) uploadAudio(ctx context.Context, qEntry *ReqQueueEntry, files []uploadFile) error {
+	err := telegramAPI.Do(ctx, qEntry.Message.Chat.ID, func(b *bot.Bot) error {
+		var media []models.InputMedia
+		for _, f := range files {
+			r, err := os.Open(f.path)
+			if err != nil {
+				return fmt.Errorf("can't open upload file: %w", err)
+			}
+			defer r.Close()
+
+			media = append(media, &models.InputMediaAudio{
+				Media:           "attach://" + f.filename,
+				MediaAttachment: r,
+			})
+		}
+		params := &bot.SendMediaGroupParams{
+			ChatID:           qEntry.Message.Chat.ID,
+			ReplyToMessageID: qEntry.Message.ID,
+			Media:            media,
+		}
+		_, err := b.SendMediaGroup(ctx, params)
+		return err
+	})
+	if err != nil {
+		fmt.Println("  send error:", err)
+
+		if isTooLargeError(err) {
+			return u.sendLinks(ctx, qEntry, files)
+		}
+		return fmt.Errorf("send error: %w", err)
+	}
+
+	return nil
 }
 
-func (u *Upload) Audio(ctx context.Context, qEntry *ReqQueueEntry, f []UploadFileData, retryAllowed bool) error {
+func (u *Upload) Audio(ctx context.Context, qEntry *ReqQueueEntry, f []UploadFileData) error {
 	defer func() {
 		for i := range f {
 			f[i].r.Close()
@@ -63,34 +185,20 @@ func (u *Upload) Audio(ctx context.Context, qEntry *ReqQueueEntry, f []UploadFil
 	fmt.Println("  uploading...")
 	qEntry.sendUpdate(ctx, uploadingStr)
 
-	var media []models.InputMedia
+	var files []uploadFile
+	tooLarge := false
 	for i := range f {
-		media = append(media, &models.InputMediaAudio{
-			Media:           "attach://" + f[i].filename,
-			MediaAttachment: f[i].r,
-		})
-	}
-	params := &bot.SendMediaGroupParams{
-		ChatID:           qEntry.Message.Chat.ID,
-		ReplyToMessageID: qEntry.Message.ID,
-		Media:            media,
-	}
-	_, err := telegramBot.SendMediaGroup(ctx, params)
-	if err != nil {
-		fmt.Println("  send error:", err)
-
-		if !retryAllowed {
-			return fmt.Errorf("send error: %w", err)
+		file, err := u.spool(qEntry, f[i].r, i, f[i].filename)
+		if err != nil {
+			return err
 		}
-
-		retryAfter := qEntry.checkWaitError(err)
-		if retryAfter > 0 {
-			fmt.Println("  retrying after", retryAfter, "...")
-			time.Sleep(retryAfter)
-			return u.Audio(ctx, qEntry, f, false)
+		files = append(files, file)
+		if file.size > getMaxUploadSize() {
+			tooLarge = true
 		}
-		return err
 	}
-
-	return nil
+	if tooLarge {
+		return u.sendLinks(ctx, qEntry, files)
+	}
+	return u.uploadAudio(ctx, qEntry, files)
 }
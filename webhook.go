@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// In webhook mode Telegram sends the updates to the webhook server instead of the bot polling for them.
+// The webhook is registered at startup and removed on shutdown, so polling works again after a restart
+// without the webhook settings.
+
+const webhookDeleteTimeout = 10 * time.Second
+
+type Webhook struct {
+}
+
+func (w *Webhook) Enabled() bool {
+	return getParams().WebhookAddr != ""
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if getParams().WebhookSecret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")),
+		[]byte(getParams().WebhookSecret)) != 1 {
+		http.Error(rw, "invalid secret token", http.StatusUnauthorized)
+		return
+	}
+	telegramBot.WebhookHandler()(rw, r)
+}
+
+func (w *Webhook) register(ctx context.Context) error {
+	return telegramAPI.Do(ctx, 0, func(b *bot.Bot) error {
+		params := &bot.SetWebhookParams{
+			URL:         getParams().WebhookURL,
+			SecretToken: getParams().WebhookSecret,
+		}
+		// The certificate is uploaded, so Telegram accepts it if it's self-signed. The file is opened for
+		// each try, as the upload consumes it.
+		if getParams().WebhookCert != "" {
+			f, err := os.Open(getParams().WebhookCert)
+			if err != nil {
+				return fmt.Errorf("can't open webhook certificate: %w", err)
+			}
+			defer f.Close()
+			params.Certificate = &models.InputFileUpload{Filename: path.Base(getParams().WebhookCert), Data: f}
+		}
+		_, err := b.SetWebhook(ctx, params)
+		return err
+	})
+}
+
+func (w *Webhook) unregister() {
+	// The context of the bot is already cancelled at this point.
+	ctx, cancel := context.WithTimeout(context.Background(), webhookDeleteTimeout)
+	defer cancel()
+	_, err := telegramBot.DeleteWebhook(ctx, &bot.DeleteWebhookParams{})
+	if err != nil {
+		fmt.Println("can't remove webhook:", err)
+		return
+	}
+	fmt.Println("webhook removed")
+}
+
+// Registers the webhook and processes the updates until the context is cancelled.
+func (w *Webhook) Run(ctx context.Context) error {
+	u, err := url.Parse(getParams().WebhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	webhookPath := u.Path
+	if webhookPath == "" {
+		webhookPath = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, w)
+	server := &http.Server{Addr: getParams().WebhookAddr, Handler: mux}
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Println("webhook server listening on", getParams().WebhookAddr)
+		var err error
+		if getParams().WebhookCert != "" {
+			err = server.ListenAndServeTLS(getParams().WebhookCert, getParams().WebhookKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+	defer server.Close()
+
+	if err := w.register(ctx); err != nil {
+		return fmt.Errorf("can't register webhook: %w", err)
+	}
+	fmt.Println("webhook registered:", getParams().WebhookURL)
+	defer w.unregister()
+
+	done := make(chan struct{})
+	go func() {
+		telegramBot.StartWebhook(ctx)
+		close(done)
+	}()
+
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("webhook server error: %w", err)
+	case <-done:
+		return nil
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const workDirPrefix = "audio-ai-telegram-bot-"
+
+// Returns the directory which holds the task work directories of this bot instance. The directory
+// name contains the PID, so multiple bot instances on the same host won't collide.
+func getInstanceWorkDir() string {
+	return path.Join(os.TempDir(), workDirPrefix+fmt.Sprint(os.Getpid()))
+}
+
+func createWorkDir(taskID uint64) (string, error) {
+	dir := path.Join(getInstanceWorkDir(), fmt.Sprint(taskID))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("can't create work dir: %w", err)
+	}
+	return dir, nil
+}
+
+func removeWorkDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		fmt.Println("  can't remove work dir:", err)
+	}
+}
+
+func isProcessRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Removes work directories left behind by bot instances which are not running anymore.
+func sweepStaleWorkDirs() {
+	dirEntries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		fmt.Println("can't read temp dir:", err)
+		return
+	}
+
+	for _, d := range dirEntries {
+		if !d.IsDir() || !strings.HasPrefix(d.Name(), workDirPrefix) {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimPrefix(d.Name(), workDirPrefix))
+		if err != nil {
+			continue
+		}
+		if pid != os.Getpid() && isProcessRunning(pid) {
+			continue
+		}
+		fmt.Println("removing stale work dir", d.Name())
+		removeWorkDir(path.Join(os.TempDir(), d.Name()))
+	}
+}
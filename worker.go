@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Worker mode: the bot runs as a remote worker (see remote.go), connecting to the worker server of the
+// bot at the given URL and running the jobs it gets with the local backends.
+
+const workerRetryInterval = 5 * time.Second
+const workerAudioFileName = "remote-in"
+
+type Worker struct {
+	url    string
+	client http.Client
+}
+
+var errWorkerJobGone = fmt.Errorf("job canceled or requeued")
+
+func (w *Worker) post(ctx context.Context, endpoint, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url+remoteAPIPath+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+getParams().WorkerToken)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return resp, nil
+	case http.StatusGone:
+		resp.Body.Close()
+		return nil, errWorkerJobGone
+	}
+	d, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(d)))
+}
+
+func (w *Worker) postJSON(ctx context.Context, endpoint string, v any) (*http.Response, error) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return w.post(ctx, endpoint, "application/json", bytes.NewReader(d))
+}
+
+// Waits for a job from the bot. Returns nil if there's no job yet.
+func (w *Worker) poll(ctx context.Context, types []string) (*remoteJobData, error) {
+	// The bot replies in remotePollTimeout if there's no job.
+	ctx, cancel := context.WithTimeout(ctx, remotePollTimeout+30*time.Second)
+	defer cancel()
+	resp, err := w.postJSON(ctx, "poll", remotePollReq{Name: getParams().WorkerName, Types: types})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	var job remoteJobData
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("can't decode job: %w", err)
+	}
+	return &job, nil
+}
+
+// Sends progress updates and heartbeats of the job until the context is done. Cancels the job if the bot
+// doesn't need it anymore.
+func (w *Worker) sendProgress(ctx context.Context, cancel context.CancelFunc, jobID uint64, progressChan chan remoteProgress) {
+	endpoint := "progress?job=" + fmt.Sprint(jobID)
+	ticker := time.NewTicker(remoteHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		var p remoteProgress
+		select {
+		case <-ctx.Done():
+			return
+		case p = <-progressChan:
+		case <-ticker.C:
+			p.Heartbeat = true
+		}
+		resp, err := w.postJSON(ctx, endpoint, p)
+		if err == errWorkerJobGone {
+			fmt.Println("  job", jobID, "is not needed anymore, canceling")
+			cancel()
+			return
+		} else if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("  can't send progress:", err)
+			}
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// Downloads the input audio of the job to the work dir.
+func (w *Worker) getAudio(ctx context.Context, job *remoteJobData, workDir string) (AudioFileData, error) {
+	audioData := AudioFileData{path: path.Join(workDir, workerAudioFileName+path.Ext(job.AudioFilename)), filename: job.AudioFilename}
+	resp, err := w.post(ctx, "audio?job="+fmt.Sprint(job.ID), "application/octet-stream", nil)
+	if err != nil {
+		return audioData, fmt.Errorf("can't get audio: %w", err)
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(audioData.path)
+	if err != nil {
+		return audioData, fmt.Errorf("can't create audio file: %w", err)
+	}
+	defer f.Close()
+	n, err := io.Copy(f, resp.Body)
+	if err == nil && n != job.AudioSize {
+		err = fmt.Errorf("got %d bytes instead of %d", n, job.AudioSize)
+	}
+	if err != nil {
+		return audioData, fmt.Errorf("can't get audio: %w", err)
+	}
+	return audioData, nil
+}
+
+func closeBackendResult(res BackendResult) {
+	if res.Voice != nil {
+		res.Voice.Close()
+	}
+	for _, f := range res.Audio {
+		f.r.Close()
+	}
+}
+
+// Uploads the result of the job to the bot.
+func (w *Worker) sendResult(ctx context.Context, jobID uint64, res BackendResult, resErr error) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := func() error {
+			if resErr != nil {
+				return mw.WriteField("error", resErr.Error())
+			}
+			if res.Text != "" {
+				if err := mw.WriteField("text", res.Text); err != nil {
+					return err
+				}
+			}
+			if res.Voice != nil {
+				fw, err := mw.CreateFormFile("voice", "voice.ogg")
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(fw, res.Voice); err != nil {
+					return err
+				}
+			}
+			for _, f := range res.Audio {
+				fw, err := mw.CreateFormFile("audio", f.filename)
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(fw, f.r); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := w.post(ctx, "result?job="+fmt.Sprint(jobID), mw.FormDataContentType(), pr)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *Worker) runJob(ctx context.Context, job *remoteJobData) {
+	fmt.Print("running job ", job.ID, " of task ", job.TaskID, ": ", job.Type, "\n")
+
+	b := getBackend(job.Type)
+	reqParams, err := ReqParamsUnmarshal(job.Type, job.Params)
+	if err != nil {
+		fmt.Println("  can't decode request params:", err)
+		if err := w.sendResult(ctx, job.ID, BackendResult{}, fmt.Errorf("can't decode request params: %w", err)); err != nil {
+			fmt.Println("  can't send result:", err)
+		}
+		return
+	}
+	qEntry := &ReqQueueEntry{
+		TaskID: job.TaskID,
+		Req: ReqQueueReq{
+			Type:   job.Type,
+			Prompt: job.Prompt,
+			Params: reqParams,
+		},
+	}
+
+	timeout := job.Timeout
+	if timeout <= 0 {
+		timeout = defaultProcessTimeout
+	}
+	jobCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	progressChan := make(chan remoteProgress, 1)
+	qEntry.progressFunc = func(processDesc string, percent int) {
+		p := remoteProgress{Desc: processDesc, Percent: percent}
+		// Dropping the previous update if it hasn't been sent yet.
+		for {
+			select {
+			case progressChan <- p:
+				return
+			default:
+				select {
+				case <-progressChan:
+				default:
+				}
+			}
+		}
+	}
+	go w.sendProgress(jobCtx, cancel, job.ID, progressChan)
+
+	qEntry.WorkDir, err = createWorkDir(job.TaskID)
+	defer removeWorkDir(qEntry.WorkDir)
+	if err == nil && job.AudioSize > 0 {
+		qEntry.AudioData, err = w.getAudio(jobCtx, job, qEntry.WorkDir)
+	}
+	if err == nil {
+		err = b.Check(qEntry.Req)
+	}
+	var res BackendResult
+	if err == nil {
+		res, err = b.Run(jobCtx, qEntry)
+	}
+
+	if ctx.Err() != nil {
+		fmt.Println("  interrupted by shutdown")
+		closeBackendResult(res)
+		return
+	}
+	if jobCtx.Err() == context.Canceled {
+		fmt.Println("  canceled")
+		closeBackendResult(res)
+		return
+	}
+	if jobCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("processing took longer than " + timeout.String())
+	}
+	if err != nil {
+		fmt.Println("  error:", err)
+	}
+	err = w.sendResult(ctx, job.ID, res, err)
+	closeBackendResult(res)
+	if err != nil {
+		fmt.Println("  can't send result:", err)
+		return
+	}
+	fmt.Println("  done")
+}
+
+// Runs the worker until the context is done.
+func (w *Worker) Run(ctx context.Context) {
+	w.url = strings.TrimSuffix(getParams().WorkerConnect, "/")
+	sweepStaleWorkDirs()
+
+	report, _ := checkBackends(true)
+	fmt.Print("backend check:\n" + report)
+
+	var types []string
+	for _, reqType := range getParams().WorkerTypes {
+		if checkReqTypeEnabled(reqType) == nil {
+			types = append(types, reqType.String())
+		}
+	}
+	fmt.Println("worker", getParams().WorkerName, "connecting to", w.url, "with types", types)
+
+	for ctx.Err() == nil {
+		job, err := w.poll(ctx, types)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("poll error:", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(workerRetryInterval):
+				}
+			}
+			continue
+		}
+		if job != nil {
+			w.runJob(ctx, job)
+		}
+	}
+}